@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/ga0/netgraph/ngalert"
+	"github.com/ga0/netgraph/ngfilter"
+	"github.com/ga0/netgraph/ngnet"
+)
+
+// alertHandler evaluates the alerting rules of -alerts against the HTTP
+// transactions
+type alertHandler struct {
+	name   string
+	engine *ngalert.Engine
+	pairer *transactionPairer
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// newAlertHandler loads the rules of a config file. With a live capture,
+// the rules with window are evaluated every second, so they resolve when
+// the transactions stop.
+func newAlertHandler(name string, live bool) (*alertHandler, error) {
+	config, err := ngalert.LoadConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	engine, err := ngalert.New(config)
+	if err != nil {
+		return nil, err
+	}
+	h := new(alertHandler)
+	h.name = name
+	h.engine = engine
+	h.pairer = newTransactionPairer()
+	h.stop = make(chan struct{})
+	h.done = make(chan struct{})
+	if live {
+		engine.Clock = time.Now
+		go h.tick()
+	} else {
+		close(h.done)
+	}
+	log.Printf("%d alert rules loaded from %s\n", engine.Rules(), name)
+	return h, nil
+}
+
+func (h *alertHandler) tick() {
+	defer close(h.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.engine.Tick()
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+// PushEvent implements the function of interface NGHTTPEventHandler
+func (h *alertHandler) PushEvent(e ngnet.Event) {
+	t, _ := h.pairer.push(e)
+	if t == nil {
+		return
+	}
+	h.engine.Add(ngfilter.Transaction{Request: &t.Request, Response: t.Response})
+}
+
+// Reopen loads the rules again and reopens the files of the log actions.
+// The rules are kept if the config file has an error.
+func (h *alertHandler) Reopen() error {
+	config, err := ngalert.LoadConfig(h.name)
+	if err == nil {
+		err = h.engine.Load(config)
+	}
+	if err != nil {
+		log.Println("Cannot reload alert rules, the former ones are kept:", err)
+	} else {
+		log.Printf("%d alert rules reloaded from %s\n", h.engine.Rules(), h.name)
+	}
+	return h.engine.Reopen()
+}
+
+// Wait implements the function of interface NGHTTPEventHandler
+func (h *alertHandler) Wait() {
+	close(h.stop)
+	<-h.done
+	h.engine.Close()
+}
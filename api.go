@@ -0,0 +1,606 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ga0/netgraph/ngfilter"
+	"github.com/ga0/netgraph/nggraph"
+	"github.com/ga0/netgraph/ngnet"
+	"github.com/ga0/netgraph/ngstats"
+)
+
+const (
+	apiDefaultLimit = 100
+	apiMaxLimit     = 1000
+)
+
+// apiTransaction is a transaction in the list returned by /api/transactions
+type apiTransaction struct {
+	ID           string       `json:"id"`
+	StreamSeq    uint         `json:"stream_seq"`
+	Start        string       `json:"start"`
+	End          string       `json:"end"`
+	DurationMs   float64      `json:"duration_ms"`
+	ClientAddr   string       `json:"client_addr"`
+	ServerAddr   string       `json:"server_addr"`
+	ClientName   string       `json:"client_name,omitempty"`
+	ServerName   string       `json:"server_name,omitempty"`
+	ClientProc   *jsonProcess `json:"client_process,omitempty"`
+	ServerProc   *jsonProcess `json:"server_process,omitempty"`
+	Method       string       `json:"method"`
+	Host         string       `json:"host"`
+	URI          string       `json:"uri"`
+	Route        string       `json:"route,omitempty"`
+	Status       uint         `json:"status"`
+	RequestSize  int          `json:"request_size"`
+	ResponseSize int          `json:"response_size"`
+}
+
+type apiTransactionList struct {
+	Transactions []apiTransaction `json:"transactions"`
+	NextCursor   string           `json:"next_cursor,omitempty"`
+}
+
+type apiConnection struct {
+	StreamSeq    uint             `json:"stream_seq"`
+	ClientAddr   string           `json:"client_addr"`
+	ServerAddr   string           `json:"server_addr"`
+	Transactions []apiTransaction `json:"transactions"`
+}
+
+func transactionEnd(t *httpTransaction) time.Time {
+	if t.Response != nil {
+		return t.Response.End
+	}
+	return t.Request.End
+}
+
+func transactionDuration(t *httpTransaction) time.Duration {
+	return transactionEnd(t).Sub(t.Request.Start)
+}
+
+func transactionStatus(t *httpTransaction) uint {
+	if t.Response != nil {
+		return t.Response.Code
+	}
+	return 0
+}
+
+func newAPITransaction(t *httpTransaction) apiTransaction {
+	var a apiTransaction
+	a.ID = t.ID
+	a.StreamSeq = t.Request.StreamSeq
+	a.Start = formatJSONTime(t.Request.Start)
+	a.End = formatJSONTime(transactionEnd(t))
+	a.DurationMs = milliseconds(transactionDuration(t))
+	a.ClientAddr = t.Request.ClientAddr
+	a.ServerAddr = t.Request.ServerAddr
+	a.ClientName = t.Request.ClientName
+	a.ServerName = t.Request.ServerName
+	a.ClientProc = newJSONProcess(t.Request.ClientProcess)
+	a.ServerProc = newJSONProcess(t.Request.ServerProcess)
+	a.Method = t.Request.Method
+	a.Host = headerValue(t.Request.Headers, "Host")
+	a.URI = t.Request.URI
+	a.Route = t.Request.Route
+	a.Status = transactionStatus(t)
+	a.RequestSize = len(t.Request.Body)
+	if t.Response != nil {
+		a.ResponseSize = len(t.Response.Body)
+	}
+	return a
+}
+
+// transactionQuery is the filter, sort order and page of /api/transactions
+type transactionQuery struct {
+	host        string
+	method      string
+	pathGlob    string
+	route       string
+	minStatus   uint
+	maxStatus   uint
+	minDuration time.Duration
+	since       time.Time
+	until       time.Time
+	headers     []headerMatch
+	body        string
+	filter      *ngfilter.Filter
+
+	sortField string
+	desc      bool
+	limit     int
+	cursor    *apiCursor
+}
+
+// headerMatch matches a request or response header by name and value substring
+type headerMatch struct {
+	name  string
+	value string
+}
+
+// apiCursor points at the last transaction of a page
+type apiCursor struct {
+	Number float64 `json:"n,omitempty"`
+	String string  `json:"s,omitempty"`
+	ID     string  `json:"id"`
+}
+
+func (c *apiCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (*apiCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("bad cursor")
+	}
+	c := new(apiCursor)
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, errors.New("bad cursor")
+	}
+	return c, nil
+}
+
+func parseAPITime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("bad time %q, use RFC 3339 or unix seconds", s)
+}
+
+func parseTransactionQuery(v url.Values) (*transactionQuery, error) {
+	q := new(transactionQuery)
+	q.host = v.Get("host")
+	q.method = v.Get("method")
+	q.pathGlob = v.Get("path")
+	if q.pathGlob != "" {
+		if _, err := path.Match(q.pathGlob, "/"); err != nil {
+			return nil, fmt.Errorf("bad path glob %q", q.pathGlob)
+		}
+	}
+	q.route = v.Get("route")
+	var err error
+	if q.minStatus, q.maxStatus, err = parseCodeRange(v.Get("status")); err != nil {
+		return nil, err
+	}
+	if s := v.Get("min_duration"); s != "" {
+		if q.minDuration, err = time.ParseDuration(s); err != nil {
+			return nil, fmt.Errorf("bad min_duration %q", s)
+		}
+	}
+	if s := v.Get("since"); s != "" {
+		if q.since, err = parseAPITime(s); err != nil {
+			return nil, err
+		}
+	}
+	if s := v.Get("until"); s != "" {
+		if q.until, err = parseAPITime(s); err != nil {
+			return nil, err
+		}
+	}
+	for _, h := range v["header"] {
+		p := strings.Index(h, ":")
+		if p == -1 {
+			return nil, fmt.Errorf("bad header %q, use Name:value", h)
+		}
+		q.headers = append(q.headers, headerMatch{strings.TrimSpace(h[:p]), strings.TrimSpace(h[p+1:])})
+	}
+	q.body = v.Get("body")
+	if s := v.Get("filter"); s != "" {
+		if q.filter, err = ngfilter.Parse(s); err != nil {
+			return nil, fmt.Errorf("bad filter: %v", err)
+		}
+	}
+
+	q.sortField = "start"
+	if s := v.Get("sort"); s != "" {
+		q.desc = strings.HasPrefix(s, "-")
+		q.sortField = strings.TrimPrefix(s, "-")
+	}
+	switch q.sortField {
+	case "start", "duration", "status", "host", "uri", "route":
+	default:
+		return nil, fmt.Errorf("bad sort field %q", q.sortField)
+	}
+	q.limit = apiDefaultLimit
+	if s := v.Get("limit"); s != "" {
+		if q.limit, err = strconv.Atoi(s); err != nil || q.limit <= 0 {
+			return nil, fmt.Errorf("bad limit %q", s)
+		}
+		if q.limit > apiMaxLimit {
+			q.limit = apiMaxLimit
+		}
+	}
+	if s := v.Get("cursor"); s != "" {
+		if q.cursor, err = decodeCursor(s); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+func headersMatch(t *httpTransaction, m headerMatch) bool {
+	contains := func(value string) bool {
+		return strings.Contains(value, m.value)
+	}
+	for _, h := range t.Request.Headers {
+		if strings.EqualFold(h.Name, m.name) && contains(h.Value) {
+			return true
+		}
+	}
+	if t.Response != nil {
+		for _, h := range t.Response.Headers {
+			if strings.EqualFold(h.Name, m.name) && contains(h.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (q *transactionQuery) match(t *httpTransaction) bool {
+	req := t.Request
+	if q.host != "" {
+		host := headerValue(req.Headers, "Host")
+		if !strings.EqualFold(host, q.host) && !strings.EqualFold(hostOf(host), q.host) {
+			return false
+		}
+	}
+	if q.method != "" && !strings.EqualFold(req.Method, q.method) {
+		return false
+	}
+	if q.pathGlob != "" {
+		p := req.URI
+		if u, err := url.Parse(requestURL(req)); err == nil {
+			p = u.Path
+		}
+		if ok, _ := path.Match(q.pathGlob, p); !ok {
+			return false
+		}
+	}
+	if q.route != "" && req.Route != q.route {
+		return false
+	}
+	if q.maxStatus != 0 {
+		status := transactionStatus(t)
+		if status < q.minStatus || status > q.maxStatus {
+			return false
+		}
+	}
+	if q.minDuration > 0 && (t.Response == nil || transactionDuration(t) < q.minDuration) {
+		return false
+	}
+	if !q.since.IsZero() && req.Start.Before(q.since) {
+		return false
+	}
+	if !q.until.IsZero() && !req.Start.Before(q.until) {
+		return false
+	}
+	for _, h := range q.headers {
+		if !headersMatch(t, h) {
+			return false
+		}
+	}
+	if q.body != "" {
+		found := strings.Contains(string(req.Body), q.body)
+		if !found && t.Response != nil {
+			found = strings.Contains(string(t.Response.Body), q.body)
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.filter != nil && !matchTransaction(q.filter, t) {
+		return false
+	}
+	return true
+}
+
+// sortKey returns the key of the transaction for the sort field
+func (q *transactionQuery) sortKey(t *httpTransaction) apiCursor {
+	c := apiCursor{ID: t.ID}
+	switch q.sortField {
+	case "start":
+		c.Number = float64(t.Request.Start.UnixNano())
+	case "duration":
+		c.Number = milliseconds(transactionDuration(t))
+	case "status":
+		c.Number = float64(transactionStatus(t))
+	case "host":
+		c.String = headerValue(t.Request.Headers, "Host")
+	case "uri":
+		c.String = t.Request.URI
+	case "route":
+		c.String = t.Request.Route
+	}
+	return c
+}
+
+// less compares sort keys, the transaction ID breaks ties
+func (q *transactionQuery) less(a, b apiCursor) bool {
+	var r int
+	switch {
+	case a.Number < b.Number:
+		r = -1
+	case a.Number > b.Number:
+		r = 1
+	case a.String < b.String:
+		r = -1
+	case a.String > b.String:
+		r = 1
+	case a.ID < b.ID:
+		r = -1
+	case a.ID > b.ID:
+		r = 1
+	}
+	if q.desc {
+		return r > 0
+	}
+	return r < 0
+}
+
+func (q *transactionQuery) run(ts []*httpTransaction) *apiTransactionList {
+	type keyed struct {
+		key apiCursor
+		t   *httpTransaction
+	}
+	var matched []keyed
+	for _, t := range ts {
+		if !q.match(t) {
+			continue
+		}
+		k := keyed{q.sortKey(t), t}
+		if q.cursor != nil && !q.less(*q.cursor, k.key) {
+			continue
+		}
+		matched = append(matched, k)
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return q.less(matched[i].key, matched[j].key)
+	})
+
+	list := new(apiTransactionList)
+	list.Transactions = []apiTransaction{}
+	for i, k := range matched {
+		if i == q.limit {
+			list.NextCursor = matched[i-1].key.encode()
+			break
+		}
+		list.Transactions = append(list.Transactions, newAPITransaction(k.t))
+	}
+	return list
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeAPIJSON(w, status, map[string]string{"error": msg})
+}
+
+func (s *NGServer) apiAvailable(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "GET" {
+		writeAPIError(w, http.StatusMethodNotAllowed, "only GET is allowed")
+		return false
+	}
+	if s.store == nil {
+		writeAPIError(w, http.StatusNotFound, "events are not saved, run netgraph with option -s")
+		return false
+	}
+	return true
+}
+
+// GET /api/transactions lists the saved transactions. Query parameters:
+//
+//	host, method, path (glob), route, status (range like 500-599), min_duration (like 200ms),
+//	since, until (RFC 3339 or unix seconds), header (Name:value, repeatable), body (substring),
+//	filter (filter expression), sort (start, duration, status, host, uri, route, "-" prefix for descending),
+//	limit, cursor
+func (s *NGServer) handleAPITransactions(w http.ResponseWriter, r *http.Request) {
+	if !s.apiAvailable(w, r) {
+		return
+	}
+	q, err := parseTransactionQuery(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var events []ngnet.Event
+	if !q.since.IsZero() {
+		events = s.store.Since(q.since)
+	} else {
+		events = s.store.Events()
+	}
+	writeAPIJSON(w, http.StatusOK, q.run(pairEvents(events)))
+}
+
+// GET /api/transactions/{id} returns a transaction with headers and bodies.
+func (s *NGServer) handleAPITransaction(w http.ResponseWriter, r *http.Request) {
+	if !s.apiAvailable(w, r) {
+		return
+	}
+	t, err := s.findTransaction(strings.TrimPrefix(r.URL.Path, "/api/transactions/"))
+	if err == errBadTransactionID {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if t == nil {
+		writeAPIError(w, http.StatusNotFound, "transaction not found")
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, newJSONTransaction(t))
+}
+
+var errBadTransactionID = errors.New("bad transaction id")
+
+// findTransaction returns the saved transaction with the ID, or nil if it is not saved
+func (s *NGServer) findTransaction(id string) (*httpTransaction, error) {
+	p := strings.Index(id, ".")
+	if p == -1 {
+		return nil, errBadTransactionID
+	}
+	seq, err := strconv.ParseUint(id[:p], 10, 32)
+	if err != nil {
+		return nil, errBadTransactionID
+	}
+	for _, t := range pairEvents(s.store.BySeq(uint(seq))) {
+		if t.ID == id {
+			return t, nil
+		}
+	}
+	return nil, nil
+}
+
+// GET /api/connections/{seq} returns the transactions of a TCP connection.
+func (s *NGServer) handleAPIConnection(w http.ResponseWriter, r *http.Request) {
+	if !s.apiAvailable(w, r) {
+		return
+	}
+	seq, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/api/connections/"), 10, 32)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad connection sequence number")
+		return
+	}
+	ts := pairEvents(s.store.BySeq(uint(seq)))
+	if len(ts) == 0 {
+		writeAPIError(w, http.StatusNotFound, "connection not found")
+		return
+	}
+	c := apiConnection{StreamSeq: uint(seq)}
+	c.ClientAddr = ts[0].Request.ClientAddr
+	c.ServerAddr = ts[0].Request.ServerAddr
+	c.Transactions = []apiTransaction{}
+	for _, t := range ts {
+		c.Transactions = append(c.Transactions, newAPITransaction(t))
+	}
+	writeAPIJSON(w, http.StatusOK, c)
+}
+
+// apiEndpointList is the result of /api/endpoints and of the websocket command "endpoints"
+type apiEndpointList struct {
+	Window    string                  `json:"window"`
+	Endpoints []ngstats.EndpointStats `json:"endpoints"`
+}
+
+// endpointStats returns the statistics of the endpoints over the window
+// ("1m", "5m" or "15m"), sorted by a field with an optional "-" prefix for
+// descending, for a host if it is not empty
+func (s *NGServer) endpointStats(window string, sortBy string, limit int, host string) (*apiEndpointList, error) {
+	if window == "" {
+		window = "5m"
+	}
+	d, err := time.ParseDuration(window)
+	valid := false
+	for _, w := range ngstats.Windows {
+		valid = valid || (err == nil && d == w)
+	}
+	if !valid {
+		return nil, fmt.Errorf("bad window %q, use 1m, 5m or 15m", window)
+	}
+	if sortBy == "" {
+		sortBy = "-requests"
+	}
+	if limit < 0 {
+		return nil, errors.New("bad limit")
+	}
+	if limit == 0 {
+		limit = apiDefaultLimit
+	} else if limit > apiMaxLimit {
+		limit = apiMaxLimit
+	}
+
+	list := &apiEndpointList{Window: window, Endpoints: []ngstats.EndpointStats{}}
+	for _, st := range s.endpoints.Stats(d) {
+		if host == "" || strings.EqualFold(st.Host, host) || strings.EqualFold(hostOf(st.Host), host) {
+			list.Endpoints = append(list.Endpoints, st)
+		}
+	}
+	if err := ngstats.Sort(list.Endpoints, strings.TrimPrefix(sortBy, "-"), strings.HasPrefix(sortBy, "-")); err != nil {
+		return nil, err
+	}
+	if len(list.Endpoints) > limit {
+		list.Endpoints = list.Endpoints[:limit]
+	}
+	return list, nil
+}
+
+// GET /api/endpoints returns the statistics of the endpoints (host and
+// route). Query parameters: window (1m, 5m or 15m), host, sort (requests,
+// rate, client_error_rate, server_error_rate, p50, p90, p99, bytes_in,
+// bytes_out, host or route, "-" prefix for descending), limit
+func (s *NGServer) handleAPIEndpoints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeAPIError(w, http.StatusMethodNotAllowed, "only GET is allowed")
+		return
+	}
+	v := r.URL.Query()
+	limit := 0
+	if l := v.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("bad limit %q", l))
+			return
+		}
+	}
+	list, err := s.endpointStats(v.Get("window"), v.Get("sort"), limit, v.Get("host"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, list)
+}
+
+// graphView returns the dependency graph with the nodes grouped by ip, host
+// or name, host if group is empty
+func (s *NGServer) graphView(group string) (*nggraph.View, error) {
+	if group == "" {
+		group = nggraph.GroupHost
+	}
+	return s.graph.View(group)
+}
+
+// GET /api/graph returns the dependency graph of the clients and services.
+// Query parameters: group (ip, host or name, default host), format (json
+// or dot)
+func (s *NGServer) handleAPIGraph(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeAPIError(w, http.StatusMethodNotAllowed, "only GET is allowed")
+		return
+	}
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format != "" && format != "json" && format != "dot" {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("bad format %q, use json or dot", format))
+		return
+	}
+	v, err := s.graphView(q.Get("group"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if format == "dot" {
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+		fmt.Fprint(w, v.DOT())
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, v)
+}
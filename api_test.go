@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ga0/netgraph/ngnet"
+	"github.com/ga0/netgraph/ngstore"
+)
+
+var apiTestStart = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// addTestTransaction pushes a request, its response and their transaction,
+// which starts seq seconds after apiTestStart and lasts seq*10ms
+func addTestTransaction(s *NGServer, seq uint, host, route string, status uint) {
+	req := testRequest(seq, apiTestStart.Add(time.Duration(seq)*time.Second))
+	req.Type = ngnet.KindHTTPRequest
+	req.Headers = []ngnet.HTTPHeaderItem{{Name: "Host", Value: host}}
+	req.URI = route
+	req.Route = route
+	req.End = req.Start
+	var resp ngnet.HTTPResponseEvent
+	resp.Type = ngnet.KindHTTPResponse
+	resp.ID = ngnet.ResponseID(seq, 0)
+	resp.RequestID = req.ID
+	resp.StreamSeq = seq
+	resp.Code = status
+	resp.Start = req.Start
+	resp.End = req.Start.Add(time.Duration(seq) * 10 * time.Millisecond)
+	t := ngnet.NewTransactionEvent(req)
+	t.Response = &resp
+	s.PushEvent(req)
+	s.PushEvent(resp)
+	s.PushEvent(*t)
+}
+
+func newAPITestServer(t *testing.T) *httptest.Server {
+	s := NewNGServer("", ngstore.NewMemoryStore(ngstore.Limits{}), 16, false, nil)
+	addTestTransaction(s, 0, "a.example.com", "/c", 200)
+	addTestTransaction(s, 1, "b.example.com", "/b", 500)
+	addTestTransaction(s, 2, "a.example.com", "/a", 200)
+	addTestTransaction(s, 3, "c.example.com", "/a", 500)
+	addTestTransaction(s, 4, "b.example.com", "/b", 200)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/transactions", s.handleAPITransactions)
+	mux.HandleFunc("/api/transactions/", s.handleAPITransaction)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func getAPIList(t *testing.T, ts *httptest.Server, query string) (int, *apiTransactionList) {
+	resp, err := http.Get(ts.URL + "/api/transactions?" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	list := new(apiTransactionList)
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(list); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, list
+}
+
+func listIDs(list *apiTransactionList) []string {
+	ids := []string{}
+	for _, t := range list.Transactions {
+		ids = append(ids, t.ID)
+	}
+	return ids
+}
+
+func TestAPITransactionsSort(t *testing.T) {
+	ts := newAPITestServer(t)
+	tests := []struct {
+		query string
+		ids   []string
+	}{
+		{"", []string{"0.0", "1.0", "2.0", "3.0", "4.0"}},
+		{"sort=-start", []string{"4.0", "3.0", "2.0", "1.0", "0.0"}},
+		{"sort=-duration", []string{"4.0", "3.0", "2.0", "1.0", "0.0"}},
+		// the ID breaks the ties, in the order of the sort
+		{"sort=status", []string{"0.0", "2.0", "4.0", "1.0", "3.0"}},
+		{"sort=-status", []string{"3.0", "1.0", "4.0", "2.0", "0.0"}},
+		{"sort=host", []string{"0.0", "2.0", "1.0", "4.0", "3.0"}},
+		{"sort=route", []string{"2.0", "3.0", "1.0", "4.0", "0.0"}},
+		{"sort=-uri", []string{"0.0", "4.0", "1.0", "3.0", "2.0"}},
+		{"status=500-599&sort=-start", []string{"3.0", "1.0"}},
+		{"route=/b", []string{"1.0", "4.0"}},
+	}
+	for _, test := range tests {
+		code, list := getAPIList(t, ts, test.query)
+		if code != http.StatusOK {
+			t.Errorf("%q: status %d", test.query, code)
+			continue
+		}
+		if ids := listIDs(list); !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("%q: %v, want %v", test.query, ids, test.ids)
+		}
+		if list.NextCursor != "" {
+			t.Errorf("%q: cursor on the last page", test.query)
+		}
+	}
+}
+
+func TestAPITransactionsPages(t *testing.T) {
+	ts := newAPITestServer(t)
+	for _, sort := range []string{"start", "-start", "status", "-status", "host"} {
+		_, all := getAPIList(t, ts, "sort="+sort)
+		var ids []string
+		v := url.Values{"sort": {sort}, "limit": {"2"}}
+		for pages := 0; ; pages++ {
+			if pages == 3 {
+				t.Fatalf("sort %s: too many pages", sort)
+			}
+			code, list := getAPIList(t, ts, v.Encode())
+			if code != http.StatusOK {
+				t.Fatalf("sort %s: status %d", sort, code)
+			}
+			ids = append(ids, listIDs(list)...)
+			if list.NextCursor == "" {
+				break
+			}
+			v.Set("cursor", list.NextCursor)
+		}
+		if want := listIDs(all); !reflect.DeepEqual(ids, want) {
+			t.Errorf("sort %s: pages %v, want %v", sort, ids, want)
+		}
+	}
+}
+
+func TestAPITransactionsBadQuery(t *testing.T) {
+	ts := newAPITestServer(t)
+	for _, query := range []string{
+		"sort=size",
+		"sort=-",
+		"cursor=!!",
+		"cursor=" + url.QueryEscape("bm90IGpzb24"), // "not json"
+		"limit=0",
+		"limit=x",
+		"status=abc",
+		"min_duration=fast",
+		"since=yesterday",
+		"filter=" + url.QueryEscape("status >="),
+	} {
+		if code, _ := getAPIList(t, ts, query); code != http.StatusBadRequest {
+			t.Errorf("%q: status %d", query, code)
+		}
+	}
+}
+
+func TestAPICursor(t *testing.T) {
+	for _, c := range []apiCursor{
+		{Number: 1.5, ID: "1.0"},
+		{String: "/a?b=c", ID: "12.3"},
+		{ID: "0.0"},
+	} {
+		decoded, err := decodeCursor(c.encode())
+		if err != nil || *decoded != c {
+			t.Errorf("%+v decoded as %+v, %v", c, decoded, err)
+		}
+	}
+
+	q, err := parseTransactionQuery(url.Values{"limit": {"100000"}})
+	if err != nil || q.limit != apiMaxLimit {
+		t.Errorf("limit not clamped: %v %v", q, err)
+	}
+	q, err = parseTransactionQuery(url.Values{})
+	if err != nil || q.limit != apiDefaultLimit || q.sortField != "start" || q.desc {
+		t.Errorf("bad defaults: %+v %v", q, err)
+	}
+}
+
+func TestAPITransaction(t *testing.T) {
+	ts := newAPITestServer(t)
+	for _, test := range []struct {
+		id   string
+		code int
+	}{
+		{"3.0", http.StatusOK},
+		{"3.1", http.StatusNotFound},
+		{"9.0", http.StatusNotFound},
+		{"3", http.StatusBadRequest},
+	} {
+		resp, err := http.Get(ts.URL + "/api/transactions/" + test.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var j jsonTransaction
+		json.NewDecoder(resp.Body).Decode(&j)
+		resp.Body.Close()
+		if resp.StatusCode != test.code {
+			t.Errorf("%s: status %d", test.id, resp.StatusCode)
+		}
+		if test.code == http.StatusOK && (j.ID != test.id || j.Response == nil || j.Response.Status != 500) {
+			t.Errorf("%s: bad transaction %+v", test.id, j)
+		}
+	}
+}
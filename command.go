@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/ga0/netgraph/ngfilter"
+	"github.com/ga0/netgraph/ngstore"
+)
+
+// protocolVersion is the version of the websocket command protocol, see PROTOCOL.md
+const protocolVersion = 1
+
+// wsCommand is a command sent by a websocket client
+type wsCommand struct {
+	Version   int             `json:"version"`
+	RequestID json.RawMessage `json:"request_id"` // any JSON value, returned in the reply
+	Command   string          `json:"command"`
+
+	Filter string `json:"filter"` // subscribe
+	Since  string `json:"since"`  // sync
+	Limit  int    `json:"limit"`  // sync, endpoints
+	ID     string `json:"id"`     // get_body
+	Window string `json:"window"` // endpoints
+	Sort   string `json:"sort"`   // endpoints
+	Host   string `json:"host"`   // endpoints
+	Group  string `json:"group"`  // graph
+}
+
+// wsReply is the answer to a command. Error is set if the command failed.
+type wsReply struct {
+	Type      string
+	Version   int
+	RequestID json.RawMessage `json:",omitempty"`
+	Command   string
+	Error     string      `json:",omitempty"`
+	Result    interface{} `json:",omitempty"`
+}
+
+func newReply(cmd *wsCommand, result interface{}) wsReply {
+	return wsReply{"Reply", protocolVersion, cmd.RequestID, cmd.Command, "", result}
+}
+
+// newErrorReply returns the error reply of a command, cmd is nil if the
+// command could not be decoded
+func newErrorReply(cmd *wsCommand, msg string) wsReply {
+	r := wsReply{Type: "Reply", Version: protocolVersion, Error: msg}
+	if cmd != nil {
+		r.RequestID = cmd.RequestID
+		r.Command = cmd.Command
+	}
+	return r
+}
+
+type wsSubscribeResult struct {
+	Filter string
+}
+
+type wsSyncResult struct {
+	Events int
+}
+
+type wsResumeResult struct {
+	Missed uint64
+}
+
+type wsClearResult struct {
+	Cleared int
+}
+
+type wsBody struct {
+	Body         string
+	BodyEncoding string
+}
+
+type wsBodyResult struct {
+	ID       string
+	Request  wsBody
+	Response *wsBody
+}
+
+type wsStatsResult struct {
+	Store   *ngstore.Stats `json:",omitempty"`
+	Filter  string
+	Paused  bool
+	Queued  int
+	Dropped uint64
+	Missed  uint64
+}
+
+func (c *NGClient) processJSONCommand(msg string) {
+	cmd := new(wsCommand)
+	if err := json.Unmarshal([]byte(msg), cmd); err != nil {
+		c.reply(newErrorReply(nil, "malformed command: "+err.Error()))
+		return
+	}
+	if cmd.Version != 0 && cmd.Version != protocolVersion {
+		c.reply(newErrorReply(cmd, "unsupported protocol version"))
+		return
+	}
+	switch cmd.Command {
+	case "subscribe":
+		c.subscribe(cmd)
+	case "pause":
+		atomic.StoreInt32(&c.paused, 1)
+		c.reply(newReply(cmd, nil))
+	case "resume":
+		atomic.StoreInt32(&c.paused, 0)
+		c.reply(newReply(cmd, wsResumeResult{atomic.SwapUint64(&c.missed, 0)}))
+	case "clear":
+		c.clear(cmd)
+	case "sync":
+		c.syncSince(cmd)
+	case "get_body":
+		c.getBody(cmd)
+	case "stats":
+		c.stats(cmd)
+	case "endpoints":
+		c.endpoints(cmd)
+	case "graph":
+		c.graph(cmd)
+	case "":
+		c.reply(newErrorReply(cmd, "missing command"))
+	default:
+		c.reply(newErrorReply(cmd, "unknown command"))
+	}
+}
+
+// subscribe sets the filter of the live events, an empty filter removes it
+func (c *NGClient) subscribe(cmd *wsCommand) {
+	var f *ngfilter.Filter
+	if cmd.Filter != "" {
+		var err error
+		if f, err = ngfilter.Parse(cmd.Filter); err != nil {
+			c.reply(newErrorReply(cmd, "bad filter: "+err.Error()))
+			return
+		}
+	}
+	c.setFilter(f)
+	c.reply(newReply(cmd, wsSubscribeResult{cmd.Filter}))
+}
+
+// clear discards the events queued for the client and the requests held
+// back by the filter
+func (c *NGClient) clear(cmd *wsCommand) {
+	n := 0
+	for drained := false; !drained; {
+		select {
+		case <-c.eventChan:
+			n++
+		default:
+			drained = true
+		}
+	}
+	c.setFilter(c.currentFilter())
+	c.reply(newReply(cmd, wsClearResult{n}))
+}
+
+func (c *NGClient) syncSince(cmd *wsCommand) {
+	if c.server.store == nil {
+		c.reply(newErrorReply(cmd, "events are not saved, run netgraph with option -s"))
+		return
+	}
+	var since time.Time
+	if cmd.Since != "" {
+		var err error
+		if since, err = parseAPITime(cmd.Since); err != nil {
+			c.reply(newErrorReply(cmd, err.Error()))
+			return
+		}
+	}
+	if cmd.Limit < 0 {
+		c.reply(newErrorReply(cmd, "bad limit"))
+		return
+	}
+	events := c.server.savedEvents(c.currentFilter(), since, cmd.Limit)
+	c.reply(append(messages(events), newStoreStatsEvent(c.server.store.Stats()), newReply(cmd, wsSyncResult{len(events)}))...)
+}
+
+func (c *NGClient) getBody(cmd *wsCommand) {
+	if c.server.store == nil {
+		c.reply(newErrorReply(cmd, "events are not saved, run netgraph with option -s"))
+		return
+	}
+	t, err := c.server.findTransaction(cmd.ID)
+	if err != nil {
+		c.reply(newErrorReply(cmd, err.Error()))
+		return
+	}
+	if t == nil {
+		c.reply(newErrorReply(cmd, "transaction not found"))
+		return
+	}
+	var r wsBodyResult
+	r.ID = t.ID
+	r.Request.Body, r.Request.BodyEncoding = jsonBody(t.Request.Headers, t.Request.Body)
+	if t.Response != nil {
+		r.Response = new(wsBody)
+		r.Response.Body, r.Response.BodyEncoding = jsonBody(t.Response.Headers, t.Response.Body)
+	}
+	c.reply(newReply(cmd, r))
+}
+
+func (c *NGClient) stats(cmd *wsCommand) {
+	var r wsStatsResult
+	if c.server.store != nil {
+		st := c.server.store.Stats()
+		r.Store = &st
+	}
+	if f := c.currentFilter(); f != nil {
+		r.Filter = f.String()
+	}
+	r.Paused = atomic.LoadInt32(&c.paused) != 0
+	r.Queued = len(c.eventChan)
+	r.Dropped = atomic.LoadUint64(&c.dropped)
+	r.Missed = atomic.LoadUint64(&c.missed)
+	c.reply(newReply(cmd, r))
+}
+
+func (c *NGClient) endpoints(cmd *wsCommand) {
+	list, err := c.server.endpointStats(cmd.Window, cmd.Sort, cmd.Limit, cmd.Host)
+	if err != nil {
+		c.reply(newErrorReply(cmd, err.Error()))
+		return
+	}
+	c.reply(newReply(cmd, list))
+}
+
+func (c *NGClient) graph(cmd *wsCommand) {
+	v, err := c.server.graphView(cmd.Group)
+	if err != nil {
+		c.reply(newErrorReply(cmd, err.Error()))
+		return
+	}
+	c.reply(newReply(cmd, v))
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ga0/netgraph/ngstore"
+	"golang.org/x/net/websocket"
+)
+
+// wsMessage is a message of the server, decoded loosely
+type wsMessage map[string]interface{}
+
+func (m wsMessage) result() map[string]interface{} {
+	r, _ := m["Result"].(map[string]interface{})
+	return r
+}
+
+func receiveMessage(t *testing.T, ws *websocket.Conn) wsMessage {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var m wsMessage
+	if err := websocket.JSON.Receive(ws, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// command sends a command and returns the messages received before its
+// reply, and the reply
+func command(t *testing.T, ws *websocket.Conn, cmd string) ([]wsMessage, wsMessage) {
+	if err := websocket.Message.Send(ws, cmd); err != nil {
+		t.Fatal(err)
+	}
+	var before []wsMessage
+	for {
+		m := receiveMessage(t, ws)
+		if m["Type"] == "Reply" {
+			return before, m
+		}
+		before = append(before, m)
+	}
+}
+
+func newCommandTestServer(t *testing.T) (*NGServer, *websocket.Conn) {
+	s := NewNGServer("", ngstore.NewMemoryStore(ngstore.Limits{}), 16, false, nil)
+	addTestTransaction(s, 0, "a.example.com", "/a", 200)
+	addTestTransaction(s, 1, "b.example.com", "/b", 500)
+	return s, newTestClient(t, s)
+}
+
+func TestCommandReplies(t *testing.T) {
+	_, ws := newCommandTestServer(t)
+	tests := []struct {
+		cmd    string
+		err    bool
+		result string // a field of the result
+	}{
+		{`{"version": 1, "request_id": 7, "command": "stats"}`, false, "Store"},
+		{`{"command": "subscribe", "filter": "status >= 500"}`, false, "Filter"},
+		{`{"command": "subscribe", "filter": "status >="}`, true, ""},
+		{`{"command": "pause"}`, false, ""},
+		{`{"command": "resume"}`, false, "Missed"},
+		{`{"command": "clear"}`, false, "Cleared"},
+		{`{"command": "sync", "limit": 10}`, false, "Events"},
+		{`{"command": "sync", "since": "yesterday"}`, true, ""},
+		{`{"command": "sync", "limit": -1}`, true, ""},
+		{`{"command": "get_body", "id": "1.0"}`, false, "Request"},
+		{`{"command": "get_body", "id": "9.0"}`, true, ""},
+		{`{"command": "get_body", "id": "x"}`, true, ""},
+		{`{"command": "endpoints", "window": "1m"}`, false, "endpoints"},
+		{`{"command": "endpoints", "window": "2m"}`, true, ""},
+		{`{"command": "graph", "group": "ip"}`, false, "nodes"},
+		{`{"command": "graph", "group": "port"}`, true, ""},
+		{`{"version": 2, "command": "stats"}`, true, ""},
+		{`{"command": "unknown"}`, true, ""},
+		{`{}`, true, ""},
+		{`{"command"`, true, ""},
+	}
+	for _, test := range tests {
+		_, reply := command(t, ws, test.cmd)
+		if reply["Version"] != float64(protocolVersion) {
+			t.Errorf("%s: bad version %v", test.cmd, reply["Version"])
+		}
+		_, failed := reply["Error"]
+		if failed != test.err {
+			t.Errorf("%s: error %v", test.cmd, reply["Error"])
+			continue
+		}
+		if test.result != "" {
+			if _, ok := reply.result()[test.result]; !ok {
+				t.Errorf("%s: no %s in %v", test.cmd, test.result, reply["Result"])
+			}
+		}
+	}
+
+	_, reply := command(t, ws, `{"request_id": {"n": 7}, "command": "stats"}`)
+	if id, _ := json.Marshal(reply["RequestID"]); string(id) != `{"n":7}` || reply["Command"] != "stats" {
+		t.Errorf("request id not returned: %v", reply)
+	}
+	_, reply = command(t, ws, `{"command"`)
+	if _, ok := reply["RequestID"]; ok {
+		t.Errorf("request id in the reply of a malformed command: %v", reply)
+	}
+}
+
+func TestCommandSync(t *testing.T) {
+	_, ws := newCommandTestServer(t)
+	events, reply := command(t, ws, `{"command": "sync"}`)
+	// the requests, the responses and the store stats
+	if len(events) != 5 || events[4]["Type"] != "StoreStats" || reply.result()["Events"] != float64(4) {
+		t.Fatalf("bad sync: %v %v", events, reply)
+	}
+
+	command(t, ws, `{"command": "subscribe", "filter": "status >= 500"}`)
+	events, reply = command(t, ws, `{"command": "sync"}`)
+	if len(events) != 3 || events[0]["ID"] != "1.0:request" || reply.result()["Events"] != float64(2) {
+		t.Fatalf("bad filtered sync: %v %v", events, reply)
+	}
+
+	_, reply = command(t, ws, `{"command": "get_body", "id": "1.0"}`)
+	if r := reply.result(); r["ID"] != "1.0" || r["Response"] == nil {
+		t.Errorf("bad body: %v", reply)
+	}
+}
+
+func TestCommandsGateLiveEvents(t *testing.T) {
+	s, ws := newCommandTestServer(t)
+
+	command(t, ws, `{"command": "pause"}`)
+	addTestTransaction(s, 2, "a.example.com", "/a", 200)
+	_, reply := command(t, ws, `{"command": "stats"}`)
+	if r := reply.result(); r["Paused"] != true || r["Missed"] != float64(2) {
+		t.Errorf("bad stats while paused: %v", reply)
+	}
+	_, reply = command(t, ws, `{"command": "resume"}`)
+	if reply.result()["Missed"] != float64(2) {
+		t.Errorf("bad resume: %v", reply)
+	}
+
+	// the events of the transaction which doesn't match are not sent, and
+	// they would be before the events of the next one
+	command(t, ws, `{"command": "subscribe", "filter": "status >= 500"}`)
+	addTestTransaction(s, 3, "a.example.com", "/a", 200)
+	addTestTransaction(s, 4, "b.example.com", "/b", 500)
+	for _, id := range []string{"4.0:request", "4.0:response"} {
+		if m := receiveMessage(t, ws); m["ID"] != id {
+			t.Fatalf("received %v, want %s", m, id)
+		}
+	}
+
+	command(t, ws, `{"command": "subscribe"}`)
+	addTestTransaction(s, 5, "a.example.com", "/a", 200)
+	if m := receiveMessage(t, ws); m["ID"] != "5.0:request" {
+		t.Fatalf("received %v after the filter is removed", m)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"github.com/ga0/netgraph/ngfilter"
+	"github.com/ga0/netgraph/ngnet"
+)
+
+func matchTransaction(f *ngfilter.Filter, t *httpTransaction) bool {
+	return f.Match(ngfilter.Transaction{Request: &t.Request, Response: t.Response})
+}
+
+// eventFilter passes the events of the transactions matching a filter
+// expression. If the expression needs the response, the request is held
+// back until its response arrives, or until it is forgotten without
+// response.
+type eventFilter struct {
+	filter  *ngfilter.Filter
+	pairer  *transactionPairer
+	expired []ngnet.Event // requests without response to pass on
+}
+
+func newEventFilter(f *ngfilter.Filter) *eventFilter {
+	ef := new(eventFilter)
+	ef.filter = f
+	ef.pairer = newTransactionPairer()
+	ef.pairer.expired = ef.expire
+	return ef
+}
+
+// expire passes the request of a transaction without response if it was
+// held back and matches
+func (ef *eventFilter) expire(t *httpTransaction) {
+	if ef.filter.NeedsResponse() && matchTransaction(ef.filter, t) {
+		ef.expired = append(ef.expired, t.Request)
+	}
+}
+
+func isDNSEvent(e ngnet.Event) bool {
+	_, ok := e.(ngnet.DNSQueryEvent)
+	return ok
+}
+
+// push returns the events to pass on. The DNS queries are not HTTP
+// transactions, they never pass.
+func (ef *eventFilter) push(e ngnet.Event) []ngnet.Event {
+	switch v := e.(type) {
+	case ngnet.DNSQueryEvent:
+		return nil
+	case ngnet.TransactionEvent:
+		if matchTransaction(ef.filter, &v) {
+			return []ngnet.Event{v}
+		}
+		return nil
+	}
+	t, completed := ef.pairer.push(e)
+	passed := ef.expired
+	ef.expired = nil
+	return append(passed, ef.pass(t, completed)...)
+}
+
+// pass returns the events to pass on when a transaction is pushed
+func (ef *eventFilter) pass(t *httpTransaction, completed bool) []ngnet.Event {
+	if t == nil {
+		return nil
+	}
+	if !completed {
+		if !ef.filter.NeedsResponse() && matchTransaction(ef.filter, t) {
+			return []ngnet.Event{t.Request}
+		}
+		return nil
+	}
+	if !matchTransaction(ef.filter, t) {
+		return nil
+	}
+	if ef.filter.NeedsResponse() {
+		return []ngnet.Event{t.Request, *t.Response}
+	}
+	return []ngnet.Event{*t.Response}
+}
+
+// unanswered returns the matching requests held back which are still
+// without response, once there are no more events
+func (ef *eventFilter) unanswered() []ngnet.Event {
+	for _, t := range ef.pairer.unanswered() {
+		ef.expire(t)
+	}
+	passed := ef.expired
+	ef.expired = nil
+	return passed
+}
+
+// filterEvents returns the events of a list which pass the filter
+func filterEvents(f *ngfilter.Filter, events []ngnet.Event) []ngnet.Event {
+	ef := newEventFilter(f)
+	var passed []ngnet.Event
+	for _, e := range events {
+		passed = append(passed, ef.push(e)...)
+	}
+	return append(passed, ef.unanswered()...)
+}
+
+// filteredHandler is an NGHTTPEventHandler passing only the events of the
+// matching transactions to another handler.
+type filteredHandler struct {
+	handler NGHTTPEventHandler
+	filter  *eventFilter
+}
+
+func newFilteredHandler(h NGHTTPEventHandler, f *ngfilter.Filter) *filteredHandler {
+	return &filteredHandler{h, newEventFilter(f)}
+}
+
+// PushEvent implements the function of interface NGHTTPEventHandler
+func (h *filteredHandler) PushEvent(e ngnet.Event) {
+	for _, ev := range h.filter.push(e) {
+		h.handler.PushEvent(ev)
+	}
+}
+
+// Reopen reopens the output file of the wrapped handler
+func (h *filteredHandler) Reopen() error {
+	if r, ok := h.handler.(reopener); ok {
+		return r.Reopen()
+	}
+	return nil
+}
+
+// Wait implements the function of interface NGHTTPEventHandler, the
+// requests held back without response are passed on first
+func (h *filteredHandler) Wait() {
+	for _, ev := range h.filter.unanswered() {
+		h.handler.PushEvent(ev)
+	}
+	h.handler.Wait()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ga0/netgraph/ngfilter"
+	"github.com/ga0/netgraph/ngnet"
+)
+
+// recordingHandler keeps the events pushed to it
+type recordingHandler struct {
+	events []ngnet.Event
+}
+
+func (h *recordingHandler) PushEvent(e ngnet.Event) { h.events = append(h.events, e) }
+
+func (h *recordingHandler) Wait() {}
+
+func testRequest(streamSeq uint, start time.Time) ngnet.HTTPRequestEvent {
+	var req ngnet.HTTPRequestEvent
+	req.ID = ngnet.RequestID(streamSeq, 0)
+	req.StreamSeq = streamSeq
+	req.Method = "GET"
+	req.URI = "/"
+	req.Start = start
+	return req
+}
+
+func TestFilteredHandlerUnanswered(t *testing.T) {
+	f, err := ngfilter.Parse("!(status >= 500)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := new(recordingHandler)
+	fh := newFilteredHandler(h, f)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// held back until its response, forgotten by the newer requests
+	fh.PushEvent(testRequest(0, start))
+	fh.PushEvent(ngnet.DNSQueryEvent{})
+	fh.PushEvent(testRequest(1, start.Add(pendingTimeout+time.Second)))
+	if len(h.events) != 1 || h.events[0].EventID() != ngnet.RequestID(0, 0) {
+		t.Fatalf("expired request not passed: %v", h.events)
+	}
+
+	// still waiting when the capture ends
+	fh.Wait()
+	if len(h.events) != 2 || h.events[1].EventID() != ngnet.RequestID(1, 0) {
+		t.Fatalf("unanswered request not passed: %v", h.events)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ga0/netgraph/ngnet"
+)
+
+// harDocument is a HAR 1.2 document, see http://www.softwareishard.com/blog/har-12-spec/
+type harDocument struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Connection      string      `json:"connection,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+// harPostData carries binary bodies base64 encoded with "encoding" set,
+// like the response content does.
+type harPostData struct {
+	MimeType string         `json:"mimeType"`
+	Params   []harNameValue `json:"params"`
+	Text     string         `json:"text"`
+	Encoding string         `json:"encoding,omitempty"`
+}
+
+type harResponse struct {
+	Status      uint           `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+func harHeaders(headers []ngnet.HTTPHeaderItem) []harNameValue {
+	hs := make([]harNameValue, 0, len(headers))
+	for _, h := range headers {
+		hs = append(hs, harNameValue{h.Name, h.Value})
+	}
+	return hs
+}
+
+func httpHeader(headers []ngnet.HTTPHeaderItem) http.Header {
+	h := make(http.Header)
+	for _, item := range headers {
+		h.Add(item.Name, item.Value)
+	}
+	return h
+}
+
+func harRequestCookies(headers []ngnet.HTTPHeaderItem) []harCookie {
+	r := http.Request{Header: httpHeader(headers)}
+	cookies := []harCookie{}
+	for _, c := range r.Cookies() {
+		cookies = append(cookies, harCookie{Name: c.Name, Value: c.Value})
+	}
+	return cookies
+}
+
+func harResponseCookies(headers []ngnet.HTTPHeaderItem) []harCookie {
+	r := http.Response{Header: httpHeader(headers)}
+	cookies := []harCookie{}
+	for _, c := range r.Cookies() {
+		hc := harCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HTTPOnly: c.HttpOnly,
+			Secure:   c.Secure,
+		}
+		if !c.Expires.IsZero() {
+			hc.Expires = c.Expires.Format(time.RFC3339)
+		}
+		cookies = append(cookies, hc)
+	}
+	return cookies
+}
+
+// parseQueryString keeps the order of the parameters, unlike url.ParseQuery.
+func parseQueryString(query string) []harNameValue {
+	params := []harNameValue{}
+	for _, kv := range strings.Split(query, "&") {
+		if kv == "" {
+			continue
+		}
+		var nv harNameValue
+		p := strings.Index(kv, "=")
+		if p == -1 {
+			nv.Name = kv
+		} else {
+			nv.Name, nv.Value = kv[:p], kv[p+1:]
+		}
+		if n, err := url.QueryUnescape(nv.Name); err == nil {
+			nv.Name = n
+		}
+		if v, err := url.QueryUnescape(nv.Value); err == nil {
+			nv.Value = v
+		}
+		params = append(params, nv)
+	}
+	return params
+}
+
+// requestURL makes an absolute URL from the request line and the Host header
+func requestURL(req ngnet.HTTPRequestEvent) string {
+	if strings.HasPrefix(req.URI, "http://") || strings.HasPrefix(req.URI, "https://") {
+		return req.URI
+	}
+	host := headerValue(req.Headers, "Host")
+	if host == "" {
+		host = req.ServerAddr
+	}
+	return "http://" + host + req.URI
+}
+
+func isTextContent(mimeType string, body []byte) bool {
+	if !utf8.Valid(body) {
+		return false
+	}
+	mimeType = strings.ToLower(mimeType)
+	if mimeType == "" || strings.HasPrefix(mimeType, "text/") {
+		return true
+	}
+	for _, t := range []string{"json", "xml", "javascript", "x-www-form-urlencoded", "html"} {
+		if strings.Contains(mimeType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeBody returns the body as text, base64 encoded if it is binary
+func encodeBody(mimeType string, body []byte) (text string, encoding string) {
+	if isTextContent(mimeType, body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func milliseconds(d time.Duration) float64 {
+	if d < 0 {
+		return 0
+	}
+	return float64(d) / float64(time.Millisecond)
+}
+
+func newHAREntry(t *httpTransaction) harEntry {
+	req := t.Request
+	var e harEntry
+	e.StartedDateTime = req.Start.Format("2006-01-02T15:04:05.000Z07:00")
+	e.Connection = strconv.FormatUint(uint64(req.StreamSeq), 10)
+	e.ServerIPAddress = hostOf(req.ServerAddr)
+
+	e.Request.Method = req.Method
+	e.Request.URL = requestURL(req)
+	e.Request.HTTPVersion = req.Version
+	e.Request.Cookies = harRequestCookies(req.Headers)
+	e.Request.Headers = harHeaders(req.Headers)
+	e.Request.QueryString = []harNameValue{}
+	if u, err := url.Parse(e.Request.URL); err == nil {
+		e.Request.QueryString = parseQueryString(u.RawQuery)
+	}
+	e.Request.HeadersSize = -1
+	e.Request.BodySize = len(req.Body)
+	if len(req.Body) > 0 {
+		pd := new(harPostData)
+		pd.MimeType = headerValue(req.Headers, "Content-Type")
+		pd.Params = []harNameValue{}
+		if strings.HasPrefix(pd.MimeType, "application/x-www-form-urlencoded") {
+			pd.Params = parseQueryString(string(req.Body))
+		}
+		pd.Text, pd.Encoding = encodeBody(pd.MimeType, req.Body)
+		e.Request.PostData = pd
+	}
+
+	e.Timings.Blocked = -1
+	e.Timings.DNS = -1
+	e.Timings.Connect = -1
+	e.Timings.SSL = -1
+	e.Timings.Send = milliseconds(req.End.Sub(req.Start))
+
+	e.Response.Cookies = []harCookie{}
+	e.Response.Headers = []harNameValue{}
+	e.Response.HeadersSize = -1
+	e.Response.BodySize = -1
+	if resp := t.Response; resp != nil {
+		e.Response.Status = resp.Code
+		e.Response.StatusText = resp.Reason
+		e.Response.HTTPVersion = resp.Version
+		e.Response.Cookies = harResponseCookies(resp.Headers)
+		e.Response.Headers = harHeaders(resp.Headers)
+		e.Response.RedirectURL = headerValue(resp.Headers, "Location")
+		e.Response.BodySize = len(resp.Body)
+		e.Response.Content.Size = len(resp.Body)
+		e.Response.Content.MimeType = headerValue(resp.Headers, "Content-Type")
+		e.Response.Content.Text, e.Response.Content.Encoding =
+			encodeBody(e.Response.Content.MimeType, resp.Body)
+		e.Timings.Wait = milliseconds(resp.Start.Sub(req.End))
+		e.Timings.Receive = milliseconds(resp.End.Sub(resp.Start))
+	}
+	e.Time = e.Timings.Send + e.Timings.Wait + e.Timings.Receive
+	return e
+}
+
+func newHARDocument(ts []*httpTransaction) *harDocument {
+	doc := new(harDocument)
+	doc.Log.Version = "1.2"
+	doc.Log.Creator = harCreator{Name: "netgraph", Version: "dev"}
+	doc.Log.Entries = make([]harEntry, 0, len(ts))
+	for _, t := range ts {
+		doc.Log.Entries = append(doc.Log.Entries, newHAREntry(t))
+	}
+	return doc
+}
+
+func writeHAR(w io.Writer, ts []*httpTransaction) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(newHARDocument(ts))
+}
+
+// maxHAREntries is the number of transactions kept by HARPrinter, the
+// document is written when netgraph stops so they are all in memory
+const maxHAREntries = 10000
+
+// HARPrinter collects HTTP transactions and writes them as a HAR document
+// when the capture completes. Only the last maxHAREntries transactions
+// are written, the oldest ones are evicted.
+type HARPrinter struct {
+	file         *os.File
+	pairer       *transactionPairer
+	transactions []*httpTransaction
+	evicted      int // transactions dropped beyond maxHAREntries
+}
+
+// NewHARPrinter creates HARPrinter
+func NewHARPrinter(name string) *HARPrinter {
+	p := new(HARPrinter)
+	p.file = openOutputFile(name)
+	p.pairer = newTransactionPairer()
+	return p
+}
+
+// PushEvent implements the function of interface NGHTTPEventHandler
+func (p *HARPrinter) PushEvent(e ngnet.Event) {
+	t, completed := p.pairer.push(e)
+	if t == nil || completed {
+		return
+	}
+	if len(p.transactions) >= maxHAREntries {
+		if p.evicted == 0 {
+			log.Printf("HAR output is full with %d transactions, the oldest ones are not written\n", maxHAREntries)
+		}
+		p.evicted++
+		p.transactions[0] = nil
+		p.transactions = p.transactions[1:]
+	}
+	p.transactions = append(p.transactions, t)
+}
+
+// Wait implements the function of interface NGHTTPEventHandler
+func (p *HARPrinter) Wait() {
+	if p.evicted > 0 {
+		log.Printf("%d transactions not written to the HAR output\n", p.evicted)
+	}
+	if err := writeHAR(p.file, p.transactions); err != nil {
+		log.Println("Cannot write HAR:", err)
+	}
+	if p.file != os.Stdout {
+		p.file.Close()
+	}
+}
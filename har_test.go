@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ga0/netgraph/ngnet"
+)
+
+func TestHAREntry(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	req := testRequest(3, start)
+	req.Method = "POST"
+	req.URI = "/form?b=x%20y&a=1&b=2"
+	req.Version = "HTTP/1.1"
+	req.ServerAddr = "10.0.0.1:80"
+	req.Headers = []ngnet.HTTPHeaderItem{
+		{Name: "Host", Value: "example.com"},
+		{Name: "Content-Type", Value: "application/x-www-form-urlencoded"},
+		{Name: "Cookie", Value: "s=1"},
+	}
+	req.Body = []byte("k=v&k=w")
+	req.End = start.Add(2 * time.Millisecond)
+	var resp ngnet.HTTPResponseEvent
+	resp.Code = 200
+	resp.Reason = "OK"
+	resp.Headers = []ngnet.HTTPHeaderItem{{Name: "Content-Type", Value: "image/png"}}
+	resp.Body = []byte{0x89, 'P', 'N', 'G', 0xff}
+	resp.Start = start.Add(12 * time.Millisecond)
+	resp.End = start.Add(15 * time.Millisecond)
+	tr := ngnet.NewTransactionEvent(req)
+	tr.Response = &resp
+
+	e := newHAREntry(tr)
+	if e.Request.URL != "http://example.com/form?b=x%20y&a=1&b=2" || e.Connection != "3" || e.ServerIPAddress != "10.0.0.1" {
+		t.Errorf("bad entry %+v", e)
+	}
+	if e.StartedDateTime != "2020-01-01T00:00:00.000Z" {
+		t.Errorf("bad start %s", e.StartedDateTime)
+	}
+	want := harTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1, Send: 2, Wait: 10, Receive: 3}
+	if e.Timings != want || e.Time != 15 {
+		t.Errorf("bad timings %+v, time %v", e.Timings, e.Time)
+	}
+	headers := []harNameValue{
+		{"Host", "example.com"},
+		{"Content-Type", "application/x-www-form-urlencoded"},
+		{"Cookie", "s=1"},
+	}
+	if !reflect.DeepEqual(e.Request.Headers, headers) {
+		t.Errorf("bad headers %v", e.Request.Headers)
+	}
+	// in the order of the URL
+	query := []harNameValue{{"b", "x y"}, {"a", "1"}, {"b", "2"}}
+	if !reflect.DeepEqual(e.Request.QueryString, query) {
+		t.Errorf("bad query string %v", e.Request.QueryString)
+	}
+	if len(e.Request.Cookies) != 1 || e.Request.Cookies[0].Name != "s" {
+		t.Errorf("bad cookies %v", e.Request.Cookies)
+	}
+	pd := e.Request.PostData
+	if pd == nil || pd.MimeType != "application/x-www-form-urlencoded" || pd.Text != "k=v&k=w" || pd.Encoding != "" ||
+		!reflect.DeepEqual(pd.Params, []harNameValue{{"k", "v"}, {"k", "w"}}) {
+		t.Errorf("bad post data %+v", pd)
+	}
+	c := e.Response.Content
+	if e.Response.Status != 200 || c.MimeType != "image/png" || c.Encoding != "base64" || c.Size != 5 {
+		t.Errorf("bad response %+v", e.Response)
+	}
+
+	// without response
+	tr.Response = nil
+	e = newHAREntry(tr)
+	if e.Response.Status != 0 || e.Response.BodySize != -1 || e.Time != 2 || e.Response.Headers == nil {
+		t.Errorf("bad entry without response %+v", e)
+	}
+}
+
+func TestHARPrinterEvictsOldest(t *testing.T) {
+	p := new(HARPrinter)
+	p.pairer = newTransactionPairer()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := uint(0); i < maxHAREntries+2; i++ {
+		p.PushEvent(testRequest(i, start))
+	}
+	if len(p.transactions) != maxHAREntries || p.evicted != 2 {
+		t.Fatalf("%d transactions, %d evicted", len(p.transactions), p.evicted)
+	}
+	first, last := p.transactions[0], p.transactions[maxHAREntries-1]
+	if first.Request.StreamSeq != 2 || last.Request.StreamSeq != maxHAREntries+1 {
+		t.Errorf("kept the transactions %d to %d", first.Request.StreamSeq, last.Request.StreamSeq)
+	}
+}
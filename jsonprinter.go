@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/ga0/netgraph/ngnet"
+)
+
+// jsonTimeFormat is RFC 3339 with nanoseconds, always with 9 fraction digits
+const jsonTimeFormat = "2006-01-02T15:04:05.000000000Z07:00"
+
+type jsonHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// jsonProcess is a local process of the connection
+type jsonProcess struct {
+	PID         int    `json:"pid"`
+	Exe         string `json:"exe"`
+	Cmdline     string `json:"cmdline"`
+	User        string `json:"user"`
+	Cgroup      string `json:"cgroup,omitempty"`
+	ContainerID string `json:"container_id,omitempty"`
+}
+
+func newJSONProcess(p *ngnet.Process) *jsonProcess {
+	if p == nil {
+		return nil
+	}
+	return &jsonProcess{p.PID, p.Exe, p.Cmdline, p.User, p.Cgroup, p.ContainerID}
+}
+
+// jsonRequest is the NDJSON record of a HTTP request.
+// "id" identifies the transaction, the response of the request has the same "id".
+// "event_id" is the ID of the ngnet event. "schema" is ngnet.SchemaVersion,
+// set in the top-level records only.
+type jsonRequest struct {
+	Type         string       `json:"type"`
+	Schema       int          `json:"schema,omitempty"`
+	ID           string       `json:"id"`
+	EventID      string       `json:"event_id"`
+	StreamSeq    uint         `json:"stream_seq"`
+	Start        string       `json:"start"`
+	End          string       `json:"end"`
+	ClientAddr   string       `json:"client_addr"`
+	ServerAddr   string       `json:"server_addr"`
+	ClientName   string       `json:"client_name,omitempty"`
+	ServerName   string       `json:"server_name,omitempty"`
+	ClientProc   *jsonProcess `json:"client_process,omitempty"`
+	ServerProc   *jsonProcess `json:"server_process,omitempty"`
+	Method       string       `json:"method"`
+	URI          string       `json:"uri"`
+	Route        string       `json:"route,omitempty"`
+	Version      string       `json:"version"`
+	Headers      []jsonHeader `json:"headers"`
+	BodySize     int          `json:"body_size"`
+	Body         string       `json:"body"`
+	BodyEncoding string       `json:"body_encoding"`
+}
+
+// jsonResponse is the NDJSON record of a HTTP response
+type jsonResponse struct {
+	Type         string       `json:"type"`
+	Schema       int          `json:"schema,omitempty"`
+	ID           string       `json:"id"`
+	EventID      string       `json:"event_id"`
+	StreamSeq    uint         `json:"stream_seq"`
+	Start        string       `json:"start"`
+	End          string       `json:"end"`
+	ClientAddr   string       `json:"client_addr"`
+	ServerAddr   string       `json:"server_addr"`
+	Version      string       `json:"version"`
+	Status       uint         `json:"status"`
+	Reason       string       `json:"reason"`
+	Headers      []jsonHeader `json:"headers"`
+	BodySize     int          `json:"body_size"`
+	Body         string       `json:"body"`
+	BodyEncoding string       `json:"body_encoding"`
+}
+
+// jsonTransaction is the NDJSON record of a completed HTTP transaction.
+// "response" is null if the response was not captured.
+type jsonTransaction struct {
+	Type       string        `json:"type"`
+	Schema     int           `json:"schema"`
+	ID         string        `json:"id"`
+	StreamSeq  uint          `json:"stream_seq"`
+	Start      string        `json:"start"`
+	End        string        `json:"end"`
+	DurationMs float64       `json:"duration_ms"`
+	ClientAddr string        `json:"client_addr"`
+	ServerAddr string        `json:"server_addr"`
+	Request    *jsonRequest  `json:"request"`
+	Response   *jsonResponse `json:"response"`
+}
+
+type jsonDNSAnswer struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl"`
+	Data string `json:"data"`
+}
+
+// jsonDNSQuery is the NDJSON record of a DNS query and its response
+type jsonDNSQuery struct {
+	Type       string          `json:"type"`
+	Schema     int             `json:"schema"`
+	ID         string          `json:"id"`
+	Start      string          `json:"start"`
+	End        string          `json:"end,omitempty"`
+	DurationMs float64         `json:"duration_ms"`
+	Protocol   string          `json:"protocol"`
+	ClientAddr string          `json:"client_addr"`
+	ServerAddr string          `json:"server_addr"`
+	QueryID    uint16          `json:"query_id"`
+	Name       string          `json:"name"`
+	QType      string          `json:"qtype"`
+	Answered   bool            `json:"answered"`
+	RCode      string          `json:"rcode,omitempty"`
+	Answers    []jsonDNSAnswer `json:"answers"`
+}
+
+func newJSONDNSQuery(q ngnet.DNSQueryEvent) *jsonDNSQuery {
+	r := &jsonDNSQuery{Type: "dns", Schema: ngnet.SchemaVersion, ID: q.ID, Start: formatJSONTime(q.Start),
+		DurationMs: milliseconds(q.Duration), Protocol: q.Protocol, ClientAddr: q.ClientAddr,
+		ServerAddr: q.ServerAddr, QueryID: q.QueryID,
+		Name: q.Name, QType: q.QType, Answered: q.Answered, RCode: q.RCode, Answers: []jsonDNSAnswer{}}
+	if q.Answered {
+		r.End = formatJSONTime(q.End)
+	}
+	for _, a := range q.Answers {
+		r.Answers = append(r.Answers, jsonDNSAnswer{a.Name, a.Type, a.TTL, a.Data})
+	}
+	return r
+}
+
+func formatJSONTime(t time.Time) string {
+	return t.Format(jsonTimeFormat)
+}
+
+func jsonHeaders(headers []ngnet.HTTPHeaderItem) []jsonHeader {
+	hs := make([]jsonHeader, 0, len(headers))
+	for _, h := range headers {
+		hs = append(hs, jsonHeader{h.Name, h.Value})
+	}
+	return hs
+}
+
+// jsonBody returns the body as UTF-8 text or base64 according to content type
+func jsonBody(headers []ngnet.HTTPHeaderItem, body []byte) (text string, encoding string) {
+	text, encoding = encodeBody(headerValue(headers, "Content-Type"), body)
+	if encoding == "" {
+		encoding = "utf8"
+	}
+	return
+}
+
+func newJSONRequest(id string, req ngnet.HTTPRequestEvent) *jsonRequest {
+	r := new(jsonRequest)
+	r.Type = "request"
+	r.ID = id
+	r.EventID = req.ID
+	r.StreamSeq = req.StreamSeq
+	r.Start = formatJSONTime(req.Start)
+	r.End = formatJSONTime(req.End)
+	r.ClientAddr = req.ClientAddr
+	r.ServerAddr = req.ServerAddr
+	r.ClientName = req.ClientName
+	r.ServerName = req.ServerName
+	r.ClientProc = newJSONProcess(req.ClientProcess)
+	r.ServerProc = newJSONProcess(req.ServerProcess)
+	r.Method = req.Method
+	r.URI = req.URI
+	r.Route = req.Route
+	r.Version = req.Version
+	r.Headers = jsonHeaders(req.Headers)
+	r.BodySize = len(req.Body)
+	r.Body, r.BodyEncoding = jsonBody(req.Headers, req.Body)
+	return r
+}
+
+func newJSONResponse(id string, resp ngnet.HTTPResponseEvent) *jsonResponse {
+	r := new(jsonResponse)
+	r.Type = "response"
+	r.ID = id
+	r.EventID = resp.ID
+	r.StreamSeq = resp.StreamSeq
+	r.Start = formatJSONTime(resp.Start)
+	r.End = formatJSONTime(resp.End)
+	r.ClientAddr = resp.ClientAddr
+	r.ServerAddr = resp.ServerAddr
+	r.Version = resp.Version
+	r.Status = resp.Code
+	r.Reason = resp.Reason
+	r.Headers = jsonHeaders(resp.Headers)
+	r.BodySize = len(resp.Body)
+	r.Body, r.BodyEncoding = jsonBody(resp.Headers, resp.Body)
+	return r
+}
+
+func newJSONTransaction(t *httpTransaction) *jsonTransaction {
+	j := new(jsonTransaction)
+	j.Type = "transaction"
+	j.Schema = ngnet.SchemaVersion
+	j.ID = t.ID
+	j.StreamSeq = t.Request.StreamSeq
+	j.Start = formatJSONTime(t.Request.Start)
+	end := t.Request.End
+	if t.Response != nil {
+		end = t.Response.End
+		j.Response = newJSONResponse(t.ID, *t.Response)
+	}
+	j.End = formatJSONTime(end)
+	j.DurationMs = milliseconds(end.Sub(t.Request.Start))
+	j.ClientAddr = t.Request.ClientAddr
+	j.ServerAddr = t.Request.ServerAddr
+	j.Request = newJSONRequest(t.ID, t.Request)
+	return j
+}
+
+// jsonRecord is a record of the JSON output and the event it is made of
+type jsonRecord struct {
+	kind  string    // "request", "response", "transaction" or "dns"
+	id    string    // of the transaction, empty for a DNS query
+	start time.Time // of the event
+	value interface{}
+}
+
+// jsonRecorder makes the JSON records of the events. If pair is set, one
+// record is made per transaction instead of per HTTP event.
+type jsonRecorder struct {
+	pairer  *transactionPairer // nil unless pair is set
+	expired []jsonRecord       // of the transactions forgotten without response
+}
+
+func newJSONRecorder(pair bool) *jsonRecorder {
+	r := new(jsonRecorder)
+	if pair {
+		r.pairer = newTransactionPairer()
+		r.pairer.expired = func(t *httpTransaction) {
+			r.expired = append(r.expired, transactionRecord(t))
+		}
+	}
+	return r
+}
+
+func transactionRecord(t *httpTransaction) jsonRecord {
+	return jsonRecord{"transaction", t.ID, t.Request.Start, newJSONTransaction(t)}
+}
+
+// records returns the records of an event. The TransactionEvents are
+// ignored, the transactions are paired from the requests and responses.
+func (r *jsonRecorder) records(e ngnet.Event) []jsonRecord {
+	switch v := e.(type) {
+	case ngnet.DNSQueryEvent:
+		return []jsonRecord{{"dns", "", v.Start, newJSONDNSQuery(v)}}
+	case ngnet.TransactionEvent:
+		return nil
+	}
+	if r.pairer != nil {
+		t, completed := r.pairer.push(e)
+		records := r.expired
+		r.expired = nil
+		if completed {
+			records = append(records, transactionRecord(t))
+		}
+		return records
+	}
+	switch v := e.(type) {
+	case ngnet.HTTPRequestEvent:
+		req := newJSONRequest(ngnet.TransactionID(v.StreamSeq, v.RequestSeq), v)
+		req.Schema = ngnet.SchemaVersion
+		return []jsonRecord{{"request", req.ID, v.Start, req}}
+	case ngnet.HTTPResponseEvent:
+		resp := newJSONResponse(ngnet.TransactionID(v.StreamSeq, v.RequestSeq), v)
+		resp.Schema = ngnet.SchemaVersion
+		return []jsonRecord{{"response", resp.ID, v.Start, resp}}
+	}
+	log.Printf("Unknown event: %v", e)
+	return nil
+}
+
+// unanswered returns the records of the transactions without response, in
+// pair mode only
+func (r *jsonRecorder) unanswered() []jsonRecord {
+	if r.pairer == nil {
+		return nil
+	}
+	var records []jsonRecord
+	for _, t := range r.pairer.unanswered() {
+		records = append(records, transactionRecord(t))
+	}
+	return records
+}
+
+// JSONPrinter writes HTTP events as newline delimited JSON, one object per line.
+// If pair is set, one object is written per transaction instead of per event.
+type JSONPrinter struct {
+	name     string
+	file     *os.File
+	encoder  *json.Encoder
+	recorder *jsonRecorder
+}
+
+// NewJSONPrinter creates JSONPrinter
+func NewJSONPrinter(name string, pair bool) *JSONPrinter {
+	p := new(JSONPrinter)
+	p.name = name
+	p.file = openOutputFile(name)
+	p.setEncoder()
+	p.recorder = newJSONRecorder(pair)
+	return p
+}
+
+func (p *JSONPrinter) setEncoder() {
+	p.encoder = json.NewEncoder(p.file)
+	p.encoder.SetEscapeHTML(false)
+}
+
+func (p *JSONPrinter) write(v interface{}) {
+	if err := p.encoder.Encode(v); err != nil {
+		log.Println("Cannot write JSON:", err)
+	}
+}
+
+// PushEvent implements the function of interface NGHTTPEventHandler
+func (p *JSONPrinter) PushEvent(e ngnet.Event) {
+	for _, r := range p.recorder.records(e) {
+		p.write(r.value)
+	}
+}
+
+// Reopen opens the output file again after it was rotated
+func (p *JSONPrinter) Reopen() (err error) {
+	p.file, err = reopenOutputFile(p.name, p.file)
+	p.setEncoder()
+	return err
+}
+
+// Wait implements the function of interface NGHTTPEventHandler
+func (p *JSONPrinter) Wait() {
+	for _, r := range p.recorder.unanswered() {
+		p.write(r.value)
+	}
+	if p.file != os.Stdout {
+		p.file.Close()
+	}
+}
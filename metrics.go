@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ga0/netgraph/ngcapture"
+)
+
+// captureStats is the state of the capture reported by /metrics
+type captureStats struct {
+	mutex    sync.Mutex
+	capturer *ngcapture.Capturer // nil until the capture starts
+}
+
+var capture captureStats
+
+func (c *captureStats) set(capturer *ngcapture.Capturer) {
+	c.mutex.Lock()
+	c.capturer = capturer
+	c.mutex.Unlock()
+}
+
+// latencyBuckets are the upper bounds of the latency histograms in seconds
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// maxMetricSeries limits the label sets of the HTTP metrics, the following
+// transactions are counted with the labels set to "other"
+const maxMetricSeries = 2000
+
+type seriesKey struct {
+	host, method, statusClass, route string
+}
+
+type latencySeries struct {
+	count   uint64
+	sum     float64
+	buckets []uint64 // count of the durations <= latencyBuckets[i]
+}
+
+// httpMetrics counts the captured HTTP transactions
+type httpMetrics struct {
+	mutex  sync.Mutex
+	series map[seriesKey]*latencySeries
+}
+
+func newHTTPMetrics() *httpMetrics {
+	m := new(httpMetrics)
+	m.series = make(map[seriesKey]*latencySeries)
+	return m
+}
+
+func statusClass(code uint) string {
+	if code < 100 || code > 599 {
+		return "other"
+	}
+	return strconv.Itoa(int(code/100)) + "xx"
+}
+
+// observe counts a transaction with its response
+func (m *httpMetrics) observe(t *httpTransaction) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	key := seriesKey{requestHost(t.Request), t.Request.Method, statusClass(t.Response.Code), t.Request.Route}
+	seconds := transactionDuration(t).Seconds()
+	s := m.series[key]
+	if s == nil {
+		if len(m.series) >= maxMetricSeries {
+			key = seriesKey{"other", "other", key.statusClass, "other"}
+			s = m.series[key]
+		}
+		if s == nil {
+			s = &latencySeries{buckets: make([]uint64, len(latencyBuckets))}
+			m.series[key] = s
+		}
+	}
+	s.count++
+	s.sum += seconds
+	for i, b := range latencyBuckets {
+		if seconds <= b {
+			s.buckets[i]++
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (k seriesKey) labels() string {
+	return fmt.Sprintf(`host="%s",method="%s",status_class="%s",route="%s"`,
+		labelEscaper.Replace(k.host), labelEscaper.Replace(k.method),
+		k.statusClass, labelEscaper.Replace(k.route))
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func writeMetricHeader(b *bytes.Buffer, name string, kind string, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeMetric(b *bytes.Buffer, name string, kind string, help string, value interface{}) {
+	writeMetricHeader(b, name, kind, help)
+	fmt.Fprintf(b, "%s %v\n", name, value)
+}
+
+func (c *captureStats) write(b *bytes.Buffer) {
+	c.mutex.Lock()
+	capturer := c.capturer
+	c.mutex.Unlock()
+	if capturer == nil {
+		writeMetric(b, "netgraph_packets_total", "counter", "Packets captured.", 0)
+		return
+	}
+	stats := capturer.Stats()
+	writeMetric(b, "netgraph_packets_total", "counter", "Packets captured.", stats.Packets)
+	if stats.Drops != nil {
+		writeMetric(b, "netgraph_pcap_dropped_packets_total", "counter",
+			"Packets dropped by pcap because the buffer was full.", stats.Drops.Pcap)
+		writeMetric(b, "netgraph_pcap_interface_dropped_packets_total", "counter",
+			"Packets dropped by the network interface.", stats.Drops.Interface)
+	}
+	writeMetric(b, "netgraph_running_streams", "gauge", "TCP connections being parsed.",
+		stats.RunningStreams)
+	writeMetric(b, "netgraph_reassembled_bytes_total", "counter", "Bytes reassembled from the TCP streams.",
+		stats.Streams.Bytes)
+	writeMetricHeader(b, "netgraph_parse_errors_total", "counter", "TCP connections which stopped being parsed, by reason.")
+	var reasons []string
+	for reason := range stats.Streams.ParseErrors {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(b, "netgraph_parse_errors_total{reason=\"%s\"} %d\n", reason, stats.Streams.ParseErrors[reason])
+	}
+	writeMetric(b, "netgraph_dns_dropped_events_total", "counter",
+		"DNS events dropped because the event queue was full.", stats.Streams.DroppedDNS)
+	writeMetric(b, "netgraph_event_queue_length", "gauge", "HTTP events waiting to be handled.", stats.QueueLength)
+	writeMetric(b, "netgraph_event_queue_capacity", "gauge", "Max HTTP events waiting to be handled.", stats.QueueCapacity)
+}
+
+func (m *httpMetrics) write(b *bytes.Buffer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	keys := make([]seriesKey, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].labels() < keys[j].labels()
+	})
+
+	writeMetricHeader(b, "netgraph_http_requests_total", "counter", "HTTP transactions captured, counted when the response is complete.")
+	for _, k := range keys {
+		fmt.Fprintf(b, "netgraph_http_requests_total{%s} %d\n", k.labels(), m.series[k].count)
+	}
+	writeMetricHeader(b, "netgraph_http_request_duration_seconds", "histogram", "Time from the first request packet to the last response packet.")
+	for _, k := range keys {
+		s := m.series[k]
+		labels := k.labels()
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(b, "netgraph_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, formatFloat(le), s.buckets[i])
+		}
+		fmt.Fprintf(b, "netgraph_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, s.count)
+		fmt.Fprintf(b, "netgraph_http_request_duration_seconds_sum{%s} %s\n", labels, formatFloat(s.sum))
+		fmt.Fprintf(b, "netgraph_http_request_duration_seconds_count{%s} %d\n", labels, s.count)
+	}
+}
+
+// GET /metrics returns the metrics in the Prometheus text format
+func (s *NGServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+	capture.write(&b)
+	s.metrics.write(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
@@ -1,45 +1,126 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/ga0/netgraph/ngcapture"
+	"github.com/ga0/netgraph/ngfilter"
 	"github.com/ga0/netgraph/ngnet"
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
-	"github.com/google/gopacket/pcapgo"
-	"github.com/google/gopacket/tcpassembly"
+	"github.com/ga0/netgraph/ngproc"
+	"github.com/ga0/netgraph/ngredact"
+	"github.com/ga0/netgraph/ngroute"
+	"github.com/ga0/netgraph/ngstore"
 )
 
 var device = flag.String("i", "", "Device to capture, auto select one if no device provided")
 var bpf = flag.String("bpf", "tcp port 80", "Set berkeley packet filter")
+var sampleRate = flag.Float64("sample-rate", 1, "Fraction of the TCP connections to parse (0-1), chosen by a hash of the connection addresses")
+var allowHosts = flag.String("allow-host", "", "Parse only the TCP connections whose first HTTP request is to one of these hosts (comma separated, \"*.example.com\" for subdomains)")
+var denyHosts = flag.String("deny-host", "", "Drop the TCP connections whose first HTTP request is to one of these hosts (comma separated)")
+var allowPaths = flag.String("allow-path", "", "Parse only the TCP connections whose first HTTP request URI starts with one of these prefixes (comma separated)")
+var denyPaths = flag.String("deny-path", "", "Drop the TCP connections whose first HTTP request URI starts with one of these prefixes (comma separated)")
 
 var outputHTTP = flag.String("o", "", "Write HTTP request/response to file")
+var outputFormat = flag.String("format", "text", "Format of the file written by -o: text, har, json, json-pair")
+var outputTemplate = flag.String("template", "", "Write each HTTP transaction to the file set by -o with a Go template, or a built-in one: combined, curl, httpie, summary")
+var outputTemplateFile = flag.String("template-file", "", "Like -template, but read the template from a file")
+var outputFilter = flag.String("filter", "", "Write only the HTTP transactions matching this filter expression to the file set by -o, the DNS queries are not written, e.g. 'host ~ \"api.\" && status >= 500'")
 var inputPcap = flag.String("input-pcap", "", "Open pcap file")
 var outputPcap = flag.String("output-pcap", "", "Write captured packet to a pcap file")
-var requestOnly = flag.Bool("output-request-only", true, "Write HTTP request only, drop response")
+var outputPcapHost = flag.String("output-pcap-host", "", "Write only connections with HTTP requests to this host to the pcap file")
+var outputPcapPath = flag.String("output-pcap-path", "", "Write only connections with HTTP requests whose URI starts with this prefix to the pcap file")
+var outputPcapMethod = flag.String("output-pcap-method", "", "Write only connections with HTTP requests of this method to the pcap file")
+var outputPcapCode = flag.String("output-pcap-code", "", "Write only connections with HTTP responses whose status code is in this range (e.g. 500-599) to the pcap file")
+var requestOnly = flag.Bool("output-request-only", false, "Write HTTP request only, drop response. Same as -output-mode=request")
+var outputMode = flag.String("output-mode", "both", "HTTP events written by -o in text format: request, response, both, paired")
 
 var bindingPort = flag.Int("p", 9000, "Web server port. If the port is set to '0', the server will not run.")
+var bindAddr = flag.String("bind", "", "Address of the web server, all interfaces if empty, e.g. 127.0.0.1")
+var serveTLS = flag.Bool("tls", false, "Serve HTTPS, with a self-signed certificate unless -tls-cert is set")
+var tlsCert = flag.String("tls-cert", "", "Certificate file of HTTPS, implies -tls")
+var tlsKey = flag.String("tls-key", "", "Private key file of the certificate set by -tls-cert")
+var authBasic = flag.String("auth-basic", "", "Require HTTP basic authentication with these credentials, user:password or @file to read them from a file")
+var authToken = flag.String("auth-token", "", "Require this bearer token, or @file to read it from a file. Browsers open the web page with ?token=<token>")
+var allowedOrigins = flag.String("allowed-origins", "", "Origins allowed to open the websocket (comma separated, \"*\" for any), e.g. https://example.com. By default only the web server itself")
 var saveEvent = flag.Bool("s", false, "Save HTTP event in server")
+var storeMaxEvents = flag.Int("store-max-events", 100000, "Max number of HTTP events saved in server, 0 means unlimited")
+var storeMaxBytes = flag.Int64("store-max-bytes", 512*1024*1024, "Max bytes of HTTP events saved in server, 0 means unlimited")
+var storeDir = flag.String("store", "", "Save HTTP events in files in this directory, they are loaded again when netgraph restarts. Implies -s")
+var storeRetentionBytes = flag.Int64("store-retention-bytes", 1024*1024*1024, "Max bytes of the files written by -store, 0 means unlimited")
+var storeRetentionAge = flag.Duration("store-retention-age", 7*24*time.Hour, "Max age of the HTTP events in the files written by -store, 0 means unlimited")
+var storeMaxAge = flag.Duration("store-max-age", 0, "Max age of HTTP events saved in server (relative to the newest event), 0 means unlimited")
+var clientQueueSize = flag.Int("client-queue", 1024, "Max number of HTTP events queued for each websocket client")
+var clientOverflow = flag.String("client-overflow", "drop", "What to do when the queue of a websocket client is full: drop (events), disconnect (the client)")
+
+var redactConfig = flag.String("redact", "", "Redact secrets from the HTTP events with the rules of this JSON config file, or \"builtin\" for the built-in rules only")
+
+var routePatterns = flag.String("routes", "", "Route templates of the URL paths, comma separated or @file with one per line, e.g. /repos/{owner}/{repo}. Other routes are learned")
+
+var alertRules = flag.String("alerts", "", "Evaluate the alerting rules of this JSON config file against the HTTP transactions, reloaded on SIGHUP")
+
+// stringList is a flag set once per value
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+var sinks = func() *stringList {
+	l := new(stringList)
+	flag.Var(l, "sink", "Forward the HTTP events to a sink: syslog+udp://, syslog+tcp://, http(s)://, kafka:// or file:// URL. Can be set several times")
+	return l
+}()
+
+var processes = flag.Bool("processes", false, "Find the local process (pid, executable, command line, user, cgroup and container) of each end of the connections, Linux only")
+
+var shutdownTimeout = flag.Duration("shutdown-timeout", 5*time.Second, "Max time to wait for the TCP streams to be parsed, and for the web clients and the sinks to receive the events, when netgraph is stopped")
 
 var verbose = flag.Bool("v", true, "Show more message")
 
 // NGHTTPEventHandler handle HTTP events
 type NGHTTPEventHandler interface {
-	PushEvent(interface{})
+	PushEvent(ngnet.Event)
 	Wait()
 }
 
 var handlers []NGHTTPEventHandler
 
-func init() {
+// firstStreamSeq is the StreamSeq of the first TCP connection captured
+var firstStreamSeq uint
+
+// matchedPcap is set when -output-pcap writes only matched connections
+var matchedPcap *matchedPcapWriter
+
+// rawPcap is set when -output-pcap writes all the packets
+var rawPcap *pcapFileWriter
+
+// redactor is set when -redact is set
+var redactor *ngredact.Redactor
+
+// router sets the Route of the requests
+var router *ngroute.Router
+
+// processTable finds the local processes of the connections, nil unless -processes is set
+var processTable *ngproc.Table
+
+// parseFlags parses and checks the command line
+func parseFlags() {
 	flag.Parse()
-	if *inputPcap != "" && *outputPcap != "" {
+	if *inputPcap != "" && *outputPcap != "" && !pcapMatchFilterSet() {
 		log.Fatalln("ERROR: set -input-pcap and -output-pcap at the same time")
 	}
 	if *inputPcap != "" && *device != "" {
@@ -51,170 +132,326 @@ func init() {
 	if *inputPcap != "" {
 		*saveEvent = true
 	}
+	if *requestOnly {
+		*outputMode = "request"
+	}
+	switch *outputMode {
+	case "request", "response", "both", "paired":
+	default:
+		log.Fatalln("Unknown output mode:", *outputMode)
+	}
+	if *sampleRate <= 0 || *sampleRate > 1 {
+		log.Fatalln("ERROR: -sample-rate must be in (0, 1]")
+	}
+	if *processes && *inputPcap != "" {
+		log.Fatalln("ERROR: set -input-pcap and -processes at the same time, the processes of a pcap file are not running")
+	}
+}
+
+func initRedactor() {
+	if *redactConfig == "" {
+		return
+	}
+	var config *ngredact.Config
+	if *redactConfig != "builtin" {
+		var err error
+		config, err = ngredact.LoadConfig(*redactConfig)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *outputPcap != "" && (config == nil || !config.AllowRawPcap) {
+		log.Fatalln("ERROR: -output-pcap writes raw packets which can't be redacted, set \"allow_raw_pcap\" in the -redact config to allow it")
+	}
+	var err error
+	redactor, err = ngredact.New(config)
+	if err != nil {
+		log.Fatalln("Bad redaction config:", err)
+	}
+}
+
+func initRouter() {
+	var patterns []string
+	if strings.HasPrefix(*routePatterns, "@") {
+		data, err := ioutil.ReadFile((*routePatterns)[1:])
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				patterns = append(patterns, line)
+			}
+		}
+	} else {
+		patterns = splitList(*routePatterns)
+	}
+	var err error
+	router, err = ngroute.New(patterns)
+	if err != nil {
+		log.Fatalln("Bad -routes:", err)
+	}
+}
+
+func initProcessTable() {
+	if !*processes {
+		return
+	}
+	var err error
+	processTable, err = ngproc.New()
+	if err != nil {
+		log.Fatalln("Cannot find the processes:", err)
+	}
+}
+
+func newServerSecurity() *serverSecurity {
+	security := new(serverSecurity)
+	if *tlsCert != "" || *serveTLS {
+		if (*tlsCert == "") != (*tlsKey == "") {
+			log.Fatalln("ERROR: set both -tls-cert and -tls-key")
+		}
+		if err := security.setTLS(*tlsCert, *tlsKey); err != nil {
+			log.Fatalln("Cannot set up TLS:", err)
+		}
+	}
+	if *authBasic != "" {
+		if err := security.setBasicAuth(*authBasic); err != nil {
+			log.Fatalln("Bad -auth-basic:", err)
+		}
+	}
+	if *authToken != "" {
+		if err := security.setToken(*authToken); err != nil {
+			log.Fatalln("Bad -auth-token:", err)
+		}
+	}
+	security.allowedOrigins = splitList(*allowedOrigins)
+	return security
 }
 
 func initEventHandlers() {
+	initRedactor()
+	initRouter()
+	initProcessTable()
 	if *bindingPort != 0 {
-		addr := fmt.Sprintf(":%d", *bindingPort)
-		ngserver := NewNGServer(addr, *saveEvent)
+		addr := net.JoinHostPort(*bindAddr, strconv.Itoa(*bindingPort))
+		if *clientOverflow != "drop" && *clientOverflow != "disconnect" {
+			log.Fatalln("Unknown client overflow policy:", *clientOverflow)
+		}
+		var store ngstore.Store
+		if *storeDir != "" {
+			diskStore, err := ngstore.NewDiskStore(*storeDir, ngstore.Limits{
+				MaxBytes: *storeRetentionBytes,
+				MaxAge:   *storeRetentionAge,
+			})
+			if err != nil {
+				log.Fatalln("Cannot open store:", err)
+			}
+			firstStreamSeq = diskStore.NextSeq()
+			store = diskStore
+		} else if *saveEvent {
+			store = ngstore.NewMemoryStore(ngstore.Limits{
+				MaxEvents: *storeMaxEvents,
+				MaxBytes:  *storeMaxBytes,
+				MaxAge:    *storeMaxAge,
+			})
+		}
+		ngserver := NewNGServer(addr, store, *clientQueueSize, *clientOverflow == "disconnect", newServerSecurity())
+		if *inputPcap == "" {
+			// end the windows of the statistics now, even without traffic
+			ngserver.endpoints.Clock = time.Now
+		}
 		ngserver.Serve()
 		handlers = append(handlers, ngserver)
 	}
 
 	if *outputHTTP != "" {
-		p := NewEventPrinter(*outputHTTP)
-		handlers = append(handlers, p)
+		var printer NGHTTPEventHandler
+		if *outputTemplate != "" || *outputTemplateFile != "" {
+			tmpl, err := parseOutputTemplate(*outputTemplate, *outputTemplateFile)
+			if err != nil {
+				log.Fatalln("Bad template:", err)
+			}
+			printer = NewTemplatePrinter(*outputHTTP, tmpl)
+		} else {
+			switch *outputFormat {
+			case "text":
+				printer = NewEventPrinter(*outputHTTP, *outputMode)
+			case "har":
+				printer = NewHARPrinter(*outputHTTP)
+			case "json":
+				printer = NewJSONPrinter(*outputHTTP, false)
+			case "json-pair":
+				printer = NewJSONPrinter(*outputHTTP, true)
+			default:
+				log.Fatalln("Unknown output format:", *outputFormat)
+			}
+		}
+		if *outputFilter != "" {
+			filter, err := ngfilter.Parse(*outputFilter)
+			if err != nil {
+				log.Fatalln("Bad filter:", err)
+			}
+			printer = newFilteredHandler(printer, filter)
+		}
+		handlers = append(handlers, printer)
 	}
-}
 
-func autoSelectDev() string {
-	ifs, err := pcap.FindAllDevs()
-	if err != nil {
-		log.Fatalln(err)
+	if *outputPcap != "" && pcapMatchFilterSet() {
+		var filter pcapMatchFilter
+		filter.host = *outputPcapHost
+		filter.pathPrefix = *outputPcapPath
+		filter.method = *outputPcapMethod
+		var err error
+		filter.minCode, filter.maxCode, err = parseCodeRange(*outputPcapCode)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		matchedPcap = newMatchedPcapWriter(*outputPcap, filter)
+		handlers = append(handlers, matchedPcap)
 	}
-	var available []string
-	for _, i := range ifs {
-		addrFound := false
-		var addrs []string
-		for _, addr := range i.Addresses {
-			if addr.IP.IsLoopback() ||
-				addr.IP.IsMulticast() ||
-				addr.IP.IsUnspecified() ||
-				addr.IP.IsLinkLocalUnicast() {
-				continue
-			}
-			addrFound = true
-			addrs = append(addrs, addr.IP.String())
+
+	if *alertRules != "" {
+		h, err := newAlertHandler(*alertRules, *inputPcap == "")
+		if err != nil {
+			log.Fatalln("Bad alert rules:", err)
 		}
-		if addrFound {
-			available = append(available, i.Name)
+		handlers = append(handlers, h)
+	}
+
+	for _, rawurl := range *sinks {
+		h, err := newSinkHandler(rawurl)
+		if err != nil {
+			log.Fatalln("Bad sink:", err)
 		}
+		handlers = append(handlers, h)
 	}
-	if len(available) > 0 {
-		return available[0]
+}
+
+func pcapMatchFilterSet() bool {
+	return *outputPcapHost != "" || *outputPcapPath != "" ||
+		*outputPcapMethod != "" || *outputPcapCode != ""
+}
+
+func headerValue(headers []ngnet.HTTPHeaderItem, name string) string {
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
 	}
 	return ""
 }
 
-func packetSource() *gopacket.PacketSource {
+func packetSource() *ngcapture.PcapSource {
 	if *inputPcap != "" {
-		handle, err := pcap.OpenOffline(*inputPcap)
+		source, err := ngcapture.OpenFile(*inputPcap)
 		if err != nil {
 			log.Fatalln(err)
 		}
 		log.Printf("open pcap file \"%s\"\n", *inputPcap)
-		return gopacket.NewPacketSource(handle, handle.LinkType())
+		return source
 	}
 
 	if *device == "" {
-		*device = autoSelectDev()
+		var err error
+		if *device, err = ngcapture.DefaultDevice(); err != nil {
+			log.Fatalln(err)
+		}
 		if *device == "" {
 			log.Fatalln("no device to capture")
 		}
 	}
 
-	handle, err := pcap.OpenLive(*device, 1024*1024, true, pcap.BlockForever)
+	source, err := ngcapture.OpenLive(*device, *bpf)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	if *bpf != "" {
-		if err = handle.SetBPFFilter(*bpf); err != nil {
-			log.Fatalln("Failed to set BPF filter:", err)
-		}
-	}
 	log.Printf("open live on device \"%s\", bpf \"%s\"\n", *device, *bpf)
-	return gopacket.NewPacketSource(handle, handle.LinkType())
+	return source
 }
 
-func runNGNet(packetSource *gopacket.PacketSource, eventChan chan<- interface{}) {
-	streamFactory := ngnet.NewHTTPStreamFactory(eventChan)
-	pool := tcpassembly.NewStreamPool(streamFactory)
-	assembler := tcpassembly.NewAssembler(pool)
-
-	var pcapWriter *pcapgo.Writer
-	if *outputPcap != "" {
-		outPcapFile, err := os.Create(*outputPcap)
-		if err != nil {
-			log.Fatalln(err)
+// splitList splits a comma separated flag value
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
 		}
-		defer outPcapFile.Close()
-		pcapWriter = pcapgo.NewWriter(outPcapFile)
-		pcapWriter.WriteFileHeader(65536, layers.LinkTypeEthernet)
 	}
+	return list
+}
 
-	var count uint
-	ticker := time.Tick(time.Minute)
-	var lastPacketTimestamp time.Time
-
-LOOP:
-	for {
-		select {
-		case packet := <-packetSource.Packets():
-			if packet == nil {
-				break LOOP
-			}
-
-			count++
-			netLayer := packet.NetworkLayer()
-			if netLayer == nil {
-				continue
-			}
-			transLayer := packet.TransportLayer()
-			if transLayer == nil {
-				continue
-			}
-			tcp, _ := transLayer.(*layers.TCP)
-			if tcp == nil {
-				continue
-			}
-
-			if pcapWriter != nil {
-				pcapWriter.WritePacket(packet.Metadata().CaptureInfo, packet.Data())
-			}
-
-			assembler.AssembleWithTimestamp(
-				netLayer.NetworkFlow(),
-				tcp,
-				packet.Metadata().CaptureInfo.Timestamp)
+func streamFilterSet() bool {
+	return *sampleRate != 1 || *allowHosts != "" || *denyHosts != "" ||
+		*allowPaths != "" || *denyPaths != ""
+}
 
-			lastPacketTimestamp = packet.Metadata().CaptureInfo.Timestamp
-		case <-ticker:
-			assembler.FlushOlderThan(lastPacketTimestamp.Add(time.Minute * -2))
+func captureOptions(source ngcapture.PacketSource) ngcapture.Options {
+	var options ngcapture.Options
+	options.Source = source
+	if streamFilterSet() {
+		options.Filter = &ngnet.StreamFilter{
+			SampleRate: *sampleRate,
+			AllowHosts: splitList(*allowHosts),
+			DenyHosts:  splitList(*denyHosts),
+			AllowPaths: splitList(*allowPaths),
+			DenyPaths:  splitList(*denyPaths),
 		}
 	}
-
-	assembler.FlushAll()
-	log.Println("Read pcap file complete")
-	streamFactory.Wait()
-	log.Println("Parse complete, packet count: ", count)
-
-	close(eventChan)
+	if processTable != nil {
+		options.ProcessLookup = processTable
+	}
+	if matchedPcap != nil {
+		options.PacketHandler = matchedPcap
+	} else if *outputPcap != "" {
+		rawPcap = newPcapFileWriter(*outputPcap)
+		options.PacketHandler = rawPcap
+	}
+	options.FirstStreamSeq = firstStreamSeq
+	options.ShutdownTimeout = *shutdownTimeout
+	options.Transactions = true
+	options.Logger = log.Default()
+	return options
 }
 
 // EventPrinter print HTTP events to file or stdout
 type EventPrinter struct {
-	file *os.File
+	name   string
+	file   *os.File
+	mode   string
+	pairer *transactionPairer
 }
 
-// NewEventPrinter creates EventPrinter
-func NewEventPrinter(name string) *EventPrinter {
-	p := new(EventPrinter)
-	var err error
+// openOutputFile opens the file set by -o, "stdout" means the console
+func openOutputFile(name string) *os.File {
 	if name == "stdout" {
-		p.file = os.Stdout
-	} else {
-		p.file, err = os.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0755)
-		if err != nil {
-			log.Fatalln("Cannot open file ", name)
-		}
+		return os.Stdout
+	}
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		log.Fatalln("Cannot open file ", name)
 	}
+	return file
+}
 
+// NewEventPrinter creates EventPrinter.
+// mode selects the events to print: "request", "response", "both" or "paired".
+// In "paired" mode a request is printed together with its response
+// once the transaction completes.
+func NewEventPrinter(name string, mode string) *EventPrinter {
+	p := new(EventPrinter)
+	p.name = name
+	p.file = openOutputFile(name)
+	p.mode = mode
+	if mode == "paired" {
+		p.pairer = newTransactionPairer()
+		p.pairer.expired = p.printTransaction
+	}
 	return p
 }
 
 func (p *EventPrinter) printHTTPRequestEvent(req ngnet.HTTPRequestEvent) {
 	fmt.Fprintf(p.file, "[%s] #%d Request %s->%s\r\n",
-		req.Start.Format("2006-01-02 15:04:05.000"), req.StreamSeq, req.ClientAddr, req.ServerAddr)
+		req.Start.Format("2006-01-02 15:04:05.000"), req.StreamSeq,
+		addrWithName(req.ClientAddr, req.ClientName), addrWithName(req.ServerAddr, req.ServerName))
 	fmt.Fprintf(p.file, "%s %s %s\r\n", req.Method, req.URI, req.Version)
 	for _, h := range req.Headers {
 		fmt.Fprintf(p.file, "%s: %s\r\n", h.Name, h.Value)
@@ -227,6 +464,28 @@ func (p *EventPrinter) printHTTPRequestEvent(req ngnet.HTTPRequestEvent) {
 	fmt.Fprintf(p.file, "\r\n\r\n")
 }
 
+// addrWithName appends the DNS name of an address if it is known
+func addrWithName(addr, name string) string {
+	if name == "" {
+		return addr
+	}
+	return addr + " (" + name + ")"
+}
+
+func (p *EventPrinter) printDNSQueryEvent(q ngnet.DNSQueryEvent) {
+	result := "no response"
+	if q.Answered {
+		result = q.RCode
+	}
+	fmt.Fprintf(p.file, "[%s] DNS %s %s->%s %s %s %s %.3fms\r\n",
+		q.Start.Format("2006-01-02 15:04:05.000"), q.Protocol, q.ClientAddr, q.ServerAddr,
+		q.QType, q.Name, result, milliseconds(q.Duration))
+	for _, a := range q.Answers {
+		fmt.Fprintf(p.file, "%s %s %d %s\r\n", a.Name, a.Type, a.TTL, a.Data)
+	}
+	fmt.Fprintf(p.file, "\r\n")
+}
+
 func (p *EventPrinter) printHTTPResponseEvent(resp ngnet.HTTPResponseEvent) {
 	fmt.Fprintf(p.file, "[%s] #%d Response %s<-%s\r\n",
 		resp.Start.Format("2006-01-02 15:04:05.000"), resp.StreamSeq, resp.ClientAddr, resp.ServerAddr)
@@ -242,36 +501,107 @@ func (p *EventPrinter) printHTTPResponseEvent(resp ngnet.HTTPResponseEvent) {
 	fmt.Fprintf(p.file, "\r\n\r\n")
 }
 
+func (p *EventPrinter) printTransaction(t *httpTransaction) {
+	p.printHTTPRequestEvent(t.Request)
+	if t.Response == nil {
+		fmt.Fprintf(p.file, "======== #%s %s %s (no response) ========\r\n\r\n",
+			t.ID, t.Request.Method, t.Request.URI)
+		return
+	}
+	p.printHTTPResponseEvent(*t.Response)
+	fmt.Fprintf(p.file, "======== #%s %s %s %d %.3fms ========\r\n\r\n",
+		t.ID, t.Request.Method, t.Request.URI, t.Response.Code,
+		milliseconds(t.Response.End.Sub(t.Request.Start)))
+}
+
 // PushEvent implements the function of interface NGHTTPEventHandler
-func (p *EventPrinter) PushEvent(e interface{}) {
+func (p *EventPrinter) PushEvent(e ngnet.Event) {
+	if q, ok := e.(ngnet.DNSQueryEvent); ok {
+		p.printDNSQueryEvent(q)
+		return
+	}
+	if p.pairer != nil {
+		if t, completed := p.pairer.push(e); completed {
+			p.printTransaction(t)
+		}
+		return
+	}
 	switch v := e.(type) {
 	case ngnet.HTTPRequestEvent:
-		p.printHTTPRequestEvent(v)
+		if p.mode != "response" {
+			p.printHTTPRequestEvent(v)
+		}
 	case ngnet.HTTPResponseEvent:
-		if !*requestOnly {
+		if p.mode != "request" {
 			p.printHTTPResponseEvent(v)
 		}
+	case ngnet.TransactionEvent:
+		// printed from its request and response
 	default:
 		log.Printf("Unknown event: %v", e)
 	}
 }
 
-// Wait implements the function of interface NGHTTPEventHandler
-func (p *EventPrinter) Wait() {}
+// Reopen opens the output file again after it was rotated
+func (p *EventPrinter) Reopen() (err error) {
+	p.file, err = reopenOutputFile(p.name, p.file)
+	return err
+}
 
-func runEventHandler(eventChan <-chan interface{}) {
-	for e := range eventChan {
-		if e == nil {
-			break
+// Wait implements the function of interface NGHTTPEventHandler
+func (p *EventPrinter) Wait() {
+	if p.pairer != nil {
+		for _, t := range p.pairer.unanswered() {
+			p.printTransaction(t)
 		}
-		for _, h := range handlers {
-			h.PushEvent(e)
+	}
+}
+
+func runEventHandler(eventChan <-chan ngnet.Event) {
+LOOP:
+	for {
+		select {
+		case e, ok := <-eventChan:
+			if !ok {
+				break LOOP
+			}
+			summary.count(e)
+			switch v := e.(type) {
+			case ngnet.HTTPRequestEvent:
+				v.Route = router.Route(v.URI)
+				e = v
+			case ngnet.TransactionEvent:
+				v.Request.Route = router.Route(v.Request.URI)
+				e = v
+			}
+			if redactor != nil {
+				e = redactor.Redact(e)
+			}
+			for _, h := range handlers {
+				h.PushEvent(e)
+			}
+		case <-reopenHandlers:
+			reopenOutputFiles()
 		}
 	}
 
+	// The web server keeps serving the saved events until netgraph is
+	// stopped, so the other handlers finish first.
+	var servers []*NGServer
 	for _, h := range handlers {
+		if s, ok := h.(*NGServer); ok {
+			servers = append(servers, s)
+			continue
+		}
 		h.Wait()
 	}
+	if len(servers) > 0 {
+		<-stopCapture
+		for _, s := range servers {
+			s.Close("netgraph is shutting down", *shutdownTimeout)
+			s.Wait()
+		}
+	}
 }
 
 /*
@@ -280,8 +610,25 @@ func runEventHandler(eventChan <-chan interface{}) {
 //go:generate python embed_html.py
 
 func main() {
+	parseFlags()
 	initEventHandlers()
-	eventChan := make(chan interface{}, 1024)
-	go runNGNet(packetSource(), eventChan)
-	runEventHandler(eventChan)
+	source := packetSource()
+	c, err := ngcapture.New(captureOptions(source))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	capture.set(c)
+	summary.start = time.Now()
+	go handleSignals()
+	go func() {
+		<-stopCapture
+		c.Stop()
+	}()
+	c.Start(context.Background())
+	runEventHandler(c.Events())
+	if rawPcap != nil {
+		rawPcap.Close()
+	}
+	summary.setStats(c.Stats())
+	summary.print()
 }
@@ -0,0 +1,156 @@
+package ngalert
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is the default of Action.Timeout
+const DefaultTimeout = 10 * time.Second
+
+// action sends an alert, payload is the alert in JSON
+type action interface {
+	run(a *Alert, payload []byte) error
+	String() string
+}
+
+func compileAction(a Action, logs map[string]*logAction) (action, error) {
+	set := 0
+	for _, s := range []bool{a.Webhook != "", len(a.Exec) != 0, a.Log != ""} {
+		if s {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, errors.New("an action needs exactly one of webhook, exec or log")
+	}
+	timeout := time.Duration(a.Timeout)
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	switch {
+	case a.Webhook != "":
+		u, err := url.Parse(a.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("bad webhook URL %q", a.Webhook)
+		}
+		return &webhookAction{a.Webhook, &http.Client{Timeout: timeout}}, nil
+	case len(a.Exec) != 0:
+		return &execAction{a.Exec, timeout}, nil
+	}
+	// the rules writing to the same file share it
+	l := logs[a.Log]
+	if l == nil {
+		l = &logAction{name: a.Log}
+		if err := l.open(); err != nil {
+			return nil, err
+		}
+		logs[a.Log] = l
+	}
+	return l, nil
+}
+
+// webhookAction posts the alert to a URL
+type webhookAction struct {
+	url    string
+	client *http.Client
+}
+
+func (w *webhookAction) run(a *Alert, payload []byte) error {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+func (w *webhookAction) String() string {
+	return "webhook " + w.url
+}
+
+// execAction runs a command with the alert on its stdin, and the rule and
+// state in the environment variables NETGRAPH_ALERT_RULE and
+// NETGRAPH_ALERT_STATE
+type execAction struct {
+	args    []string
+	timeout time.Duration
+}
+
+func (e *execAction) run(a *Alert, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, e.args[0], e.args[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(), "NETGRAPH_ALERT_RULE="+a.Rule, "NETGRAPH_ALERT_STATE="+a.State)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if len(out) > 0 {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		}
+		return err
+	}
+	return nil
+}
+
+func (e *execAction) String() string {
+	return "exec " + e.args[0]
+}
+
+// logAction appends the alerts to a file
+type logAction struct {
+	name  string
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func (l *logAction) open() error {
+	f, err := os.OpenFile(l.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	old := l.file
+	l.file = f
+	l.mutex.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (l *logAction) close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+func (l *logAction) run(a *Alert, payload []byte) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return errors.New("file is closed")
+	}
+	_, err := l.file.Write(append(payload, '\n'))
+	return err
+}
+
+func (l *logAction) String() string {
+	return "log " + l.name
+}
@@ -0,0 +1,365 @@
+// Package ngalert evaluates alerting rules against the captured HTTP
+// transactions, and runs the actions of a rule when it fires or resolves:
+// post the alert to a webhook, run a command with the alert on its stdin or
+// append it to a log file. The rules are the ngfilter expressions of a JSON
+// config file, e.g.
+//
+//	{
+//	    "rules": [
+//	        {"name": "shop-5xx", "filter": "host == \"shop.example.com\"", "match": "status >= 500",
+//	         "window": "1m", "threshold": 0.05, "min_count": 20, "cooldown": "10m",
+//	         "actions": [{"webhook": "http://alerts.example.com/hook"}]},
+//	        {"name": "slow-checkout", "filter": "path ~ \"^/checkout\" && duration > 2s",
+//	         "cooldown": "1m", "actions": [{"exec": ["/usr/local/bin/page", "web"]}]},
+//	        {"name": "debug-header", "filter": "req.header[\"X-Debug\"]",
+//	         "actions": [{"log": "/var/log/netgraph/alerts.log"}]}
+//	    ]
+//	}
+//
+// The windows end at the newest transaction seen, like the statistics of
+// ngstats, unless Engine.Clock is set.
+package ngalert
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ga0/netgraph/ngfilter"
+)
+
+// States of the alerts
+const (
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+// maxQueuedAlerts is the number of alerts waiting for their actions, the
+// alerts after it are dropped
+const maxQueuedAlerts = 1000
+
+// Config is the JSON config file of the rules
+type Config struct {
+	Rules []Rule `json:"rules"`
+}
+
+// LoadConfig reads a config file
+func LoadConfig(name string) (*Config, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	c := new(Config)
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("bad alert config %s: %v", name, err)
+	}
+	return c, nil
+}
+
+// Transaction is the transaction which fired an alert
+type Transaction struct {
+	Start      time.Time `json:"start"`
+	ClientAddr string    `json:"client_addr"`
+	ServerAddr string    `json:"server_addr"`
+	Method     string    `json:"method"`
+	Host       string    `json:"host"`
+	URI        string    `json:"uri"`
+	Route      string    `json:"route,omitempty"`
+	Status     uint      `json:"status,omitempty"` // 0 without response
+	DurationMs float64   `json:"duration_ms,omitempty"`
+}
+
+func newTransaction(t ngfilter.Transaction) *Transaction {
+	req := t.Request
+	a := &Transaction{Start: req.Start, ClientAddr: req.ClientAddr, ServerAddr: req.ServerAddr,
+		Method: req.Method, URI: req.URI, Route: req.Route}
+	for _, h := range req.Headers {
+		if strings.EqualFold(h.Name, "Host") {
+			a.Host = h.Value
+			break
+		}
+	}
+	if t.Response != nil {
+		end := t.Response.End
+		if end.IsZero() {
+			end = t.Response.Start
+		}
+		a.Status = t.Response.Code
+		a.DurationMs = float64(end.Sub(req.Start)) / float64(time.Millisecond)
+	}
+	return a
+}
+
+// Alert is sent to the actions when a rule fires or resolves
+type Alert struct {
+	Rule        string       `json:"rule"`
+	State       string       `json:"state"`
+	Time        time.Time    `json:"time"`
+	Window      string       `json:"window,omitempty"` // rules with window only
+	Value       float64      `json:"value"`            // of the window, 1 for the rules without window
+	Threshold   float64      `json:"threshold"`
+	Count       uint64       `json:"count"`                 // transactions in the window
+	Canceled    uint64       `json:"canceled,omitempty"`    // firings canceled by the cooldown since the last alert
+	Transaction *Transaction `json:"transaction,omitempty"` // which fired the rule
+}
+
+// Engine evaluates the rules. The alerts are sent by a goroutine, so slow
+// actions don't hold the evaluation. It is safe for concurrent use.
+type Engine struct {
+	Clock func() time.Time // the time of the windows, the newest transaction if nil
+
+	mutex  sync.Mutex
+	rules  []*rule
+	logs   map[string]*logAction
+	newest time.Time
+	queue  chan *queuedAlert
+	done   chan struct{}
+	closed bool
+}
+
+type queuedAlert struct {
+	alert   Alert
+	actions []action
+}
+
+// New creates an Engine with the rules of a config
+func New(config *Config) (*Engine, error) {
+	e := new(Engine)
+	e.logs = make(map[string]*logAction)
+	if err := e.Load(config); err != nil {
+		return nil, err
+	}
+	e.queue = make(chan *queuedAlert, maxQueuedAlerts)
+	e.done = make(chan struct{})
+	go e.send()
+	return e, nil
+}
+
+// Load replaces the rules by the ones of a config. The rules of the same name
+// and condition keep their state, e.g. they don't fire again if they are
+// firing. The rules are not changed if the config has an error.
+func (e *Engine) Load(config *Config) error {
+	logs := make(map[string]*logAction)
+	var rules []*rule
+	names := make(map[string]bool)
+	fail := func(err error) error {
+		for name, l := range logs {
+			if e.logs[name] != l {
+				l.close()
+			}
+		}
+		return err
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for name, l := range e.logs {
+		logs[name] = l
+	}
+	for _, r := range config.Rules {
+		if names[r.Name] {
+			return fail(fmt.Errorf("duplicate rule %s", r.Name))
+		}
+		names[r.Name] = true
+		c, err := compileRule(r, logs)
+		if err != nil {
+			return fail(err)
+		}
+		rules = append(rules, c)
+	}
+	for _, c := range rules {
+		for _, old := range e.rules {
+			if old.Name != c.Name {
+				continue
+			}
+			c.fired = old.fired
+			if c.sameCondition(old) {
+				c.slots, c.firing, c.canceled = old.slots, old.firing, old.canceled
+			}
+		}
+	}
+	// the files of the removed log actions are closed, the others are kept
+	used := make(map[string]bool)
+	for _, c := range rules {
+		for _, a := range c.actions {
+			if l, ok := a.(*logAction); ok {
+				used[l.name] = true
+			}
+		}
+	}
+	for name, l := range logs {
+		if !used[name] {
+			l.close()
+			delete(logs, name)
+		}
+	}
+	e.rules = rules
+	e.logs = logs
+	return nil
+}
+
+// Rules returns the number of rules
+func (e *Engine) Rules() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return len(e.rules)
+}
+
+// Reopen opens the files of the log actions again, after they were rotated
+func (e *Engine) Reopen() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for _, l := range e.logs {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Engine) now() time.Time {
+	if e.Clock != nil {
+		return e.Clock()
+	}
+	return e.newest
+}
+
+// Add evaluates the rules against a transaction, it is added when its
+// request is seen, and again with its response. It returns the alerts sent.
+// A rule without window whose filter needs the response is decided with the
+// response, the other ones with the request. The rules with window count the
+// transactions with their response only.
+func (e *Engine) Add(t ngfilter.Transaction) []Alert {
+	if t.Request == nil {
+		return nil
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if t.Request.Start.After(e.newest) {
+		e.newest = t.Request.Start
+	}
+	now := e.now()
+	var alerts []Alert
+	for _, r := range e.rules {
+		if r.Window == 0 {
+			if r.filter.NeedsResponse() != (t.Response != nil) || !r.filter.Match(t) {
+				continue
+			}
+			if !r.fired.IsZero() && now.Sub(r.fired) < time.Duration(r.Cooldown) {
+				r.canceled++
+				continue
+			}
+			a := Alert{Rule: r.Name, State: StateFiring, Time: now, Value: 1, Threshold: r.Threshold,
+				Count: 1, Canceled: r.canceled, Transaction: newTransaction(t)}
+			r.fired, r.canceled = now, 0
+			alerts = append(alerts, e.queueAlert(r, a))
+			continue
+		}
+		if t.Response == nil || (r.filter != nil && !r.filter.Match(t)) {
+			continue
+		}
+		r.count(t.Request.Start, r.match != nil && r.match.Match(t))
+		if a, ok := e.evaluate(r, now, t); ok {
+			alerts = append(alerts, a)
+		}
+	}
+	return alerts
+}
+
+// Tick evaluates the rules with window at the time of the clock, so they
+// resolve when the transactions stop. It does nothing if Clock is not set.
+func (e *Engine) Tick() []Alert {
+	if e.Clock == nil {
+		return nil
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	now := e.now()
+	var alerts []Alert
+	for _, r := range e.rules {
+		if r.Window == 0 {
+			continue
+		}
+		if a, ok := e.evaluate(r, now, ngfilter.Transaction{}); ok {
+			alerts = append(alerts, a)
+		}
+	}
+	return alerts
+}
+
+// evaluate fires or resolves a rule with window, t is the last transaction
+// counted, if any
+func (e *Engine) evaluate(r *rule, now time.Time, t ngfilter.Transaction) (Alert, bool) {
+	value, count := r.value(now)
+	above := count >= r.MinCount && count > 0 && value > r.Threshold
+	a := Alert{Rule: r.Name, Time: now, Window: time.Duration(r.Window).String(),
+		Value: value, Threshold: r.Threshold, Count: count}
+	switch {
+	case above && !r.firing:
+		if !r.fired.IsZero() && now.Sub(r.fired) < time.Duration(r.Cooldown) {
+			return a, false
+		}
+		a.State = StateFiring
+		if t.Request != nil {
+			a.Transaction = newTransaction(t)
+		}
+		r.firing, r.fired = true, now
+		return e.queueAlert(r, a), true
+	case !above && r.firing:
+		a.State = StateResolved
+		r.firing = false
+		return e.queueAlert(r, a), true
+	}
+	return a, false
+}
+
+// queueAlert queues an alert for the actions of a rule
+func (e *Engine) queueAlert(r *rule, a Alert) Alert {
+	if e.queue == nil || e.closed {
+		return a
+	}
+	select {
+	case e.queue <- &queuedAlert{a, r.actions}:
+	default:
+		log.Printf("Alert %s %s dropped, %d alerts are waiting for their actions\n", a.Rule, a.State, maxQueuedAlerts)
+	}
+	return a
+}
+
+// send runs the actions of the queued alerts
+func (e *Engine) send() {
+	defer close(e.done)
+	for q := range e.queue {
+		payload, err := json.Marshal(q.alert)
+		if err != nil {
+			log.Println("Cannot encode alert:", err)
+			continue
+		}
+		for _, a := range q.actions {
+			if err := a.run(&q.alert, payload); err != nil {
+				log.Printf("Alert %s %s: %v failed: %v\n", q.alert.Rule, q.alert.State, a, err)
+			}
+		}
+	}
+}
+
+// Close waits for the actions of the queued alerts and closes the log files
+func (e *Engine) Close() {
+	e.mutex.Lock()
+	if e.closed {
+		e.mutex.Unlock()
+		return
+	}
+	e.closed = true
+	close(e.queue)
+	e.mutex.Unlock()
+	<-e.done
+	e.mutex.Lock()
+	for _, l := range e.logs {
+		l.close()
+	}
+	e.mutex.Unlock()
+}
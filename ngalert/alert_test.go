@@ -0,0 +1,214 @@
+package ngalert
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ga0/netgraph/ngfilter"
+	"github.com/ga0/netgraph/ngnet"
+)
+
+var start = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func transaction(host, uri string, at time.Duration, status uint, d time.Duration) ngfilter.Transaction {
+	req := &ngnet.HTTPRequestEvent{Method: "GET", URI: uri,
+		Headers: []ngnet.HTTPHeaderItem{{Name: "Host", Value: host}}}
+	req.Start = start.Add(at)
+	t := ngfilter.Transaction{Request: req}
+	if status != 0 {
+		resp := &ngnet.HTTPResponseEvent{Code: status}
+		resp.End = req.Start.Add(d)
+		t.Response = resp
+	}
+	return t
+}
+
+func newEngine(t *testing.T, config string) *Engine {
+	c := new(Config)
+	if err := json.Unmarshal([]byte(config), c); err != nil {
+		t.Fatal(err)
+	}
+	e, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func states(alerts []Alert) string {
+	var s []string
+	for _, a := range alerts {
+		s = append(s, a.Rule+" "+a.State)
+	}
+	return strings.Join(s, ",")
+}
+
+func TestRatioRule(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "alerts.log")
+	e := newEngine(t, `{"rules": [{"name": "5xx", "filter": "host == \"shop\"", "match": "status >= 500",
+		"window": "1m", "threshold": 0.05, "min_count": 10, "actions": [{"log": "`+log+`"}]}]}`)
+	var fired []Alert
+	add := func(host string, at time.Duration, status uint) {
+		fired = append(fired, e.Add(transaction(host, "/", at, status, 0))...)
+	}
+	// 1 error of 9 requests is under min_count, the other hosts don't count
+	for i := 0; i < 8; i++ {
+		add("shop", time.Duration(i)*time.Second, 200)
+		add("other", time.Duration(i)*time.Second, 500)
+	}
+	add("shop", 8*time.Second, 500)
+	if len(fired) != 0 {
+		t.Fatalf("unexpected alerts %s", states(fired))
+	}
+	add("shop", 9*time.Second, 200)
+	if states(fired) != "5xx firing" || fired[0].Count != 10 || fired[0].Value != 0.1 || fired[0].Transaction == nil {
+		t.Fatalf("bad alerts %+v", fired)
+	}
+	// still firing, then resolved when the error left the window
+	add("shop", 30*time.Second, 200)
+	add("shop", 70*time.Second, 200)
+	if states(fired) != "5xx firing,5xx resolved" || fired[1].Count != 2 {
+		t.Fatalf("bad alerts %+v", fired)
+	}
+
+	e.Close()
+	data, _ := ioutil.ReadFile(log)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"state":"firing"`) || !strings.Contains(lines[1], `"window":"1m0s"`) {
+		t.Errorf("bad log:\n%s", data)
+	}
+}
+
+func TestTransactionRule(t *testing.T) {
+	e := newEngine(t, `{"rules": [
+		{"name": "slow", "filter": "path ~ \"^/checkout\" && duration > 2s", "cooldown": "1m",
+		 "actions": [{"exec": ["true"]}]},
+		{"name": "debug", "filter": "req.header[\"X-Debug\"]", "actions": [{"exec": ["true"]}]}]}`)
+	defer e.Close()
+	var fired []Alert
+	add := func(t ngfilter.Transaction) {
+		fired = append(fired, e.Add(t)...)
+	}
+	slow := transaction("shop", "/checkout/pay", 0, 200, 3*time.Second)
+	add(ngfilter.Transaction{Request: slow.Request})
+	add(slow)
+	add(transaction("shop", "/checkout/pay", time.Second, 200, time.Second))
+	add(transaction("shop", "/checkout/pay", 10*time.Second, 200, 3*time.Second))
+	add(transaction("shop", "/checkout/pay", 70*time.Second, 200, 3*time.Second))
+	if states(fired) != "slow firing,slow firing" || fired[1].Canceled != 1 || fired[1].Transaction.DurationMs != 3000 {
+		t.Fatalf("bad alerts %+v", fired)
+	}
+
+	// decided with the request, not again with the response
+	fired = nil
+	debug := transaction("shop", "/", 80*time.Second, 200, 0)
+	debug.Request.Headers = append(debug.Request.Headers, ngnet.HTTPHeaderItem{Name: "X-Debug", Value: "1"})
+	add(ngfilter.Transaction{Request: debug.Request})
+	add(debug)
+	if states(fired) != "debug firing" || fired[0].Transaction.Status != 0 {
+		t.Fatalf("bad alerts %+v", fired)
+	}
+}
+
+func TestCountRuleAndTick(t *testing.T) {
+	now := start
+	e := newEngine(t, `{"rules": [{"name": "busy", "window": "10s", "threshold": 2,
+		"actions": [{"exec": ["true"]}]}]}`)
+	defer e.Close()
+	e.Clock = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		if alerts := e.Add(transaction("shop", "/", 0, 200, 0)); i < 2 && len(alerts) != 0 {
+			t.Fatalf("unexpected alerts %s", states(alerts))
+		} else if i == 2 && states(alerts) != "busy firing" {
+			t.Fatalf("bad alerts %+v", alerts)
+		}
+	}
+	now = start.Add(5 * time.Second)
+	if alerts := e.Tick(); len(alerts) != 0 {
+		t.Fatalf("unexpected alerts %s", states(alerts))
+	}
+	now = start.Add(11 * time.Second)
+	if alerts := e.Tick(); states(alerts) != "busy resolved" || alerts[0].Value != 0 {
+		t.Fatalf("bad alerts %+v", alerts)
+	}
+}
+
+func TestWebhookAndExec(t *testing.T) {
+	bodies := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- r.Header.Get("Content-Type") + " " + string(body)
+	}))
+	defer server.Close()
+	out := filepath.Join(t.TempDir(), "out")
+	e := newEngine(t, `{"rules": [{"name": "any", "filter": "status >= 500", "actions": [
+		{"webhook": "`+server.URL+`"},
+		{"exec": ["sh", "-c", "cat > `+out+`; echo $NETGRAPH_ALERT_RULE $NETGRAPH_ALERT_STATE >> `+out+`"]}]}]}`)
+	e.Add(transaction("shop", "/", 0, 503, 0))
+	e.Close()
+	if body := <-bodies; !strings.HasPrefix(body, "application/json {") || !strings.Contains(body, `"rule":"any"`) {
+		t.Errorf("bad webhook body %s", body)
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil || !strings.Contains(string(data), `"status":503`) || !strings.HasSuffix(string(data), "any firing\n") {
+		t.Errorf("bad command input %q %v", data, err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "a.log")
+	e := newEngine(t, `{"rules": [{"name": "busy", "window": "10s", "threshold": 1,
+		"actions": [{"log": "`+log+`"}]}]}`)
+	defer e.Close()
+	e.Add(transaction("shop", "/", 0, 200, 0))
+	if alerts := e.Add(transaction("shop", "/", 0, 200, 0)); states(alerts) != "busy firing" {
+		t.Fatalf("bad alerts %+v", alerts)
+	}
+	// the rule keeps firing after a reload
+	config := `{"rules": [{"name": "busy", "window": "10s", "threshold": 1, "actions": [{"log": "` + log + `"}]},
+		{"name": "new", "filter": "status == 404", "actions": [{"log": "` + log + `"}]}]}`
+	c := new(Config)
+	json.Unmarshal([]byte(config), c)
+	if err := e.Load(c); err != nil || e.Rules() != 2 {
+		t.Fatal(err)
+	}
+	if alerts := e.Add(transaction("shop", "/", 0, 200, 0)); len(alerts) != 0 {
+		t.Fatalf("unexpected alerts %s", states(alerts))
+	}
+
+	bad := []string{
+		`{"rules": [{"name": "x", "actions": [{"exec": ["true"]}]}]}`,
+		`{"rules": [{"name": "x", "filter": "status >", "actions": [{"exec": ["true"]}]}]}`,
+		`{"rules": [{"name": "x", "filter": "status > 1", "match": "status > 2", "actions": [{"exec": ["true"]}]}]}`,
+		`{"rules": [{"name": "x", "filter": "status > 1"}]}`,
+		`{"rules": [{"name": "x", "filter": "status > 1", "actions": [{"exec": ["true"], "log": "x"}]}]}`,
+		`{"rules": [{"name": "x", "filter": "status > 1", "actions": [{"webhook": "ftp://x"}]}]}`,
+		`{"rules": [{"name": "x", "window": "1h", "actions": [{"exec": ["true"]}]},
+			{"name": "x", "window": "1h", "actions": [{"exec": ["true"]}]}]}`,
+		`{"rules": [{"name": "x", "window": 60, "actions": [{"exec": ["true"]}]}]}`,
+	}
+	for _, b := range bad {
+		c := new(Config)
+		err := json.Unmarshal([]byte(b), c)
+		if err == nil {
+			err = e.Load(c)
+		}
+		if err == nil {
+			t.Errorf("bad config should be rejected: %s", b)
+		}
+	}
+	if e.Rules() != 2 {
+		t.Error("bad config should not change the rules")
+	}
+	if _, err := os.Stat(log); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,167 @@
+package ngalert
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ga0/netgraph/ngfilter"
+)
+
+// numSlots is the number of slots of the window of a rule
+const numSlots = 60
+
+// Duration is a time.Duration written like "1m" or "500ms" in the config
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("durations are strings like \"1m\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Rule is a rule of the config. Without Window, each transaction matching
+// Filter fires the rule. With Window, the rule fires when the value over the
+// window goes above Threshold, and resolves when it goes back under it: the
+// fraction of the transactions of Filter which match Match, or the number of
+// transactions of Filter if Match is not set.
+type Rule struct {
+	Name      string   `json:"name"`
+	Filter    string   `json:"filter,omitempty"` // transactions of the rule, all if empty
+	Match     string   `json:"match,omitempty"`
+	Window    Duration `json:"window,omitempty"`
+	Threshold float64  `json:"threshold,omitempty"`
+	MinCount  uint64   `json:"min_count,omitempty"` // transactions needed in the window to fire
+	Cooldown  Duration `json:"cooldown,omitempty"`  // min time between two firings
+	Actions   []Action `json:"actions"`
+}
+
+// Action is an action of a rule, with exactly one of Webhook, Exec or Log
+type Action struct {
+	Webhook string   `json:"webhook,omitempty"` // URL the alert is posted to
+	Exec    []string `json:"exec,omitempty"`    // command and arguments, the alert is written to its stdin
+	Log     string   `json:"log,omitempty"`     // file the alert is appended to, one JSON per line
+	Timeout Duration `json:"timeout,omitempty"` // of the webhook and the command, DefaultTimeout if not set
+}
+
+// counts are the transactions of a slot of a window
+type counts struct {
+	index   int64 // start time / slot duration
+	total   uint64
+	matched uint64
+}
+
+// rule is a compiled Rule and its state
+type rule struct {
+	Rule
+	filter   *ngfilter.Filter
+	match    *ngfilter.Filter
+	actions  []action
+	slots    [numSlots]counts
+	firing   bool
+	fired    time.Time // last time the rule fired
+	canceled uint64    // firings canceled by the cooldown since the last alert
+}
+
+func compileFilter(text string) (*ngfilter.Filter, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return ngfilter.Parse(text)
+}
+
+func compileRule(r Rule, logs map[string]*logAction) (*rule, error) {
+	if r.Name == "" {
+		return nil, errors.New("rule without name")
+	}
+	c := &rule{Rule: r}
+	var err error
+	if c.filter, err = compileFilter(r.Filter); err != nil {
+		return nil, fmt.Errorf("rule %s: bad filter: %v", r.Name, err)
+	}
+	if c.match, err = compileFilter(r.Match); err != nil {
+		return nil, fmt.Errorf("rule %s: bad match: %v", r.Name, err)
+	}
+	if r.Window < 0 || r.Cooldown < 0 {
+		return nil, fmt.Errorf("rule %s: negative duration", r.Name)
+	}
+	if r.Window == 0 {
+		if c.filter == nil {
+			return nil, fmt.Errorf("rule %s: a rule without window needs a filter", r.Name)
+		}
+		if c.match != nil {
+			return nil, fmt.Errorf("rule %s: match needs a window, put it in the filter", r.Name)
+		}
+	} else if time.Duration(r.Window) < numSlots*time.Millisecond {
+		return nil, fmt.Errorf("rule %s: window is shorter than %v", r.Name, numSlots*time.Millisecond)
+	}
+	if len(r.Actions) == 0 {
+		return nil, fmt.Errorf("rule %s: no action", r.Name)
+	}
+	for _, a := range r.Actions {
+		ca, err := compileAction(a, logs)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %v", r.Name, err)
+		}
+		c.actions = append(c.actions, ca)
+	}
+	return c, nil
+}
+
+// sameCondition tells whether two rules fire on the same transactions, so
+// the state of one can be kept by the other
+func (r *rule) sameCondition(o *rule) bool {
+	return r.Filter == o.Filter && r.Match == o.Match && r.Window == o.Window &&
+		r.Threshold == o.Threshold && r.MinCount == o.MinCount
+}
+
+func (r *rule) slotDuration() time.Duration {
+	return time.Duration(r.Window) / numSlots
+}
+
+// count adds a transaction of the filter to the window
+func (r *rule) count(at time.Time, matched bool) {
+	index := at.UnixNano() / int64(r.slotDuration())
+	s := &r.slots[index%numSlots]
+	if s.index != index {
+		*s = counts{index: index}
+	}
+	s.total++
+	if matched {
+		s.matched++
+	}
+}
+
+// value returns the value of the window ending at now, and the number of
+// transactions in it
+func (r *rule) value(now time.Time) (float64, uint64) {
+	last := now.UnixNano() / int64(r.slotDuration())
+	var total, matched uint64
+	for _, s := range r.slots {
+		if s.index > last-numSlots && s.index <= last {
+			total += s.total
+			matched += s.matched
+		}
+	}
+	if r.match == nil {
+		return float64(total), total
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	return float64(matched) / float64(total), total
+}
@@ -0,0 +1,315 @@
+// Package ngcapture captures the HTTP transactions and the DNS queries of a
+// packet source: the TCP streams are reassembled and parsed by ngnet, and the
+// events are sent on a channel. It is what the netgraph command runs, for the
+// programs which want to embed it:
+//
+//	source, err := ngcapture.OpenLive("eth0", "tcp port 80 or port 53")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	c, err := ngcapture.New(ngcapture.Options{Source: source})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	c.Start(ctx)
+//	for e := range c.Events() {
+//		switch e := e.(type) {
+//		case ngnet.HTTPRequestEvent:
+//			fmt.Println(e.ID, e.Method, e.URI)
+//		case ngnet.HTTPResponseEvent:
+//			fmt.Println(e.RequestID, e.Code, e.Reason)
+//		}
+//	}
+package ngcapture
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ga0/netgraph/ngnet"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// flushInterval is the period of the flush of the idle connections
+const flushInterval = time.Minute
+
+// streamTimeout is the time after which an idle TCP connection is closed
+const streamTimeout = 2 * time.Minute
+
+// dnsTimeout is the time after which a DNS query without response is sent
+// as unanswered
+const dnsTimeout = 10 * time.Second
+
+// PacketSource provides the packets to parse, the channel is closed after
+// the last packet. *gopacket.PacketSource implements it.
+type PacketSource interface {
+	Packets() chan gopacket.Packet
+}
+
+// PacketHandler sees the TCP packets before they are reassembled, e.g. to
+// write them to a pcap file. It is called from the goroutine of the capture.
+type PacketHandler interface {
+	HandlePacket(packet gopacket.Packet, netFlow gopacket.Flow, tcp *layers.TCP)
+	// FlushOlderThan is called with the time before which the idle
+	// connections are closed
+	FlushOlderThan(t time.Time)
+}
+
+// Options of a Capturer, only Source is required
+type Options struct {
+	Source          PacketSource
+	Filter          *ngnet.StreamFilter // parse only some of the TCP connections, all if nil
+	ProcessLookup   ngnet.ProcessLookup // finds the local processes of the connections if set
+	PacketHandler   PacketHandler       // sees the TCP packets if set
+	Transactions    bool                // send a TransactionEvent after each response
+	FirstStreamSeq  uint                // StreamSeq of the first TCP connection
+	EventBuffer     int                 // max events waiting to be read, 1024 if 0
+	ShutdownTimeout time.Duration       // max time to parse the TCP streams once stopped, 5s if 0
+	Logger          *log.Logger         // logs the end of the capture, nothing is logged if nil
+}
+
+// Stats of a Capturer
+type Stats struct {
+	Packets        uint64 // read from the source
+	RunningStreams int    // TCP connections being parsed
+	Streams        ngnet.StreamStats
+	Filter         ngnet.StreamFilterStats // connections dropped by Options.Filter
+	Drops          *Drops                  // packets lost by the source, nil if it does not count them
+	QueueLength    int                     // events waiting to be read
+	QueueCapacity  int
+}
+
+// Capturer parses the packets of a source in a goroutine
+type Capturer struct {
+	options  Options
+	factory  ngnet.HTTPStreamFactory
+	packets  uint64           // accessed atomically
+	events   chan ngnet.Event // written by the factory
+	out      chan ngnet.Event // read by the user
+	started  int32            // accessed atomically
+	stop     chan struct{}
+	stopOnce sync.Once
+	abandon  chan struct{} // closed if the streams are not parsed before the shutdown timeout
+	done     chan struct{}
+}
+
+// New creates a Capturer
+func New(options Options) (*Capturer, error) {
+	if options.Source == nil {
+		return nil, errors.New("no packet source")
+	}
+	if options.EventBuffer <= 0 {
+		options.EventBuffer = 1024
+	}
+	if options.ShutdownTimeout <= 0 {
+		options.ShutdownTimeout = 5 * time.Second
+	}
+	c := new(Capturer)
+	c.options = options
+	c.events = make(chan ngnet.Event, options.EventBuffer)
+	c.out = make(chan ngnet.Event)
+	if options.Filter != nil {
+		c.factory = ngnet.NewFilteredHTTPStreamFactory(c.events, *options.Filter)
+	} else {
+		c.factory = ngnet.NewHTTPStreamFactory(c.events)
+	}
+	if options.ProcessLookup != nil {
+		c.factory.SetProcessLookup(options.ProcessLookup)
+	}
+	c.factory.SetTransactions(options.Transactions)
+	c.factory.SetNextSeq(options.FirstStreamSeq)
+	c.stop = make(chan struct{})
+	c.abandon = make(chan struct{})
+	c.done = make(chan struct{})
+	return c, nil
+}
+
+// Start reads the packets until the end of the source, Stop is called or ctx
+// is canceled
+func (c *Capturer) Start(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&c.started, 0, 1) {
+		return errors.New("capture already started")
+	}
+	go c.run()
+	go c.forward()
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Stop()
+		case <-c.done:
+		}
+	}()
+	return nil
+}
+
+// Events returns the channel of the events: ngnet.HTTPRequestEvent,
+// ngnet.HTTPResponseEvent, ngnet.DNSQueryEvent and, with
+// Options.Transactions, ngnet.TransactionEvent. It is closed when the
+// capture is finished. The events must be read, the capture waits for them.
+func (c *Capturer) Events() <-chan ngnet.Event {
+	return c.out
+}
+
+// Stop stops reading the packets. The events of the packets already read are
+// still sent, until the TCP streams are parsed or Options.ShutdownTimeout.
+func (c *Capturer) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+}
+
+// Stats returns the counters of the capture, it is safe for concurrent use
+func (c *Capturer) Stats() Stats {
+	var stats Stats
+	stats.Packets = atomic.LoadUint64(&c.packets)
+	stats.RunningStreams = int(c.factory.RunningStreamCount())
+	stats.Streams = c.factory.Stats()
+	stats.Filter = c.factory.FilterStats()
+	if d, ok := c.options.Source.(DropCounter); ok {
+		if drops, err := d.Drops(); err == nil {
+			stats.Drops = &drops
+		}
+	}
+	stats.QueueLength = len(c.events)
+	stats.QueueCapacity = cap(c.events)
+	return stats
+}
+
+func (c *Capturer) run() {
+	defer close(c.done)
+	pool := tcpassembly.NewStreamPool(c.factory)
+	assembler := tcpassembly.NewAssembler(pool)
+	handler := c.options.PacketHandler
+	packets := c.options.Source.Packets()
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	var lastPacketTimestamp time.Time
+
+LOOP:
+	for {
+		select {
+		case packet, ok := <-packets:
+			if !ok || packet == nil {
+				break LOOP
+			}
+
+			atomic.AddUint64(&c.packets, 1)
+			netLayer := packet.NetworkLayer()
+			if netLayer == nil {
+				continue
+			}
+			transLayer := packet.TransportLayer()
+			if transLayer == nil {
+				continue
+			}
+			if udp, ok := transLayer.(*layers.UDP); ok {
+				// DNS, decoded to name the addresses
+				lastPacketTimestamp = packet.Metadata().CaptureInfo.Timestamp
+				c.factory.HandleUDP(netLayer.NetworkFlow(), udp, lastPacketTimestamp)
+				continue
+			}
+			tcp, _ := transLayer.(*layers.TCP)
+			if tcp == nil {
+				continue
+			}
+
+			if handler != nil {
+				handler.HandlePacket(packet, netLayer.NetworkFlow(), tcp)
+			}
+
+			assembler.AssembleWithTimestamp(
+				netLayer.NetworkFlow(),
+				tcp,
+				packet.Metadata().CaptureInfo.Timestamp)
+
+			lastPacketTimestamp = packet.Metadata().CaptureInfo.Timestamp
+		case <-c.stop:
+			break LOOP
+		case <-ticker.C:
+			assembler.FlushOlderThan(lastPacketTimestamp.Add(-streamTimeout))
+			c.factory.FlushDNSOlderThan(lastPacketTimestamp.Add(-dnsTimeout))
+			if handler != nil {
+				handler.FlushOlderThan(lastPacketTimestamp.Add(-streamTimeout))
+			}
+		}
+	}
+
+	assembler.FlushAll()
+	c.factory.FlushAllDNS()
+	c.logf("Read packets complete, packet count: %d", atomic.LoadUint64(&c.packets))
+	if !c.waitStreams() {
+		// the streams still running may send more events, they are
+		// discarded until the streams end
+		close(c.abandon)
+		go func() {
+			c.factory.Wait()
+			close(c.events)
+		}()
+		return
+	}
+	c.logf("Parse complete")
+	close(c.events)
+}
+
+func (c *Capturer) logf(format string, v ...interface{}) {
+	if c.options.Logger != nil {
+		c.options.Logger.Printf(format, v...)
+	}
+}
+
+// waitStreams waits for the TCP streams to be parsed. Once the capture is
+// stopped, it waits until the shutdown timeout and returns false if the
+// streams are not finished.
+func (c *Capturer) waitStreams() bool {
+	done := make(chan struct{})
+	go func() {
+		c.factory.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-c.stop:
+	}
+	select {
+	case <-done:
+		return true
+	case <-time.After(c.options.ShutdownTimeout):
+		c.logf("%d TCP streams are not parsed in %v, their events are lost",
+			c.factory.RunningStreamCount(), c.options.ShutdownTimeout)
+		return false
+	}
+}
+
+// forward sends the events of the factory to the user. When the streams are
+// abandoned, the events already queued are sent and the next ones are
+// discarded.
+func (c *Capturer) forward() {
+	defer close(c.out)
+	for {
+		select {
+		case e, ok := <-c.events:
+			if !ok {
+				return
+			}
+			c.out <- e
+		case <-c.abandon:
+			for len(c.events) > 0 {
+				if e, ok := <-c.events; ok {
+					c.out <- e
+				}
+			}
+			go func() {
+				for range c.events {
+				}
+			}()
+			return
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package ngcapture
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ga0/netgraph/ngnet"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// chanSource is a PacketSource without packets, closed by the test
+type chanSource chan gopacket.Packet
+
+func (s chanSource) Packets() chan gopacket.Packet {
+	return s
+}
+
+// countingHandler counts the TCP packets
+type countingHandler struct {
+	packets int
+}
+
+func (h *countingHandler) HandlePacket(packet gopacket.Packet, netFlow gopacket.Flow, tcp *layers.TCP) {
+	h.packets++
+}
+
+func (h *countingHandler) FlushOlderThan(t time.Time) {}
+
+func TestCapture(t *testing.T) {
+	source, err := OpenFile("../ngnet/dump.pcapng")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	handler := new(countingHandler)
+	c, err := New(Options{Source: source, PacketHandler: handler, FirstStreamSeq: 10, Transactions: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(context.Background()); err == nil {
+		t.Error("second start should fail")
+	}
+	var requests, responses, transactions int
+	requestIDs := make(map[string]bool)
+	for e := range c.Events() {
+		switch e := e.(type) {
+		case ngnet.HTTPRequestEvent:
+			requests++
+			requestIDs[e.ID] = true
+			if e.StreamSeq < 10 {
+				t.Errorf("bad stream seq %d", e.StreamSeq)
+			}
+		case ngnet.HTTPResponseEvent:
+			responses++
+		case ngnet.TransactionEvent:
+			transactions++
+			// sent after the request and its response
+			if !requestIDs[e.Request.ID] || e.Response == nil || e.Response.RequestID != e.Request.ID {
+				t.Errorf("transaction %s is not linked to its request", e.ID)
+			}
+		}
+	}
+	if requests != 84 || responses != 84 || transactions != 84 {
+		t.Errorf("%d requests, %d responses, %d transactions", requests, responses, transactions)
+	}
+	stats := c.Stats()
+	if stats.Packets != 1633 || stats.RunningStreams != 0 || stats.Streams.Bytes == 0 || stats.Drops != nil {
+		t.Errorf("bad stats %+v", stats)
+	}
+	if handler.packets == 0 || uint64(handler.packets) > stats.Packets {
+		t.Errorf("%d packets handled", handler.packets)
+	}
+
+	if _, err := New(Options{}); err == nil {
+		t.Error("a source is required")
+	}
+}
+
+func TestStop(t *testing.T) {
+	// by Stop and by the context, the events channel is closed even if the
+	// source is not
+	for _, cancel := range []bool{false, true} {
+		c, _ := New(Options{Source: make(chanSource)})
+		ctx, cancelFunc := context.WithCancel(context.Background())
+		c.Start(ctx)
+		if cancel {
+			cancelFunc()
+		} else {
+			c.Stop()
+			c.Stop()
+		}
+		select {
+		case _, ok := <-c.Events():
+			if ok {
+				t.Error("unexpected event")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("capture not stopped")
+		}
+		cancelFunc()
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	// the events are not read, so the streams can't finish
+	source, err := OpenFile("../ngnet/dump.pcapng")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	c, _ := New(Options{Source: source, EventBuffer: 1, ShutdownTimeout: 20 * time.Millisecond})
+	c.Start(context.Background())
+	for c.Stats().Packets != 1633 {
+		time.Sleep(time.Millisecond)
+	}
+	c.Stop()
+	time.Sleep(50 * time.Millisecond)
+	n := 0
+	done := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-c.Events():
+			if !ok {
+				if n == 0 || n >= 168 {
+					t.Errorf("%d events before the timeout", n)
+				}
+				return
+			}
+			n++
+		case <-done:
+			t.Fatal("events channel not closed")
+		}
+	}
+}
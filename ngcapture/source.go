@@ -0,0 +1,94 @@
+package ngcapture
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// snapLen is the max bytes captured per packet
+const snapLen = 1024 * 1024
+
+// Drops counts the packets lost by a live capture
+type Drops struct {
+	Pcap      uint64 // dropped by pcap because its buffer was full
+	Interface uint64 // dropped by the network interface
+}
+
+// DropCounter is implemented by the packet sources which lose the packets
+// not read fast enough
+type DropCounter interface {
+	Drops() (Drops, error)
+}
+
+// PcapSource reads the packets of a pcap file or of a live capture
+type PcapSource struct {
+	*gopacket.PacketSource
+	handle *pcap.Handle
+	live   bool
+}
+
+// OpenFile opens a pcap file
+func OpenFile(name string) (*PcapSource, error) {
+	handle, err := pcap.OpenOffline(name)
+	if err != nil {
+		return nil, err
+	}
+	return &PcapSource{gopacket.NewPacketSource(handle, handle.LinkType()), handle, false}, nil
+}
+
+// OpenLive captures the packets of a device, which match the berkeley packet
+// filter bpf if it is set
+func OpenLive(device, bpf string) (*PcapSource, error) {
+	handle, err := pcap.OpenLive(device, snapLen, true, pcap.BlockForever)
+	if err != nil {
+		return nil, err
+	}
+	if bpf != "" {
+		if err = handle.SetBPFFilter(bpf); err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("failed to set BPF filter: %v", err)
+		}
+	}
+	return &PcapSource{gopacket.NewPacketSource(handle, handle.LinkType()), handle, true}, nil
+}
+
+// DefaultDevice returns the first device with an address which is not
+// loopback, multicast or link local, "" if there is none
+func DefaultDevice() (string, error) {
+	ifs, err := pcap.FindAllDevs()
+	if err != nil {
+		return "", err
+	}
+	for _, i := range ifs {
+		for _, addr := range i.Addresses {
+			if addr.IP.IsLoopback() ||
+				addr.IP.IsMulticast() ||
+				addr.IP.IsUnspecified() ||
+				addr.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			return i.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// Drops implements DropCounter, it fails for a pcap file
+func (s *PcapSource) Drops() (Drops, error) {
+	if !s.live {
+		return Drops{}, errors.New("no drops in a pcap file")
+	}
+	stats, err := s.handle.Stats()
+	if err != nil {
+		return Drops{}, err
+	}
+	return Drops{uint64(stats.PacketsDropped), uint64(stats.PacketsIfDropped)}, nil
+}
+
+// Close closes the pcap handle
+func (s *PcapSource) Close() {
+	s.handle.Close()
+}
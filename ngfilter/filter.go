@@ -0,0 +1,501 @@
+// Package ngfilter implements the filter expressions used to select HTTP
+// transactions, e.g.
+//
+//	host ~ "api." && status >= 500 && duration > 200ms && req.header["X-Tenant"] == "acme"
+//
+// Comparisons are ==, !=, <, <=, >, >=, ~ (regexp match) and !~, combined
+// with && (and), || (or), ! (not) and parentheses. A field without a
+// comparison is true when it is not empty or zero.
+package ngfilter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ga0/netgraph/ngnet"
+)
+
+// Transaction is what an expression is evaluated against. Response is nil
+// while the response is not seen yet.
+type Transaction struct {
+	Request  *ngnet.HTTPRequestEvent
+	Response *ngnet.HTTPResponseEvent
+}
+
+// Filter is a compiled filter expression
+type Filter struct {
+	text          string
+	match         func(*Transaction) bool
+	needsResponse bool
+}
+
+// Parse compiles a filter expression
+func Parse(text string) (*Filter, error) {
+	tokens, err := lex(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	match, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %v at %d", t, t.pos)
+	}
+	f := new(Filter)
+	f.text = text
+	f.match = match
+	f.needsResponse = p.needsResponse
+	return f, nil
+}
+
+// String returns the source of the expression
+func (f *Filter) String() string {
+	return f.text
+}
+
+// NeedsResponse reports whether the expression uses response fields, so
+// a request alone can't be decided.
+func (f *Filter) NeedsResponse() bool {
+	return f.needsResponse
+}
+
+// Match evaluates the expression against the transaction
+func (f *Filter) Match(t Transaction) bool {
+	if t.Request == nil {
+		return false
+	}
+	return f.match(&t)
+}
+
+type valueKind int
+
+const (
+	kindString valueKind = iota
+	kindNumber
+	kindDuration
+)
+
+func (k valueKind) String() string {
+	switch k {
+	case kindNumber:
+		return "number"
+	case kindDuration:
+		return "duration"
+	}
+	return "string"
+}
+
+// operand is a field or a literal. Durations are held as nanoseconds in
+// num. ok is false when the value is not available, e.g. a response field
+// of an unanswered request.
+type operand struct {
+	kind    valueKind
+	text    string
+	literal bool
+	str     func(*Transaction) (string, bool)
+	num     func(*Transaction) (float64, bool)
+}
+
+type parser struct {
+	tokens        []token
+	pos           int
+	needsResponse bool
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(kind tokenKind, what string) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, fmt.Errorf("expected %s at %d, got %v", what, t.pos, t)
+	}
+	return t, nil
+}
+
+func (p *parser) parseOr() (func(*Transaction) bool, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokenOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(t *Transaction) bool { return l(t) || right(t) }
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (func(*Transaction) bool, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokenAnd {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(t *Transaction) bool { return l(t) && right(t) }
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (func(*Transaction) bool, error) {
+	switch p.peek().kind {
+	case tokenNot:
+		p.next()
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(t *Transaction) bool { return !e(t) }, nil
+	case tokenLParen:
+		p.next()
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRParen, `")"`); err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (func(*Transaction) bool, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenOp {
+		if left.literal {
+			return nil, fmt.Errorf("literal %s is not a condition", left.text)
+		}
+		return truth(left), nil
+	}
+	op := p.next()
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return compare(left, op, right)
+}
+
+func (p *parser) parseOperand() (*operand, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		s := t.str
+		return &operand{kind: kindString, text: t.text, literal: true,
+			str: func(*Transaction) (string, bool) { return s, true }}, nil
+	case tokenNumber:
+		n := t.number
+		return &operand{kind: kindNumber, text: t.text, literal: true,
+			num: func(*Transaction) (float64, bool) { return n, true }}, nil
+	case tokenDuration:
+		n := float64(t.duration)
+		return &operand{kind: kindDuration, text: t.text, literal: true,
+			num: func(*Transaction) (float64, bool) { return n, true }}, nil
+	case tokenIdent:
+		name := strings.ToLower(t.text)
+		for p.peek().kind == tokenDot {
+			p.next()
+			part, err := p.expect(tokenIdent, "field name")
+			if err != nil {
+				return nil, err
+			}
+			name += "." + strings.ToLower(part.text)
+		}
+		key := ""
+		if p.peek().kind == tokenLBrack {
+			p.next()
+			k, err := p.expect(tokenString, "quoted header name")
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(tokenRBrack, `"]"`); err != nil {
+				return nil, err
+			}
+			key = k.str
+			name += "[]"
+		}
+		o, response, err := newField(name, key)
+		if err != nil {
+			return nil, fmt.Errorf("%v at %d", err, t.pos)
+		}
+		if response {
+			p.needsResponse = true
+		}
+		o.text = t.text
+		return o, nil
+	}
+	return nil, fmt.Errorf("expected field or value at %d, got %v", t.pos, t)
+}
+
+func truth(o *operand) func(*Transaction) bool {
+	if o.kind == kindString {
+		return func(t *Transaction) bool {
+			s, ok := o.str(t)
+			return ok && s != ""
+		}
+	}
+	return func(t *Transaction) bool {
+		n, ok := o.num(t)
+		return ok && n != 0
+	}
+}
+
+func compare(left *operand, op token, right *operand) (func(*Transaction) bool, error) {
+	if op.text == "~" || op.text == "!~" {
+		if left.kind != kindString || !right.literal || right.kind != kindString {
+			return nil, fmt.Errorf("%s at %d needs a string field and a quoted pattern", op.text, op.pos)
+		}
+		pattern, _ := right.str(nil)
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern %s: %v", right.text, err)
+		}
+		negate := op.text == "!~"
+		return func(t *Transaction) bool {
+			s, ok := left.str(t)
+			return ok && re.MatchString(s) != negate
+		}, nil
+	}
+
+	if left.kind != right.kind {
+		return nil, fmt.Errorf("can't compare %s %s with %s %s at %d",
+			left.kind, left.text, right.kind, right.text, op.pos)
+	}
+	if left.kind == kindString {
+		var cmp func(a, b string) bool
+		switch op.text {
+		case "==":
+			cmp = func(a, b string) bool { return a == b }
+		case "!=":
+			cmp = func(a, b string) bool { return a != b }
+		case "<":
+			cmp = func(a, b string) bool { return a < b }
+		case "<=":
+			cmp = func(a, b string) bool { return a <= b }
+		case ">":
+			cmp = func(a, b string) bool { return a > b }
+		case ">=":
+			cmp = func(a, b string) bool { return a >= b }
+		}
+		return func(t *Transaction) bool {
+			a, ok1 := left.str(t)
+			b, ok2 := right.str(t)
+			return ok1 && ok2 && cmp(a, b)
+		}, nil
+	}
+	var cmp func(a, b float64) bool
+	switch op.text {
+	case "==":
+		cmp = func(a, b float64) bool { return a == b }
+	case "!=":
+		cmp = func(a, b float64) bool { return a != b }
+	case "<":
+		cmp = func(a, b float64) bool { return a < b }
+	case "<=":
+		cmp = func(a, b float64) bool { return a <= b }
+	case ">":
+		cmp = func(a, b float64) bool { return a > b }
+	case ">=":
+		cmp = func(a, b float64) bool { return a >= b }
+	}
+	return func(t *Transaction) bool {
+		a, ok1 := left.num(t)
+		b, ok2 := right.num(t)
+		return ok1 && ok2 && cmp(a, b)
+	}, nil
+}
+
+func headerValue(headers []ngnet.HTTPHeaderItem, name string) string {
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+func stripPort(addr string) string {
+	if p := strings.LastIndex(addr, ":"); p != -1 && !strings.HasSuffix(addr, "]") {
+		return addr[:p]
+	}
+	return addr
+}
+
+func reqString(get func(*ngnet.HTTPRequestEvent) string) func(*Transaction) (string, bool) {
+	return func(t *Transaction) (string, bool) { return get(t.Request), true }
+}
+
+func respString(get func(*ngnet.HTTPResponseEvent) string) func(*Transaction) (string, bool) {
+	return func(t *Transaction) (string, bool) {
+		if t.Response == nil {
+			return "", false
+		}
+		return get(t.Response), true
+	}
+}
+
+func respNumber(get func(*Transaction) float64) func(*Transaction) (float64, bool) {
+	return func(t *Transaction) (float64, bool) {
+		if t.Response == nil {
+			return 0, false
+		}
+		return get(t), true
+	}
+}
+
+// processField returns the operand of a field of the client or server
+// process, like client.exe, nil if there is no such field. The field is
+// missing if the process is not known.
+func processField(client bool, field string) *operand {
+	process := func(t *Transaction) *ngnet.Process {
+		if client {
+			return t.Request.ClientProcess
+		}
+		return t.Request.ServerProcess
+	}
+	str := func(get func(p *ngnet.Process) string) *operand {
+		return &operand{kind: kindString, str: func(t *Transaction) (string, bool) {
+			if p := process(t); p != nil {
+				return get(p), true
+			}
+			return "", false
+		}}
+	}
+	switch field {
+	case "pid":
+		return &operand{kind: kindNumber, num: func(t *Transaction) (float64, bool) {
+			if p := process(t); p != nil {
+				return float64(p.PID), true
+			}
+			return 0, false
+		}}
+	case "exe":
+		return str(func(p *ngnet.Process) string { return p.Exe })
+	case "cmdline":
+		return str(func(p *ngnet.Process) string { return p.Cmdline })
+	case "user":
+		return str(func(p *ngnet.Process) string { return p.User })
+	case "cgroup":
+		return str(func(p *ngnet.Process) string { return p.Cgroup })
+	case "container":
+		return str(func(p *ngnet.Process) string { return p.ContainerID })
+	}
+	return nil
+}
+
+// newField returns the operand of a field, and whether it needs the response
+func newField(name, key string) (*operand, bool, error) {
+	str := func(get func(*Transaction) (string, bool)) *operand {
+		return &operand{kind: kindString, str: get}
+	}
+	switch name {
+	case "host":
+		return str(reqString(func(r *ngnet.HTTPRequestEvent) string {
+			if host := headerValue(r.Headers, "Host"); host != "" {
+				return stripPort(host)
+			}
+			return stripPort(r.ServerAddr)
+		})), false, nil
+	case "method":
+		return str(reqString(func(r *ngnet.HTTPRequestEvent) string { return r.Method })), false, nil
+	case "uri":
+		return str(reqString(func(r *ngnet.HTTPRequestEvent) string { return r.URI })), false, nil
+	case "path":
+		return str(reqString(func(r *ngnet.HTTPRequestEvent) string {
+			if p := strings.IndexByte(r.URI, '?'); p != -1 {
+				return r.URI[:p]
+			}
+			return r.URI
+		})), false, nil
+	case "route":
+		return str(reqString(func(r *ngnet.HTTPRequestEvent) string { return r.Route })), false, nil
+	case "query":
+		return str(reqString(func(r *ngnet.HTTPRequestEvent) string {
+			if p := strings.IndexByte(r.URI, '?'); p != -1 {
+				return r.URI[p+1:]
+			}
+			return ""
+		})), false, nil
+	case "version", "req.version":
+		return str(reqString(func(r *ngnet.HTTPRequestEvent) string { return r.Version })), false, nil
+	case "client":
+		return str(reqString(func(r *ngnet.HTTPRequestEvent) string { return r.ClientAddr })), false, nil
+	case "server":
+		return str(reqString(func(r *ngnet.HTTPRequestEvent) string { return r.ServerAddr })), false, nil
+	case "client.name":
+		return str(reqString(func(r *ngnet.HTTPRequestEvent) string { return r.ClientName })), false, nil
+	case "server.name":
+		return str(reqString(func(r *ngnet.HTTPRequestEvent) string { return r.ServerName })), false, nil
+	case "header[]", "req.header[]":
+		return str(reqString(func(r *ngnet.HTTPRequestEvent) string { return headerValue(r.Headers, key) })), false, nil
+	case "req.body":
+		return str(reqString(func(r *ngnet.HTTPRequestEvent) string { return string(r.Body) })), false, nil
+	case "req.size":
+		return &operand{kind: kindNumber, num: func(t *Transaction) (float64, bool) {
+			return float64(len(t.Request.Body)), true
+		}}, false, nil
+	case "stream":
+		return &operand{kind: kindNumber, num: func(t *Transaction) (float64, bool) {
+			return float64(t.Request.StreamSeq), true
+		}}, false, nil
+	case "status":
+		return &operand{kind: kindNumber, num: respNumber(func(t *Transaction) float64 {
+			return float64(t.Response.Code)
+		})}, true, nil
+	case "reason":
+		return str(respString(func(r *ngnet.HTTPResponseEvent) string { return r.Reason })), true, nil
+	case "resp.version":
+		return str(respString(func(r *ngnet.HTTPResponseEvent) string { return r.Version })), true, nil
+	case "resp.header[]":
+		return str(respString(func(r *ngnet.HTTPResponseEvent) string { return headerValue(r.Headers, key) })), true, nil
+	case "resp.body":
+		return str(respString(func(r *ngnet.HTTPResponseEvent) string { return string(r.Body) })), true, nil
+	case "resp.size":
+		return &operand{kind: kindNumber, num: respNumber(func(t *Transaction) float64 {
+			return float64(len(t.Response.Body))
+		})}, true, nil
+	case "duration":
+		return &operand{kind: kindDuration, num: respNumber(func(t *Transaction) float64 {
+			end := t.Response.End
+			if end.IsZero() {
+				end = t.Response.Start
+			}
+			return float64(end.Sub(t.Request.Start) / time.Nanosecond)
+		})}, true, nil
+	}
+	if side, field, ok := strings.Cut(name, "."); ok && (side == "client" || side == "server") {
+		if op := processField(side == "client", field); op != nil {
+			return op, false, nil
+		}
+	}
+	if strings.HasSuffix(name, "[]") {
+		return nil, false, fmt.Errorf("unknown field %s[...]", strings.TrimSuffix(name, "[]"))
+	}
+	return nil, false, fmt.Errorf("unknown field %s", name)
+}
@@ -0,0 +1,142 @@
+package ngfilter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ga0/netgraph/ngnet"
+)
+
+func transaction(code uint, d time.Duration) Transaction {
+	var req ngnet.HTTPRequestEvent
+	req.Start = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	req.Method = "POST"
+	req.URI = "/v1/users?id=3"
+	req.Route = "/v1/users"
+	req.ServerAddr = "10.0.0.1:80"
+	req.ServerName = "api.example.com"
+	req.Headers = []ngnet.HTTPHeaderItem{
+		{Name: "Host", Value: "api.example.com:8080"},
+		{Name: "X-Tenant", Value: "acme"},
+	}
+	req.Body = []byte(`{"name":"x"}`)
+	t := Transaction{Request: &req}
+	if code != 0 {
+		var resp ngnet.HTTPResponseEvent
+		resp.Code = code
+		resp.End = req.Start.Add(d)
+		resp.Headers = []ngnet.HTTPHeaderItem{{Name: "Content-Type", Value: "application/json"}}
+		t.Response = &resp
+	}
+	return t
+}
+
+func TestMatch(t *testing.T) {
+	slowError := transaction(503, 300*time.Millisecond)
+	fastOK := transaction(200, 10*time.Millisecond)
+	unanswered := transaction(0, 0)
+
+	cases := []struct {
+		expr    string
+		matches []bool // slowError, fastOK, unanswered
+	}{
+		{`host ~ "api." && status >= 500 && duration > 200ms && req.header["X-Tenant"] == "acme"`, []bool{true, false, false}},
+		{`host == "api.example.com"`, []bool{true, true, true}},
+		{`method == "GET" || path == "/v1/users"`, []bool{true, true, true}},
+		{`query == "id=3" and not (status < 300)`, []bool{true, false, true}},
+		{`!(status == 200)`, []bool{true, false, true}},
+		{`status != 200`, []bool{true, false, false}},
+		{`resp.header["content-type"] ~ "json$"`, []bool{true, true, false}},
+		{`req.header["X-Debug"]`, []bool{false, false, false}},
+		{`req.header["x-tenant"] && req.body ~ "name"`, []bool{true, true, true}},
+		{`uri !~ "^/v2/"`, []bool{true, true, true}},
+		{`duration <= 10ms || resp.size > 0`, []bool{false, true, false}},
+		{`stream == 0`, []bool{true, true, true}},
+		{`route == "/v1/users" && status >= 500`, []bool{true, false, false}},
+		{`server.name == "api.example.com" && !client.name`, []bool{true, true, true}},
+	}
+	for _, c := range cases {
+		f, err := Parse(c.expr)
+		if err != nil {
+			t.Errorf("Parse(%s): %v", c.expr, err)
+			continue
+		}
+		for i, tr := range []Transaction{slowError, fastOK, unanswered} {
+			if got := f.Match(tr); got != c.matches[i] {
+				t.Errorf("%s on transaction %d: got %v", c.expr, i, got)
+			}
+		}
+	}
+}
+
+func TestProcessFields(t *testing.T) {
+	local := transaction(200, time.Millisecond)
+	local.Request.ClientProcess = &ngnet.Process{PID: 42, Exe: "/usr/bin/python3", Cmdline: "python3 worker.py",
+		User: "www-data", ContainerID: "4f1c3a6b"}
+	remote := transaction(200, time.Millisecond)
+	cases := []struct {
+		expr    string
+		matches []bool // local, remote
+	}{
+		{`client.exe ~ "python" && client.user == "www-data"`, []bool{true, false}},
+		{`client.pid == 42 && client.cmdline ~ "worker"`, []bool{true, false}},
+		{`client.container`, []bool{true, false}},
+		{`client.exe != "/usr/bin/curl"`, []bool{true, false}},
+		{`server.pid`, []bool{false, false}},
+	}
+	for _, c := range cases {
+		f, err := Parse(c.expr)
+		if err != nil {
+			t.Errorf("Parse(%s): %v", c.expr, err)
+			continue
+		}
+		for i, tr := range []Transaction{local, remote} {
+			if got := f.Match(tr); got != c.matches[i] {
+				t.Errorf("%s on transaction %d: got %v", c.expr, i, got)
+			}
+		}
+	}
+	if _, err := Parse(`client.port == 80`); err == nil {
+		t.Error("unknown process field should be rejected")
+	}
+}
+
+func TestNeedsResponse(t *testing.T) {
+	for expr, needs := range map[string]bool{
+		`host ~ "api"`:                       false,
+		`method == "GET" && status == 200`:   true,
+		`resp.body ~ "error"`:                true,
+		`req.header["X"] == "y" || uri ~ ""`: false,
+	} {
+		f, err := Parse(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.NeedsResponse() != needs {
+			t.Errorf("%s: NeedsResponse() = %v", expr, f.NeedsResponse())
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`status >`,
+		`status >= "500"`,
+		`duration > 200`,
+		`foo == 1`,
+		`req.cookie["a"] == "b"`,
+		`host ~ "("`,
+		`host ~ method`,
+		`(host == "a"`,
+		`"a"`,
+		`host == "a" status == 1`,
+		`host == "unterminated`,
+		`duration > 2parsecs`,
+		`host # "a"`,
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%s) should fail", expr)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package ngfilter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenDuration
+	tokenOp     // == != ~ !~ < <= > >=
+	tokenAnd    // && and
+	tokenOr     // || or
+	tokenNot    // ! not
+	tokenLParen // (
+	tokenRParen // )
+	tokenLBrack // [
+	tokenRBrack // ]
+	tokenDot    // .
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+
+	str      string
+	number   float64
+	duration time.Duration
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// lex splits an expression into tokens
+func lex(s string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string at %d", start)
+			}
+			str, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("bad string at %d: %v", start, err)
+			}
+			i = j + 1
+			tokens = append(tokens, token{kind: tokenString, text: s[start:i], pos: start, str: str})
+			continue
+		case c >= '0' && c <= '9':
+			for i < len(s) && (s[i] == '.' || unicode.IsDigit(rune(s[i]))) {
+				i++
+			}
+			unit := i
+			for i < len(s) && unicode.IsLetter(rune(s[i])) {
+				i++
+			}
+			t := token{text: s[start:i], pos: start}
+			if unit == i {
+				n, err := strconv.ParseFloat(s[start:i], 64)
+				if err != nil {
+					return nil, fmt.Errorf("bad number %q at %d", t.text, start)
+				}
+				t.kind = tokenNumber
+				t.number = n
+			} else {
+				d, err := time.ParseDuration(t.text)
+				if err != nil {
+					return nil, fmt.Errorf("bad duration %q at %d", t.text, start)
+				}
+				t.kind = tokenDuration
+				t.duration = d
+			}
+			tokens = append(tokens, t)
+			continue
+		case c == '_' || unicode.IsLetter(rune(c)):
+			for i < len(s) && (s[i] == '_' || s[i] == '-' || unicode.IsLetter(rune(s[i])) || unicode.IsDigit(rune(s[i]))) {
+				i++
+			}
+			text := s[start:i]
+			kind := tokenIdent
+			switch strings.ToLower(text) {
+			case "and":
+				kind = tokenAnd
+			case "or":
+				kind = tokenOr
+			case "not":
+				kind = tokenNot
+			}
+			tokens = append(tokens, token{kind: kind, text: text, pos: start})
+			continue
+		}
+
+		two := ""
+		if i+1 < len(s) {
+			two = s[i : i+2]
+		}
+		switch two {
+		case "&&":
+			tokens = append(tokens, token{kind: tokenAnd, text: two, pos: start})
+			i += 2
+			continue
+		case "||":
+			tokens = append(tokens, token{kind: tokenOr, text: two, pos: start})
+			i += 2
+			continue
+		case "==", "!=", "!~", "<=", ">=":
+			tokens = append(tokens, token{kind: tokenOp, text: two, pos: start})
+			i += 2
+			continue
+		}
+		kind := tokenEOF
+		switch c {
+		case '~', '<', '>':
+			kind = tokenOp
+		case '!':
+			kind = tokenNot
+		case '(':
+			kind = tokenLParen
+		case ')':
+			kind = tokenRParen
+		case '[':
+			kind = tokenLBrack
+		case ']':
+			kind = tokenRBrack
+		case '.':
+			kind = tokenDot
+		case '=':
+			// a single "=" is accepted as "=="
+			kind = tokenOp
+			tokens = append(tokens, token{kind: kind, text: "==", pos: start})
+			i++
+			continue
+		default:
+			return nil, fmt.Errorf("unexpected character %q at %d", c, start)
+		}
+		tokens = append(tokens, token{kind: kind, text: string(c), pos: start})
+		i++
+	}
+	tokens = append(tokens, token{kind: tokenEOF, pos: len(s)})
+	return tokens, nil
+}
@@ -0,0 +1,360 @@
+// Package nggraph builds the dependency graph of the captured HTTP
+// transactions: the clients and services are the nodes, an edge goes from a
+// client to a service it sent requests to.
+//
+// The transactions are counted per client IP, server IP and Host header.
+// The nodes are made when the graph is read, by grouping the addresses:
+//
+//	ip     clients and services by IP
+//	host   services by Host header, clients by IP, or by the Host header of
+//	       the requests they served if they are services too
+//	name   clients and services by the DNS name of their IP, from the
+//	       captured DNS answers or else by a reverse lookup
+package nggraph
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ga0/netgraph/ngstats"
+)
+
+// Groups of the nodes
+const (
+	GroupIP   = "ip"
+	GroupHost = "host"
+	GroupName = "name"
+)
+
+// Kinds of the nodes
+const (
+	KindClient  = "client"
+	KindService = "service"
+	KindBoth    = "both" // a service which sends requests too
+)
+
+// DefaultMaxEdges is the default of Graph.MaxEdges
+const DefaultMaxEdges = 10000
+
+// Transaction is what the graph counts of an HTTP transaction
+type Transaction struct {
+	ClientAddr string // ip:port
+	ServerAddr string // ip:port
+	Host       string // Host header, may be empty
+	ClientName string // DNS names of the IPs captured, may be empty
+	ServerName string
+	Start      time.Time
+	Status     uint
+	Duration   time.Duration
+}
+
+type edgeKey struct {
+	clientIP, serverIP, host string
+}
+
+type edgeStats struct {
+	requests     uint64
+	clientErrors uint64
+	serverErrors uint64
+	latency      *ngstats.Sketch // seconds
+	firstSeen    time.Time
+	lastSeen     time.Time
+}
+
+func (s *edgeStats) merge(o *edgeStats) {
+	s.requests += o.requests
+	s.clientErrors += o.clientErrors
+	s.serverErrors += o.serverErrors
+	s.latency.Merge(o.latency)
+	if s.firstSeen.IsZero() || o.firstSeen.Before(s.firstSeen) {
+		s.firstSeen = o.firstSeen
+	}
+	if o.lastSeen.After(s.lastSeen) {
+		s.lastSeen = o.lastSeen
+	}
+}
+
+// Graph counts the transactions between the clients and the services. It
+// is safe for concurrent use.
+type Graph struct {
+	MaxEdges int // transactions of new edges are dropped after MaxEdges
+
+	mutex    sync.Mutex
+	edges    map[edgeKey]*edgeStats
+	dropped  uint64
+	names    map[string]string // IP -> newest captured DNS name
+	resolver *resolver
+}
+
+// New creates an empty Graph
+func New() *Graph {
+	g := new(Graph)
+	g.MaxEdges = DefaultMaxEdges
+	g.edges = make(map[edgeKey]*edgeStats)
+	g.names = make(map[string]string)
+	g.resolver = newResolver()
+	return g
+}
+
+// ipOf returns the IP of an "ip:port" address
+func ipOf(addr string) string {
+	if p := strings.LastIndex(addr, ":"); p != -1 {
+		addr = addr[:p]
+	}
+	return strings.Trim(addr, "[]")
+}
+
+// Add counts a transaction
+func (g *Graph) Add(t Transaction) {
+	key := edgeKey{ipOf(t.ClientAddr), ipOf(t.ServerAddr), strings.ToLower(t.Host)}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	s := g.edges[key]
+	if s == nil {
+		if len(g.edges) >= g.MaxEdges {
+			g.dropped++
+			return
+		}
+		s = &edgeStats{latency: ngstats.NewSketch(), firstSeen: t.Start}
+		g.edges[key] = s
+	}
+	if t.ClientName != "" {
+		g.names[key.clientIP] = t.ClientName
+	}
+	if t.ServerName != "" {
+		g.names[key.serverIP] = t.ServerName
+	}
+	s.requests++
+	switch t.Status / 100 {
+	case 4:
+		s.clientErrors++
+	case 5:
+		s.serverErrors++
+	}
+	s.latency.Add(t.Duration.Seconds())
+	if t.Start.Before(s.firstSeen) {
+		s.firstSeen = t.Start
+	}
+	if t.Start.After(s.lastSeen) {
+		s.lastSeen = t.Start
+	}
+}
+
+// Node is a client or a service
+type Node struct {
+	ID          string   `json:"id"`
+	Kind        string   `json:"kind"`
+	Addresses   []string `json:"addresses"` // IPs of the node
+	RequestsIn  uint64   `json:"requests_in"`
+	RequestsOut uint64   `json:"requests_out"`
+}
+
+// Edge is the traffic from a client to a service
+type Edge struct {
+	From            string    `json:"from"`
+	To              string    `json:"to"`
+	Requests        uint64    `json:"requests"`
+	Rate            float64   `json:"rate"`              // requests per second between the first and last request
+	ClientErrorRate float64   `json:"client_error_rate"` // fraction of 4xx responses
+	ServerErrorRate float64   `json:"server_error_rate"` // fraction of 5xx responses
+	P50             float64   `json:"p50_ms"`
+	P99             float64   `json:"p99_ms"`
+	FirstSeen       time.Time `json:"first_seen"`
+	LastSeen        time.Time `json:"last_seen"`
+}
+
+// View is the graph with the nodes grouped
+type View struct {
+	Group   string `json:"group"`
+	Nodes   []Node `json:"nodes"`
+	Edges   []Edge `json:"edges"`
+	Dropped uint64 `json:"dropped"` // transactions not counted because of Graph.MaxEdges
+}
+
+// View returns the graph with the nodes grouped by GroupIP, GroupHost or
+// GroupName. The reverse DNS names of the IPs without captured DNS name are
+// looked up in the background, the IP is used until the name is known.
+func (g *Graph) View(group string) (*View, error) {
+	if group != GroupIP && group != GroupHost && group != GroupName {
+		return nil, fmt.Errorf("bad group %q, use ip, host or name", group)
+	}
+	g.mutex.Lock()
+	edges := make(map[edgeKey]*edgeStats, len(g.edges))
+	for k, s := range g.edges {
+		c := &edgeStats{latency: ngstats.NewSketch()}
+		c.merge(s)
+		edges[k] = c
+	}
+	dropped := g.dropped
+	names := make(map[string]string, len(g.names))
+	for ip, name := range g.names {
+		names[ip] = name
+	}
+	g.mutex.Unlock()
+	name := func(ip string) string {
+		if n := names[ip]; n != "" {
+			return n
+		}
+		return g.resolver.name(ip)
+	}
+
+	// name of the IPs seen as servers, the most requested Host
+	serverHosts := make(map[string]string)
+	if group == GroupHost {
+		counts := make(map[string]map[string]uint64)
+		for k, s := range edges {
+			if k.host == "" {
+				continue
+			}
+			if counts[k.serverIP] == nil {
+				counts[k.serverIP] = make(map[string]uint64)
+			}
+			counts[k.serverIP][k.host] += s.requests
+		}
+		for ip, hosts := range counts {
+			best := ""
+			for h, n := range hosts {
+				if best == "" || n > hosts[best] || (n == hosts[best] && h < best) {
+					best = h
+				}
+			}
+			serverHosts[ip] = best
+		}
+	}
+	clientNode := func(k edgeKey) string {
+		switch group {
+		case GroupHost:
+			if h := serverHosts[k.clientIP]; h != "" {
+				return h
+			}
+		case GroupName:
+			return name(k.clientIP)
+		}
+		return k.clientIP
+	}
+	serverNode := func(k edgeKey) string {
+		switch group {
+		case GroupHost:
+			if k.host != "" {
+				return k.host
+			}
+			if h := serverHosts[k.serverIP]; h != "" {
+				return h
+			}
+		case GroupName:
+			return name(k.serverIP)
+		}
+		return k.serverIP
+	}
+
+	type nodeState struct {
+		node      Node
+		addresses map[string]bool
+		client    bool
+		service   bool
+	}
+	nodes := make(map[string]*nodeState)
+	getNode := func(id string, ip string) *nodeState {
+		n := nodes[id]
+		if n == nil {
+			n = &nodeState{node: Node{ID: id}, addresses: make(map[string]bool)}
+			nodes[id] = n
+		}
+		n.addresses[ip] = true
+		return n
+	}
+	type pair struct{ from, to string }
+	merged := make(map[pair]*edgeStats)
+	for k, s := range edges {
+		from, to := clientNode(k), serverNode(k)
+		c := getNode(from, k.clientIP)
+		c.client = true
+		c.node.RequestsOut += s.requests
+		sv := getNode(to, k.serverIP)
+		sv.service = true
+		sv.node.RequestsIn += s.requests
+		p := pair{from, to}
+		if merged[p] == nil {
+			merged[p] = &edgeStats{latency: ngstats.NewSketch()}
+		}
+		merged[p].merge(s)
+	}
+
+	v := &View{Group: group, Nodes: []Node{}, Edges: []Edge{}, Dropped: dropped}
+	for _, n := range nodes {
+		switch {
+		case n.client && n.service:
+			n.node.Kind = KindBoth
+		case n.service:
+			n.node.Kind = KindService
+		default:
+			n.node.Kind = KindClient
+		}
+		for ip := range n.addresses {
+			n.node.Addresses = append(n.node.Addresses, ip)
+		}
+		sort.Strings(n.node.Addresses)
+		v.Nodes = append(v.Nodes, n.node)
+	}
+	sort.Slice(v.Nodes, func(i, j int) bool { return v.Nodes[i].ID < v.Nodes[j].ID })
+	for p, s := range merged {
+		e := Edge{From: p.from, To: p.to, Requests: s.requests, FirstSeen: s.firstSeen, LastSeen: s.lastSeen}
+		seconds := s.lastSeen.Sub(s.firstSeen).Seconds()
+		if seconds < 1 {
+			seconds = 1
+		}
+		e.Rate = float64(s.requests) / seconds
+		e.ClientErrorRate = float64(s.clientErrors) / float64(s.requests)
+		e.ServerErrorRate = float64(s.serverErrors) / float64(s.requests)
+		e.P50 = s.latency.Quantile(0.5) * 1000
+		e.P99 = s.latency.Quantile(0.99) * 1000
+		v.Edges = append(v.Edges, e)
+	}
+	sort.Slice(v.Edges, func(i, j int) bool {
+		a, b := v.Edges[i], v.Edges[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		return a.To < b.To
+	})
+	return v, nil
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func dotID(s string) string {
+	return `"` + dotEscaper.Replace(s) + `"`
+}
+
+// DOT returns the graph in the Graphviz DOT language
+func (v *View) DOT() string {
+	var b strings.Builder
+	b.WriteString("digraph netgraph {\n\trankdir=LR;\n\tnode [fontname=\"Helvetica\"];\n")
+	for _, n := range v.Nodes {
+		shape := "ellipse"
+		if n.Kind != KindClient {
+			shape = "box"
+		}
+		label := n.ID
+		if len(n.Addresses) == 1 && n.Addresses[0] != n.ID {
+			label += "\n" + n.Addresses[0]
+		}
+		fmt.Fprintf(&b, "\t%s [shape=%s, label=%s];\n", dotID(n.ID), shape, dotID(label))
+	}
+	for _, e := range v.Edges {
+		color := "black"
+		if e.ServerErrorRate > 0 {
+			color = "red"
+		} else if e.ClientErrorRate > 0 {
+			color = "orange"
+		}
+		label := fmt.Sprintf("%d req, %.2f/s\n%.1f%% 5xx, p50 %.1fms, p99 %.1fms",
+			e.Requests, e.Rate, e.ServerErrorRate*100, e.P50, e.P99)
+		fmt.Fprintf(&b, "\t%s -> %s [label=%s, color=%s];\n", dotID(e.From), dotID(e.To), dotID(label), color)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
@@ -0,0 +1,139 @@
+package nggraph
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func testGraph() *Graph {
+	g := New()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	add := func(client, server, host string, at time.Duration, status uint) {
+		g.Add(Transaction{ClientAddr: client, ServerAddr: server, Host: host,
+			Start: start.Add(at), Status: status, Duration: 10 * time.Millisecond})
+	}
+	// a browser calls the frontend, which calls the api
+	add("10.0.0.1:5000", "10.0.0.2:80", "Front.example.com", 0, 200)
+	add("10.0.0.1:5001", "10.0.0.2:80", "front.example.com", 10*time.Second, 404)
+	add("10.0.0.2:6000", "10.0.0.3:8080", "api:8080", 0, 200)
+	add("10.0.0.2:6001", "10.0.0.3:8080", "", time.Second, 500)
+	return g
+}
+
+func findEdge(v *View, from, to string) *Edge {
+	for i := range v.Edges {
+		if v.Edges[i].From == from && v.Edges[i].To == to {
+			return &v.Edges[i]
+		}
+	}
+	return nil
+}
+
+func findNode(v *View, id string) *Node {
+	for i := range v.Nodes {
+		if v.Nodes[i].ID == id {
+			return &v.Nodes[i]
+		}
+	}
+	return nil
+}
+
+func TestGroupIP(t *testing.T) {
+	v, err := testGraph().View(GroupIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Nodes) != 3 || len(v.Edges) != 2 {
+		t.Fatalf("bad graph %+v", v)
+	}
+	e := findEdge(v, "10.0.0.1", "10.0.0.2")
+	if e == nil || e.Requests != 2 || e.ClientErrorRate != 0.5 || e.Rate != 0.2 {
+		t.Errorf("bad edge %+v", e)
+	}
+	e = findEdge(v, "10.0.0.2", "10.0.0.3")
+	if e == nil || e.ServerErrorRate != 0.5 || e.P50 < 9.8 || e.P50 > 10.2 {
+		t.Errorf("bad edge %+v", e)
+	}
+	kinds := map[string]string{"10.0.0.1": KindClient, "10.0.0.2": KindBoth, "10.0.0.3": KindService}
+	for id, kind := range kinds {
+		if n := findNode(v, id); n == nil || n.Kind != kind {
+			t.Errorf("bad node %s: %+v", id, n)
+		}
+	}
+}
+
+func TestGroupHost(t *testing.T) {
+	v, err := testGraph().View(GroupHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the frontend is named by the Host of its requests on both ends, the
+	// request without Host goes to the node of the api
+	if e := findEdge(v, "10.0.0.1", "front.example.com"); e == nil || e.Requests != 2 {
+		t.Errorf("bad edge %+v", v.Edges)
+	}
+	if e := findEdge(v, "front.example.com", "api:8080"); e == nil || e.Requests != 2 {
+		t.Errorf("bad edge %+v", v.Edges)
+	}
+	if n := findNode(v, "front.example.com"); n == nil || n.Kind != KindBoth || n.Addresses[0] != "10.0.0.2" {
+		t.Errorf("bad node %+v", n)
+	}
+	if _, err := testGraph().View("port"); err == nil {
+		t.Error("bad group should be rejected")
+	}
+}
+
+func TestGroupName(t *testing.T) {
+	g := testGraph()
+	done := make(chan string, 2)
+	g.resolver.lookup = func(ip string) ([]string, error) {
+		defer func() { done <- ip }()
+		if ip == "10.0.0.3" {
+			return []string{"api.internal."}, nil
+		}
+		return nil, &dnsError{}
+	}
+	g.Add(Transaction{ClientAddr: "10.0.0.1:5002", ServerAddr: "10.0.0.2:80", ServerName: "front.example.com"})
+	// the names are unknown until looked up, but the captured ones
+	v, _ := g.View(GroupName)
+	if findNode(v, "10.0.0.3") == nil || findNode(v, "front.example.com") == nil {
+		t.Errorf("bad nodes %+v", v.Nodes)
+	}
+	// 10.0.0.1 and 10.0.0.3, 10.0.0.2 has a captured name
+	for i := 0; i < 2; i++ {
+		<-done
+	}
+	v, _ = g.View(GroupName)
+	if findEdge(v, "front.example.com", "api.internal") == nil {
+		t.Errorf("bad edges %+v", v.Edges)
+	}
+}
+
+type dnsError struct{}
+
+func (*dnsError) Error() string { return "not found" }
+
+func TestMaxEdgesAndDOT(t *testing.T) {
+	g := testGraph()
+	g.MaxEdges = 3
+	g.Add(Transaction{ClientAddr: "[::1]:1", ServerAddr: "[::2]:80", Host: `a"b`})
+	g.Add(Transaction{ClientAddr: "10.0.0.1:1", ServerAddr: "10.0.0.2:80", Host: "front.example.com"})
+	v, _ := g.View(GroupIP)
+	if v.Dropped != 1 || findEdge(v, "10.0.0.1", "10.0.0.2").Requests != 3 {
+		t.Errorf("bad graph %+v", v)
+	}
+	if ipOf("[::1]:80") != "::1" {
+		t.Error("bad IPv6 address")
+	}
+	dot := v.DOT()
+	for _, s := range []string{"digraph netgraph {", `"10.0.0.1" -> "10.0.0.2" [label="3 req`,
+		`"10.0.0.3" [shape=box`, "color=red"} {
+		if !strings.Contains(dot, s) {
+			t.Errorf("%q not in DOT:\n%s", s, dot)
+		}
+	}
+	if !strings.Contains(dotID("a\"b\\"), `"a\"b\\"`) {
+		t.Error("bad DOT escaping")
+	}
+}
@@ -0,0 +1,54 @@
+package nggraph
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+// maxLookups is the number of reverse DNS lookups running at the same time
+const maxLookups = 4
+
+// resolver caches the reverse DNS names of the IPs. Each IP is looked up
+// once, in the background.
+type resolver struct {
+	mutex  sync.Mutex
+	names  map[string]string // "" while the lookup runs or if it failed
+	lookup func(ip string) ([]string, error)
+	slots  chan struct{}
+}
+
+func newResolver() *resolver {
+	r := new(resolver)
+	r.names = make(map[string]string)
+	r.lookup = net.LookupAddr
+	r.slots = make(chan struct{}, maxLookups)
+	return r
+}
+
+// name returns the name of the IP if it is known, or the IP
+func (r *resolver) name(ip string) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	name, ok := r.names[ip]
+	if !ok {
+		r.names[ip] = ""
+		go r.resolve(ip)
+	}
+	if name == "" {
+		return ip
+	}
+	return name
+}
+
+func (r *resolver) resolve(ip string) {
+	r.slots <- struct{}{}
+	names, err := r.lookup(ip)
+	<-r.slots
+	if err != nil || len(names) == 0 {
+		return
+	}
+	r.mutex.Lock()
+	r.names[ip] = strings.TrimSuffix(names[0], ".")
+	r.mutex.Unlock()
+}
@@ -0,0 +1,336 @@
+package ngnet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// DNSPort is the port of the DNS messages decoded by the HTTPStreamFactory
+const DNSPort = 53
+
+// maxPendingDNSQueries is the number of queries waiting for their response,
+// the queries after it are not matched with their response
+const maxPendingDNSQueries = 10000
+
+// maxDNSNames is the number of IPs in the name cache
+const maxDNSNames = 100000
+
+// maxQueuedDNS is the number of DNS events waiting for room in the event
+// channel, the events after it are dropped
+const maxQueuedDNS = 4096
+
+// DNSAnswer is a resource record of the answer section of a DNS response
+type DNSAnswer struct {
+	Name string
+	Type string // like "A" or "CNAME"
+	TTL  uint32
+	Data string // IP, name or text of the record, empty for the other types
+}
+
+// DNSQueryEvent is a DNS query and its response. It is sent when the
+// response is seen, or without response when the query timed out.
+type DNSQueryEvent struct {
+	Type       string
+	ID         string // "dns:<sequence number>"
+	Schema     int    // SchemaVersion
+	Protocol   string // "udp" or "tcp"
+	ClientAddr string
+	ServerAddr string
+	QueryID    uint16 // of the DNS message
+	Name       string // of the question
+	QType      string // type of the question, like "A"
+	Answered   bool   // false if the response was not seen
+	RCode      string `json:",omitempty"` // like "NOERROR" or "NXDOMAIN"
+	Answers    []DNSAnswer
+	Start      time.Time     // query, or response if the query was not seen
+	End        time.Time     // response
+	Duration   time.Duration // between the query and the response, 0 if one of them was not seen
+}
+
+var dnsRCodes = map[layers.DNSResponseCode]string{
+	layers.DNSResponseCodeNoErr:    "NOERROR",
+	layers.DNSResponseCodeFormErr:  "FORMERR",
+	layers.DNSResponseCodeServFail: "SERVFAIL",
+	layers.DNSResponseCodeNXDomain: "NXDOMAIN",
+	layers.DNSResponseCodeNotImp:   "NOTIMP",
+	layers.DNSResponseCodeRefused:  "REFUSED",
+}
+
+func dnsRCode(c layers.DNSResponseCode) string {
+	if s, ok := dnsRCodes[c]; ok {
+		return s
+	}
+	return fmt.Sprintf("RCODE%d", c)
+}
+
+func dnsAnswer(rr *layers.DNSResourceRecord) DNSAnswer {
+	a := DNSAnswer{Name: string(rr.Name), Type: rr.Type.String(), TTL: rr.TTL}
+	switch rr.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		a.Data = rr.IP.String()
+	case layers.DNSTypeCNAME:
+		a.Data = string(rr.CNAME)
+	case layers.DNSTypeNS:
+		a.Data = string(rr.NS)
+	case layers.DNSTypePTR:
+		a.Data = string(rr.PTR)
+	case layers.DNSTypeMX:
+		a.Data = string(rr.MX.Name)
+	case layers.DNSTypeTXT:
+		txts := make([]string, len(rr.TXTs))
+		for i, t := range rr.TXTs {
+			txts[i] = string(t)
+		}
+		a.Data = strings.Join(txts, " ")
+	}
+	return a
+}
+
+// nameCache maps the IPs of the DNS answers to the names queried, until
+// their TTL expires. The time is the one of the packets.
+type nameCache struct {
+	mutex sync.Mutex
+	names map[string]cachedName // by IP
+}
+
+type cachedName struct {
+	name    string
+	expires time.Time
+}
+
+func newNameCache() *nameCache {
+	c := new(nameCache)
+	c.names = make(map[string]cachedName)
+	return c
+}
+
+// add maps an IP to a name for ttl after seen. When the cache is full, the
+// expired names are removed, and the new IPs are dropped if it is still full.
+func (c *nameCache) add(ip net.IP, name string, seen time.Time, ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := ip.String()
+	if _, ok := c.names[key]; !ok && len(c.names) >= maxDNSNames {
+		for k, n := range c.names {
+			if n.expires.Before(seen) {
+				delete(c.names, k)
+			}
+		}
+		if len(c.names) >= maxDNSNames {
+			return
+		}
+	}
+	c.names[key] = cachedName{name, seen.Add(ttl)}
+}
+
+// name returns the name of the IP at a time, "" if it is unknown or expired
+func (c *nameCache) name(ip string, at time.Time) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	n, ok := c.names[ip]
+	if !ok || at.After(n.expires) {
+		return ""
+	}
+	return n.name
+}
+
+type dnsQueryKey struct {
+	protocol, client, server string
+	id                       uint16
+}
+
+// dnsTracker matches the DNS responses with their queries, and fills the
+// name cache with the answers
+type dnsTracker struct {
+	mutex     sync.Mutex
+	pending   map[dnsQueryKey]*DNSQueryEvent
+	names     *nameCache
+	eventChan chan<- Event
+	queue     []Event // waiting for room in eventChan
+	dropped   uint64  // events dropped because the queue was full
+	decoder   layers.DNS
+	seq       uint64 // of the next query
+}
+
+func newDNSTracker(eventChan chan<- Event) *dnsTracker {
+	t := new(dnsTracker)
+	t.pending = make(map[dnsQueryKey]*DNSQueryEvent)
+	t.names = newNameCache()
+	t.eventChan = eventChan
+	return t
+}
+
+func addrString(ip, port gopacket.Endpoint) string {
+	return ip.String() + ":" + port.String()
+}
+
+// handle decodes a DNS message, malformed messages are ignored
+func (t *dnsTracker) handle(protocol string, netFlow, portFlow gopacket.Flow, data []byte, seen time.Time) {
+	if q := t.decode(protocol, netFlow, portFlow, data, seen); q != nil {
+		t.send(q)
+	}
+}
+
+// send queues the event of a query, if not nil, and sends the queued events
+// the event channel has room for. It never blocks, since it is called from
+// the packet loop: the events beyond maxQueuedDNS are dropped.
+func (t *dnsTracker) send(q *DNSQueryEvent) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if q != nil {
+		if len(t.queue) >= maxQueuedDNS {
+			t.dropped++
+		} else {
+			t.queue = append(t.queue, *q)
+		}
+	}
+	for len(t.queue) > 0 {
+		select {
+		case t.eventChan <- t.queue[0]:
+			t.queue[0] = nil
+			t.queue = t.queue[1:]
+		default:
+			return
+		}
+	}
+}
+
+// droppedEvents returns the number of events dropped by send
+func (t *dnsTracker) droppedEvents() uint64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.dropped
+}
+
+// decode decodes a DNS message, it returns the query completed by a response
+func (t *dnsTracker) decode(protocol string, netFlow, portFlow gopacket.Flow, data []byte, seen time.Time) *DNSQueryEvent {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	msg := &t.decoder
+	if err := msg.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		return nil
+	}
+	src := addrString(netFlow.Src(), portFlow.Src())
+	dst := addrString(netFlow.Dst(), portFlow.Dst())
+	newQuery := func(client, server string) *DNSQueryEvent {
+		q := &DNSQueryEvent{Type: KindDNSQuery, ID: dnsQueryID(t.seq), Schema: SchemaVersion, Protocol: protocol,
+			ClientAddr: client, ServerAddr: server, QueryID: msg.ID, Start: seen}
+		t.seq++
+		if len(msg.Questions) > 0 {
+			q.Name = string(msg.Questions[0].Name)
+			q.QType = msg.Questions[0].Type.String()
+		}
+		return q
+	}
+	if !msg.QR {
+		key := dnsQueryKey{protocol, src, dst, msg.ID}
+		if _, ok := t.pending[key]; !ok && len(t.pending) < maxPendingDNSQueries {
+			t.pending[key] = newQuery(src, dst)
+		}
+		return nil
+	}
+
+	key := dnsQueryKey{protocol, dst, src, msg.ID}
+	q, ok := t.pending[key]
+	if ok {
+		delete(t.pending, key)
+		q.Duration = seen.Sub(q.Start)
+	} else {
+		q = newQuery(dst, src)
+	}
+	q.Answered = true
+	q.RCode = dnsRCode(msg.ResponseCode)
+	q.End = seen
+	for i := range msg.Answers {
+		rr := &msg.Answers[i]
+		q.Answers = append(q.Answers, dnsAnswer(rr))
+		if (rr.Type == layers.DNSTypeA || rr.Type == layers.DNSTypeAAAA) && q.Name != "" {
+			// the name asked by the client, rather than the end of a CNAME chain
+			t.names.add(rr.IP, q.Name, seen, time.Duration(rr.TTL)*time.Second)
+		}
+	}
+	return q
+}
+
+// flushOlderThan sends the queries sent before a time without response,
+// all of them if the time is zero
+func (t *dnsTracker) flushOlderThan(before time.Time) {
+	t.mutex.Lock()
+	var expired []*DNSQueryEvent
+	for k, q := range t.pending {
+		if before.IsZero() || q.Start.Before(before) {
+			expired = append(expired, q)
+			delete(t.pending, k)
+		}
+	}
+	t.mutex.Unlock()
+	sort.Slice(expired, func(i, j int) bool { return expired[i].Start.Before(expired[j].Start) })
+	if !before.IsZero() {
+		t.send(nil)
+		for _, q := range expired {
+			t.send(q)
+		}
+		return
+	}
+	// the capture is finished, the events can wait for room
+	t.mutex.Lock()
+	queue := t.queue
+	t.queue = nil
+	t.mutex.Unlock()
+	for _, e := range queue {
+		t.eventChan <- e
+	}
+	for _, q := range expired {
+		t.eventChan <- *q
+	}
+}
+
+// dnsStream decodes the DNS messages of a TCP connection, each message is
+// prefixed by its 2 bytes length
+type dnsStream struct {
+	tracker *dnsTracker
+	key     streamKey
+	buffer  []byte
+	lost    bool // the boundaries of the messages are lost
+}
+
+// Reassembled implements tcpassembly.Stream
+func (s *dnsStream) Reassembled(reassemblies []tcpassembly.Reassembly) {
+	for _, r := range reassemblies {
+		if r.Skip != 0 {
+			s.buffer = nil
+			s.lost = true
+		}
+		if s.lost {
+			continue
+		}
+		s.buffer = append(s.buffer, r.Bytes...)
+		for len(s.buffer) >= 2 {
+			n := int(binary.BigEndian.Uint16(s.buffer))
+			if len(s.buffer) < 2+n {
+				break
+			}
+			s.tracker.handle("tcp", s.key.net, s.key.tcp, s.buffer[2:2+n], r.Seen)
+			s.buffer = s.buffer[2+n:]
+		}
+	}
+}
+
+// ReassemblyComplete implements tcpassembly.Stream
+func (s *dnsStream) ReassemblyComplete() {}
+
+// isDNS tells whether one of the ports of the flow is DNSPort
+func isDNS(tcpFlow gopacket.Flow) bool {
+	src, dst := tcpFlow.Src().Raw(), tcpFlow.Dst().Raw()
+	return (len(src) == 2 && binary.BigEndian.Uint16(src) == DNSPort) ||
+		(len(dst) == 2 && binary.BigEndian.Uint16(dst) == DNSPort)
+}
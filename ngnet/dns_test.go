@@ -0,0 +1,147 @@
+package ngnet
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+var (
+	dnsClient = net.ParseIP("10.0.0.1").To4()
+	dnsServer = net.ParseIP("10.0.0.53").To4()
+)
+
+func dnsMessage(t *testing.T, id uint16, response bool, answers ...layers.DNSResourceRecord) []byte {
+	msg := &layers.DNS{ID: id, QR: response, RD: true,
+		Questions: []layers.DNSQuestion{{Name: []byte("api.example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+		Answers:   answers}
+	buf := gopacket.NewSerializeBuffer()
+	if err := msg.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func aRecord(ip string, ttl uint32) layers.DNSResourceRecord {
+	return layers.DNSResourceRecord{Name: []byte("api.example.com"), Type: layers.DNSTypeA,
+		Class: layers.DNSClassIN, TTL: ttl, IP: net.ParseIP(ip).To4()}
+}
+
+// sendUDP serializes and decodes a packet, like the ones captured
+func sendUDP(t *testing.T, f HTTPStreamFactory, fromClient bool, payload []byte, seen time.Time) {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: dnsClient, DstIP: dnsServer}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: DNSPort}
+	if !fromClient {
+		ip.SrcIP, ip.DstIP = ip.DstIP, ip.SrcIP
+		udp.SrcPort, udp.DstPort = udp.DstPort, udp.SrcPort
+	}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	f.HandleUDP(packet.NetworkLayer().NetworkFlow(), packet.Layer(layers.LayerTypeUDP).(*layers.UDP), seen)
+}
+
+func TestDNSOverUDP(t *testing.T) {
+	eventChan := make(chan Event, 16)
+	f := NewHTTPStreamFactory(eventChan)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	sendUDP(t, f, true, dnsMessage(t, 1, false), start)
+	sendUDP(t, f, false, dnsMessage(t, 1, true, aRecord("10.0.0.80", 60)), start.Add(5*time.Millisecond))
+	sendUDP(t, f, true, dnsMessage(t, 2, false), start)
+	sendUDP(t, f, true, []byte("not dns"), start)
+
+	q := (<-eventChan).(DNSQueryEvent)
+	if q.ClientAddr != "10.0.0.1:40000" || q.ServerAddr != "10.0.0.53:53" || q.Protocol != "udp" ||
+		q.Name != "api.example.com" || q.QType != "A" || !q.Answered || q.RCode != "NOERROR" {
+		t.Errorf("bad query %+v", q)
+	}
+	if q.Duration != 5*time.Millisecond || len(q.Answers) != 1 || q.Answers[0].Data != "10.0.0.80" {
+		t.Errorf("bad response %+v", q)
+	}
+	if n := f.dns.names.name("10.0.0.80", start.Add(time.Minute)); n != "api.example.com" {
+		t.Errorf("bad name %q", n)
+	}
+	if n := f.dns.names.name("10.0.0.80", start.Add(2*time.Minute)); n != "" {
+		t.Errorf("name should be expired, got %q", n)
+	}
+
+	// the query without response is sent when flushed
+	f.FlushDNSOlderThan(start)
+	if len(eventChan) != 0 {
+		t.Error("recent query should not be flushed")
+	}
+	f.FlushAllDNS()
+	q = (<-eventChan).(DNSQueryEvent)
+	if q.QueryID != 2 || q.Answered || q.Duration != 0 {
+		t.Errorf("bad unanswered query %+v", q)
+	}
+}
+
+func TestDNSEventsDontBlock(t *testing.T) {
+	// the events are not read while the packets are handled
+	eventChan := make(chan Event, 1)
+	f := NewHTTPStreamFactory(eventChan)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	n := maxQueuedDNS + 2
+	for i := 0; i < n; i++ {
+		sendUDP(t, f, true, dnsMessage(t, uint16(i), false), start)
+		sendUDP(t, f, false, dnsMessage(t, uint16(i), true), start)
+	}
+	if dropped := f.Stats().DroppedDNS; dropped != 1 {
+		t.Errorf("%d events dropped", dropped)
+	}
+	done := make(chan struct{})
+	go func() {
+		f.FlushAllDNS()
+		close(eventChan)
+		close(done)
+	}()
+	var received int
+	for e := range eventChan {
+		if q := e.(DNSQueryEvent); q.QueryID != uint16(received) {
+			t.Fatalf("event %d has query ID %d", received, q.QueryID)
+		}
+		received++
+	}
+	<-done
+	if received != n-1 {
+		t.Errorf("%d events received", received)
+	}
+}
+
+func TestDNSOverTCP(t *testing.T) {
+	eventChan := make(chan Event, 16)
+	f := NewHTTPStreamFactory(eventChan)
+	netFlow := gopacket.NewFlow(layers.EndpointIPv4, dnsServer, dnsClient)
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(DNSPort), layers.NewTCPPortEndpoint(40000))
+	s := f.New(netFlow, tcpFlow)
+	if _, ok := s.(*dnsStream); !ok {
+		t.Fatalf("bad stream %T", s)
+	}
+
+	var data []byte
+	for id := uint16(1); id <= 2; id++ {
+		msg := dnsMessage(t, id, true, aRecord("10.0.0.80", 60))
+		data = binary.BigEndian.AppendUint16(data, uint16(len(msg)))
+		data = append(data, msg...)
+	}
+	// the messages are split across the reassemblies
+	seen := time.Now()
+	s.Reassembled([]tcpassembly.Reassembly{{Bytes: data[:5], Seen: seen}, {Bytes: data[5:], Seen: seen}})
+	s.ReassemblyComplete()
+	for id := uint16(1); id <= 2; id++ {
+		q := (<-eventChan).(DNSQueryEvent)
+		if q.QueryID != id || q.Protocol != "tcp" || q.ClientAddr != "10.0.0.1:40000" || !q.Answered {
+			t.Errorf("bad query %+v", q)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package ngnet
+
+import (
+	"fmt"
+	"time"
+)
+
+// SchemaVersion is the version of the JSON encoding of the events, set in
+// their Schema field. It is increased when a field is removed or changes
+// type; version 1 is the encoding without ID and Schema.
+const SchemaVersion = 2
+
+// Kinds of the events, the Type field of their JSON encoding
+const (
+	KindHTTPRequest  = "HTTPRequest"
+	KindHTTPResponse = "HTTPResponse"
+	KindTransaction  = "Transaction"
+	KindDNSQuery     = "DNSQuery"
+)
+
+// Event is an event of the capture: HTTPRequestEvent, HTTPResponseEvent,
+// TransactionEvent or DNSQueryEvent. The types of the other packages can't
+// implement it.
+type Event interface {
+	// EventID returns the ID of the event, unique among the events of a
+	// capture only: a new capture numbers its events from 0 again. The IDs
+	// of the HTTP events stay unique across captures only if each one
+	// starts after the last StreamSeq of the former.
+	EventID() string
+	// Kind returns one of the Kind constants
+	Kind() string
+	// Timestamp returns the time of the first packet of the event
+	Timestamp() time.Time
+
+	event()
+}
+
+// TransactionID returns the ID of a transaction, "<StreamSeq>.<RequestSeq>"
+func TransactionID(streamSeq, requestSeq uint) string {
+	return fmt.Sprintf("%d.%d", streamSeq, requestSeq)
+}
+
+// RequestID returns the ID of the request of a transaction
+func RequestID(streamSeq, requestSeq uint) string {
+	return TransactionID(streamSeq, requestSeq) + ":request"
+}
+
+// ResponseID returns the ID of the response of a transaction
+func ResponseID(streamSeq, requestSeq uint) string {
+	return TransactionID(streamSeq, requestSeq) + ":response"
+}
+
+// dnsQueryID returns the ID of the DNS query with a sequence number
+func dnsQueryID(seq uint64) string {
+	return fmt.Sprintf("dns:%d", seq)
+}
+
+// TransactionEvent is an HTTP request and its response. The stream factory
+// sends it after the response if SetTransactions is set.
+type TransactionEvent struct {
+	Type     string
+	ID       string // same as TransactionID
+	Schema   int    // SchemaVersion
+	Request  HTTPRequestEvent
+	Response *HTTPResponseEvent // nil if the response was not captured
+}
+
+// NewTransactionEvent returns the transaction of a request, without response
+func NewTransactionEvent(req HTTPRequestEvent) *TransactionEvent {
+	return &TransactionEvent{
+		Type:    KindTransaction,
+		ID:      TransactionID(req.StreamSeq, req.RequestSeq),
+		Schema:  SchemaVersion,
+		Request: req,
+	}
+}
+
+// EventID implements Event
+func (e HTTPRequestEvent) EventID() string { return e.ID }
+
+// Kind implements Event
+func (e HTTPRequestEvent) Kind() string { return KindHTTPRequest }
+
+// Timestamp implements Event
+func (e HTTPRequestEvent) Timestamp() time.Time { return e.Start }
+
+func (e HTTPRequestEvent) event() {}
+
+// EventID implements Event
+func (e HTTPResponseEvent) EventID() string { return e.ID }
+
+// Kind implements Event
+func (e HTTPResponseEvent) Kind() string { return KindHTTPResponse }
+
+// Timestamp implements Event
+func (e HTTPResponseEvent) Timestamp() time.Time { return e.Start }
+
+func (e HTTPResponseEvent) event() {}
+
+// EventID implements Event
+func (e TransactionEvent) EventID() string { return e.ID }
+
+// Kind implements Event
+func (e TransactionEvent) Kind() string { return KindTransaction }
+
+// Timestamp implements Event, the time of the request
+func (e TransactionEvent) Timestamp() time.Time { return e.Request.Start }
+
+func (e TransactionEvent) event() {}
+
+// EventID implements Event
+func (e DNSQueryEvent) EventID() string { return e.ID }
+
+// Kind implements Event
+func (e DNSQueryEvent) Kind() string { return KindDNSQuery }
+
+// Timestamp implements Event
+func (e DNSQueryEvent) Timestamp() time.Time { return e.Start }
+
+func (e DNSQueryEvent) event() {}
+
+// Upgrade sets the fields of the current version in an event decoded from
+// an older one, like the events saved on disk by a former netgraph. The IDs
+// of the HTTP events are derived from their StreamSeq and RequestSeq, so
+// they are the same as if the events were captured now.
+func Upgrade(e Event) Event {
+	switch v := e.(type) {
+	case HTTPRequestEvent:
+		if v.ID == "" {
+			v.ID = RequestID(v.StreamSeq, v.RequestSeq)
+			v.Schema = SchemaVersion
+		}
+		return v
+	case HTTPResponseEvent:
+		if v.ID == "" {
+			v.ID = ResponseID(v.StreamSeq, v.RequestSeq)
+			v.RequestID = RequestID(v.StreamSeq, v.RequestSeq)
+			v.Schema = SchemaVersion
+		}
+		return v
+	}
+	return e
+}
@@ -0,0 +1,62 @@
+package ngnet
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEventIDs(t *testing.T) {
+	eventChan := make(chan Event, 1024)
+	f := NewHTTPStreamFactory(eventChan)
+	f.SetTransactions(true)
+	runDump(t, f, eventChan)
+	ids := make(map[string]bool)
+	requests := make(map[string]HTTPRequestEvent)
+	var transactions int
+	for e := range eventChan {
+		if ids[e.EventID()] {
+			t.Errorf("duplicate ID %s", e.EventID())
+		}
+		ids[e.EventID()] = true
+		switch v := e.(type) {
+		case HTTPRequestEvent:
+			if v.ID != RequestID(v.StreamSeq, v.RequestSeq) || v.Schema != SchemaVersion || v.Kind() != v.Type {
+				t.Errorf("bad request %s %d %s", v.ID, v.Schema, v.Type)
+			}
+			requests[v.ID] = v
+		case HTTPResponseEvent:
+			req, ok := requests[v.RequestID]
+			if !ok || req.StreamSeq != v.StreamSeq || req.RequestSeq != v.RequestSeq || v.Timestamp() != v.Start {
+				t.Errorf("response %s of unknown request %s", v.ID, v.RequestID)
+			}
+		case TransactionEvent:
+			transactions++
+			if v.Response == nil || v.Response.RequestID != v.Request.ID || v.ID != TransactionID(v.Request.StreamSeq, v.Request.RequestSeq) ||
+				v.Timestamp() != v.Request.Start || !ids[v.Response.ID] {
+				t.Errorf("bad transaction %s", v.ID)
+			}
+		default:
+			t.Errorf("unexpected event %T", e)
+		}
+	}
+	if len(requests) != 84 || transactions != 84 {
+		t.Errorf("%d requests, %d transactions", len(requests), transactions)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	// a response saved by netgraph before the events had IDs
+	var resp HTTPResponseEvent
+	if err := json.Unmarshal([]byte(`{"Type":"HTTPResponse","StreamSeq":12,"RequestSeq":1,"Code":200}`), &resp); err != nil {
+		t.Fatal(err)
+	}
+	e := Upgrade(resp).(HTTPResponseEvent)
+	if e.ID != "12.1:response" || e.RequestID != "12.1:request" || e.Schema != SchemaVersion {
+		t.Errorf("bad upgrade %+v", e)
+	}
+	req := HTTPRequestEvent{}
+	req.ID = "x"
+	if Upgrade(req).EventID() != "x" {
+		t.Error("the events of the current version are not changed")
+	}
+}
@@ -3,11 +3,13 @@ package ngnet
 import (
 	"bytes"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
@@ -32,19 +34,44 @@ func (k streamKey) String() string {
 	return fmt.Sprintf("{%v:%v} -> {%v:%v}", k.net.Src(), k.tcp.Src(), k.net.Dst(), k.tcp.Dst())
 }
 
+// errConnectionClosed stops parsing a connection closed between two messages
+var errConnectionClosed = errors.New("connection closed")
+
+// parseError stops parsing a connection whose data is not valid HTTP or
+// ends in the middle of a message
+type parseError struct {
+	reason string // counted in StreamStats.ParseErrors
+	msg    string
+}
+
+func (e *parseError) Error() string {
+	return e.msg
+}
+
+func parseFailed(reason string, msg string) {
+	panic(&parseError{reason, msg})
+}
+
+// readFailed is called when the stream ends before the message is complete
+func readFailed(what string, err error) {
+	parseFailed(ParseErrorTruncated, "Cannot read "+what+", err="+err.Error())
+}
+
 type httpStream struct {
 	reader *StreamReader
 	bytes  *uint64
 	key    streamKey
 	bad    *bool
+	stats  *streamStats
 }
 
-func newHTTPStream(key streamKey) httpStream {
+func newHTTPStream(key streamKey, stats *streamStats) httpStream {
 	var s httpStream
 	s.reader = NewStreamReader()
 	s.bytes = new(uint64)
 	s.key = key
 	s.bad = new(bool)
+	s.stats = stats
 	return s
 }
 
@@ -65,6 +92,7 @@ func (s httpStream) Reassembled(rs []tcpassembly.Reassembly) {
 		}
 
 		*s.bytes += uint64(len(r.Bytes))
+		atomic.AddUint64(&s.stats.bytes, uint64(len(r.Bytes)))
 		ticker := time.Tick(time.Second)
 
 		select {
@@ -89,12 +117,15 @@ func (s httpStream) ReassemblyComplete() {
 func (s *httpStream) getRequestLine() (method string, uri string, version string) {
 	bytes, err := s.reader.ReadUntil([]byte("\r\n"))
 	if err != nil {
-		panic("Cannot read request line, err=" + err.Error())
+		if s.reader.buffer.Len() == 0 {
+			panic(errConnectionClosed)
+		}
+		readFailed("request line", err)
 	}
 	line := string(bytes)
 	r := httpRequestFirtLine.FindStringSubmatch(line)
 	if len(r) != 4 {
-		panic("Bad HTTP Request: " + line)
+		parseFailed(ParseErrorRequestLine, "Bad HTTP Request: "+line)
 	}
 
 	method = r[1]
@@ -106,19 +137,19 @@ func (s *httpStream) getRequestLine() (method string, uri string, version string
 func (s *httpStream) getResponseLine() (version string, code uint, reason string) {
 	bytes, err := s.reader.ReadUntil([]byte("\r\n"))
 	if err != nil {
-		panic("Cannot read response line, err=" + err.Error())
+		readFailed("response line", err)
 	}
 	line := string(bytes)
 	r := httpResponseFirtLine.FindStringSubmatch(line)
 	if len(r) != 4 {
-		panic("Bad HTTP Response: " + line)
+		parseFailed(ParseErrorResponseLine, "Bad HTTP Response: "+line)
 	}
 
 	version = r[1]
 	var code64 uint64
 	code64, err = strconv.ParseUint(r[2], 10, 32)
 	if err != nil {
-		panic("Bad HTTP Response: " + line + ", err=" + err.Error())
+		parseFailed(ParseErrorResponseLine, "Bad HTTP Response: "+line+", err="+err.Error())
 	}
 	code = uint(code64)
 	reason = r[3]
@@ -128,13 +159,13 @@ func (s *httpStream) getResponseLine() (version string, code uint, reason string
 func (s *httpStream) getHeaders() (headers []HTTPHeaderItem) {
 	d, err := s.reader.ReadUntil([]byte("\r\n\r\n"))
 	if err != nil {
-		panic("Cannot read headers, err=" + err.Error())
+		readFailed("headers", err)
 	}
 	data := string(d[:len(d)-4])
 	for i, line := range strings.Split(data, "\r\n") {
 		p := strings.Index(line, ":")
 		if p == -1 {
-			panic(fmt.Sprintf("Bad http header (line %d): %s", i, data))
+			parseFailed(ParseErrorHeader, fmt.Sprintf("Bad http header (line %d): %s", i, data))
 		}
 		var h HTTPHeaderItem
 		h.Name = line[:p]
@@ -149,27 +180,27 @@ func (s *httpStream) getChunked() []byte {
 	for {
 		buf, err := s.reader.ReadUntil([]byte("\r\n"))
 		if err != nil {
-			panic("Cannot read chuncked content, err=" + err.Error())
+			readFailed("chuncked content", err)
 		}
 		l := string(buf)
 		l = strings.Trim(l[:len(l)-2], " ")
 		blockSize, err := strconv.ParseInt(l, 16, 32)
 		if err != nil {
-			panic("bad chunked block length: " + l + ", err=" + err.Error())
+			parseFailed(ParseErrorChunked, "bad chunked block length: "+l+", err="+err.Error())
 		}
 
 		buf, err = s.reader.Next(int(blockSize))
 		body = append(body, buf...)
 		if err != nil {
-			panic("Cannot read chuncked content, err=" + err.Error())
+			readFailed("chuncked content", err)
 		}
 		buf, err = s.reader.Next(2)
 		if err != nil {
-			panic("Cannot read chuncked content, err=" + err.Error())
+			readFailed("chuncked content", err)
 		}
 		CRLF := string(buf)
 		if CRLF != "\r\n" {
-			panic("Bad chunked block data")
+			parseFailed(ParseErrorChunked, "Bad chunked block data")
 		}
 
 		if blockSize == 0 {
@@ -182,7 +213,7 @@ func (s *httpStream) getChunked() []byte {
 func (s *httpStream) getFixedLengthContent(contentLength int) []byte {
 	body, err := s.reader.Next(contentLength)
 	if err != nil {
-		panic("Cannot read content, err=" + err.Error())
+		readFailed("content", err)
 	}
 	return body
 }
@@ -194,7 +225,7 @@ func getContentInfo(hs []HTTPHeaderItem) (contentLength int, contentEncoding str
 			var err error
 			contentLength, err = strconv.Atoi(h.Value)
 			if err != nil {
-				panic("Content-Length error: " + h.Value + ", err=" + err.Error())
+				parseFailed(ParseErrorContentLength, "Content-Length error: "+h.Value+", err="+err.Error())
 			}
 		} else if lowerName == "transfer-encoding" && h.Value == "chunked" {
 			chunked = true
@@ -3,8 +3,10 @@ package ngnet
 import (
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/tcpassembly"
 )
 
@@ -14,11 +16,17 @@ type HTTPStreamFactory struct {
 	wg            *sync.WaitGroup
 	seq           *uint
 	uniStreams    *map[streamKey]*httpStreamPair
-	eventChan     chan<- interface{}
+	eventChan     chan<- Event
+	filter        *StreamFilter
+	filterStats   *StreamFilterStats
+	stats         *streamStats
+	processes     ProcessLookup
+	transactions  bool
+	dns           *dnsTracker
 }
 
 // NewHTTPStreamFactory create a NewHTTPStreamFactory
-func NewHTTPStreamFactory(out chan<- interface{}) HTTPStreamFactory {
+func NewHTTPStreamFactory(out chan<- Event) HTTPStreamFactory {
 	var f HTTPStreamFactory
 	f.seq = new(uint)
 	*f.seq = 0
@@ -27,9 +35,71 @@ func NewHTTPStreamFactory(out chan<- interface{}) HTTPStreamFactory {
 	*f.uniStreams = make(map[streamKey]*httpStreamPair)
 	f.eventChan = out
 	f.runningStream = new(int32)
+	f.filterStats = new(StreamFilterStats)
+	f.stats = newStreamStats()
+	f.dns = newDNSTracker(out)
 	return f
 }
 
+// NewFilteredHTTPStreamFactory create a HTTPStreamFactory which drops the
+// connections not passing the filter
+func NewFilteredHTTPStreamFactory(out chan<- Event, filter StreamFilter) HTTPStreamFactory {
+	f := NewHTTPStreamFactory(out)
+	f.filter = &filter
+	return f
+}
+
+// FilterStats get the count of connections dropped by the filter
+func (f HTTPStreamFactory) FilterStats() StreamFilterStats {
+	return StreamFilterStats{
+		SampledOut: atomic.LoadUint64(&f.filterStats.SampledOut),
+		Denied:     atomic.LoadUint64(&f.filterStats.Denied),
+	}
+}
+
+// Stats get the bytes reassembled and the parse errors so far
+func (f HTTPStreamFactory) Stats() StreamStats {
+	stats := f.stats.get()
+	stats.DroppedDNS = f.dns.droppedEvents()
+	return stats
+}
+
+// SetProcessLookup sets how the local processes of the connections are
+// found, they are not looked up if l is nil
+func (f *HTTPStreamFactory) SetProcessLookup(l ProcessLookup) {
+	f.processes = l
+}
+
+// SetTransactions sets whether a TransactionEvent is sent after the
+// HTTPResponseEvent of each transaction
+func (f *HTTPStreamFactory) SetTransactions(on bool) {
+	f.transactions = on
+}
+
+// HandleUDP decodes the DNS messages from and to DNSPort, the other UDP
+// packets are ignored. A DNSQueryEvent is sent for each response.
+func (f HTTPStreamFactory) HandleUDP(netFlow gopacket.Flow, udp *layers.UDP, seen time.Time) {
+	if udp.SrcPort != DNSPort && udp.DstPort != DNSPort {
+		return
+	}
+	f.dns.handle("udp", netFlow, udp.TransportFlow(), udp.Payload, seen)
+}
+
+// FlushDNSOlderThan sends the DNS queries sent before t without response
+func (f HTTPStreamFactory) FlushDNSOlderThan(t time.Time) {
+	f.dns.flushOlderThan(t)
+}
+
+// FlushAllDNS sends all the DNS queries without response
+func (f HTTPStreamFactory) FlushAllDNS() {
+	f.dns.flushOlderThan(time.Time{})
+}
+
+// SetNextSeq sets the StreamSeq of the next TCP connection
+func (f HTTPStreamFactory) SetNextSeq(seq uint) {
+	*f.seq = seq
+}
+
 // Wait for all stream exit
 func (f HTTPStreamFactory) Wait() {
 	f.wg.Wait()
@@ -50,6 +120,9 @@ func (f *HTTPStreamFactory) runStreamPair(streamPair *httpStreamPair) {
 
 // New creates a HTTPStreamFactory
 func (f HTTPStreamFactory) New(netFlow, tcpFlow gopacket.Flow) (ret tcpassembly.Stream) {
+	if isDNS(tcpFlow) {
+		return &dnsStream{tracker: f.dns, key: streamKey{netFlow, tcpFlow}}
+	}
 	revkey := streamKey{netFlow.Reverse(), tcpFlow.Reverse()}
 	streamPair, ok := (*f.uniStreams)[revkey]
 	if ok {
@@ -58,13 +131,29 @@ func (f HTTPStreamFactory) New(netFlow, tcpFlow gopacket.Flow) (ret tcpassembly.
 		}
 		delete(*f.uniStreams, revkey)
 		key := streamKey{netFlow, tcpFlow}
-		s := newHTTPStream(key)
-		streamPair.downStream = &s
+		s := newHTTPStream(key, f.stats)
+		if !streamPair.setDownStream(&s) {
+			return discardStream{}
+		}
 		ret = s
 	} else {
-		streamPair = newHTTPStreamPair(*f.seq, f.eventChan)
 		key := streamKey{netFlow, tcpFlow}
-		s := newHTTPStream(key)
+		if f.filter != nil && !f.filter.sampled(key) {
+			// both directions of the connection are sampled out, count one of them
+			if _, _, forward := endpoints(key); forward {
+				atomic.AddUint64(&f.filterStats.SampledOut, 1)
+			}
+			return discardStream{}
+		}
+		streamPair = newHTTPStreamPair(*f.seq, f.eventChan, f.stats)
+		streamPair.processes = f.processes
+		streamPair.transactions = f.transactions
+		streamPair.names = f.dns.names
+		if f.filter != nil && f.filter.checksRequest() {
+			streamPair.filter = f.filter
+			streamPair.filterStats = f.filterStats
+		}
+		s := newHTTPStream(key, f.stats)
 		streamPair.upStream = &s
 		(*f.uniStreams)[key] = streamPair
 		*f.seq++
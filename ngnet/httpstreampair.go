@@ -1,6 +1,8 @@
 package ngnet
 
 import (
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,10 +14,13 @@ type HTTPHeaderItem struct {
 
 // HTTPEvent is HTTP request or response
 type HTTPEvent struct {
-	Type      string
-	Start     time.Time
-	End       time.Time
-	StreamSeq uint
+	Type       string
+	ID         string // RequestID or ResponseID
+	Schema     int    // SchemaVersion
+	Start      time.Time
+	End        time.Time
+	StreamSeq  uint
+	RequestSeq uint // sequence number of the request in the stream
 }
 
 // HTTPRequestEvent is HTTP request
@@ -25,9 +30,18 @@ type HTTPRequestEvent struct {
 	ServerAddr string
 	Method     string
 	URI        string
+	Route      string `json:",omitempty"` // route template of the URI, set by the event handler
 	Version    string
 	Headers    []HTTPHeaderItem
 	Body       []byte
+
+	// local processes of the connection, set if a ProcessLookup is used
+	ClientProcess *Process `json:",omitempty"`
+	ServerProcess *Process `json:",omitempty"`
+
+	// names of the addresses in the DNS answers captured before the connection
+	ClientName string `json:",omitempty"`
+	ServerName string `json:",omitempty"`
 }
 
 // HTTPResponseEvent is HTTP response
@@ -40,6 +54,7 @@ type HTTPResponseEvent struct {
 	Reason     string
 	Headers    []HTTPHeaderItem
 	Body       []byte
+	RequestID  string // ID of the request of the response
 }
 
 // httpStreamPair is Bi-direction HTTP stream pair
@@ -47,15 +62,31 @@ type httpStreamPair struct {
 	upStream   *httpStream
 	downStream *httpStream
 
-	requestSeq uint
-	connSeq    uint
-	eventChan  chan<- interface{}
+	requestSeq   uint
+	connSeq      uint
+	eventChan    chan<- Event
+	transactions bool // send a TransactionEvent after each response
+
+	stats       *streamStats
+	filter      *StreamFilter // checks the first request if not nil
+	filterStats *StreamFilterStats
+	mutex       sync.Mutex // protects downStream and dropped
+	dropped     bool
+
+	processes     ProcessLookup // nil if the processes are not looked up
+	clientProcess *Process
+	serverProcess *Process
+
+	names      *nameCache
+	clientName string
+	serverName string
 }
 
-func newHTTPStreamPair(seq uint, eventChan chan<- interface{}) *httpStreamPair {
+func newHTTPStreamPair(seq uint, eventChan chan<- Event, stats *streamStats) *httpStreamPair {
 	pair := new(httpStreamPair)
 	pair.connSeq = seq
 	pair.eventChan = eventChan
+	pair.stats = stats
 
 	return pair
 }
@@ -66,41 +97,97 @@ func (pair *httpStreamPair) run() {
 			if pair.upStream != nil {
 				close(pair.upStream.reader.stopCh)
 			}
-			if pair.downStream != nil {
-				close(pair.downStream.reader.stopCh)
+			if downStream := pair.getDownStream(); downStream != nil {
+				close(downStream.reader.stopCh)
+			}
+			if r != errConnectionClosed {
+				pair.stats.parseError(r)
 			}
 			//fmt.Printf("HTTPStream (#%d %v) error: %v\n", pair.connSeq, pair.upStream.key, r)
 		}
 	}()
 
-	for {
-		pair.handleTransaction()
+	if pair.processes != nil {
+		// as soon as the connection is seen, a short one may be closed
+		// when its first request is parsed
+		pair.lookupProcesses()
+	}
+	for pair.handleTransaction() {
 		pair.requestSeq++
 	}
 }
 
-func (pair *httpStreamPair) handleTransaction() {
+// setDownStream sets the stream of the responses, unless the connection is dropped
+func (pair *httpStreamPair) setDownStream(s *httpStream) bool {
+	pair.mutex.Lock()
+	defer pair.mutex.Unlock()
+	if pair.dropped {
+		return false
+	}
+	pair.downStream = s
+	return true
+}
+
+// getDownStream returns the stream of the responses, nil until it is set
+func (pair *httpStreamPair) getDownStream() *httpStream {
+	pair.mutex.Lock()
+	defer pair.mutex.Unlock()
+	return pair.downStream
+}
+
+// drop stops reading the connection, the rest of its data is discarded
+func (pair *httpStreamPair) drop() {
+	pair.mutex.Lock()
+	defer pair.mutex.Unlock()
+	pair.dropped = true
+	atomic.AddUint64(&pair.filterStats.Denied, 1)
+	close(pair.upStream.reader.stopCh)
+	if pair.downStream != nil {
+		close(pair.downStream.reader.stopCh)
+	}
+}
+
+// handleTransaction reads a request and its response, it returns false if
+// the connection is dropped
+func (pair *httpStreamPair) handleTransaction() bool {
 	upStream := pair.upStream
 	method, uri, version := upStream.getRequestLine()
 	reqStart := upStream.reader.lastSeen
 	reqHeaders := upStream.getHeaders()
+	if pair.filter != nil && pair.requestSeq == 0 && !pair.filter.allowed(hostHeader(reqHeaders), uri) {
+		pair.drop()
+		return false
+	}
 	reqBody := upStream.getBody(method, reqHeaders, true)
+	if pair.requestSeq == 0 && pair.names != nil {
+		// the names of the first request are kept by the connection,
+		// which may outlive the TTL of the DNS answers
+		pair.clientName = pair.names.name(pair.upStream.key.net.Src().String(), reqStart)
+		pair.serverName = pair.names.name(pair.upStream.key.net.Dst().String(), reqStart)
+	}
 
 	var req HTTPRequestEvent
 	req.ClientAddr = pair.upStream.key.net.Src().String() + ":" + pair.upStream.key.tcp.Src().String()
 	req.ServerAddr = pair.upStream.key.net.Dst().String() + ":" + pair.upStream.key.tcp.Dst().String()
-	req.Type = "HTTPRequest"
+	req.Type = KindHTTPRequest
+	req.ID = RequestID(pair.connSeq, pair.requestSeq)
+	req.Schema = SchemaVersion
 	req.Method = method
 	req.URI = uri
 	req.Version = version
 	req.Headers = reqHeaders
 	req.Body = reqBody
+	req.ClientProcess = pair.clientProcess
+	req.ServerProcess = pair.serverProcess
+	req.ClientName = pair.clientName
+	req.ServerName = pair.serverName
 	req.StreamSeq = pair.connSeq
+	req.RequestSeq = pair.requestSeq
 	req.Start = reqStart
 	req.End = upStream.reader.lastSeen
 	pair.eventChan <- req
 
-	downStream := pair.downStream
+	downStream := pair.getDownStream()
 	respVersion, code, reason := downStream.getResponseLine()
 	respStart := downStream.reader.lastSeen
 	respHeaders := downStream.getHeaders()
@@ -109,14 +196,24 @@ func (pair *httpStreamPair) handleTransaction() {
 	var resp HTTPResponseEvent
 	resp.ClientAddr = pair.upStream.key.net.Src().String() + ":" + pair.upStream.key.tcp.Src().String()
 	resp.ServerAddr = pair.upStream.key.net.Dst().String() + ":" + pair.upStream.key.tcp.Dst().String()
-	resp.Type = "HTTPResponse"
+	resp.Type = KindHTTPResponse
+	resp.ID = ResponseID(pair.connSeq, pair.requestSeq)
+	resp.Schema = SchemaVersion
+	resp.RequestID = req.ID
 	resp.Version = respVersion
 	resp.Code = uint(code)
 	resp.Reason = reason
 	resp.Headers = respHeaders
 	resp.Body = respBody
 	resp.StreamSeq = pair.connSeq
+	resp.RequestSeq = pair.requestSeq
 	resp.Start = respStart
 	resp.End = downStream.reader.lastSeen
 	pair.eventChan <- resp
+	if pair.transactions {
+		t := NewTransactionEvent(req)
+		t.Response = &resp
+		pair.eventChan <- *t
+	}
+	return true
 }
@@ -11,7 +11,7 @@ import (
 )
 
 func TestNgnet(t *testing.T) {
-	eventChan := make(chan interface{}, 1024)
+	eventChan := make(chan Event, 1024)
 	f := NewHTTPStreamFactory(eventChan)
 	pool := tcpassembly.NewStreamPool(f)
 	assembler := tcpassembly.NewAssembler(pool)
@@ -0,0 +1,41 @@
+package ngnet
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// Process is a local process owning one end of a TCP connection
+type Process struct {
+	PID         int
+	Exe         string // path of the executable
+	Cmdline     string // arguments separated by spaces
+	User        string // name of the real user, or the uid if it has no name
+	Cgroup      string `json:",omitempty"`
+	ContainerID string `json:",omitempty"` // found in the cgroup path
+}
+
+// ProcessLookup finds the local processes owning the TCP connections
+type ProcessLookup interface {
+	// LookupProcess returns the process owning the socket with the local
+	// address connected to the remote address, nil if it is not found
+	LookupProcess(local, remote *net.TCPAddr) *Process
+}
+
+// tcpAddrs returns the source and destination of the stream
+func (k streamKey) tcpAddrs() (src, dst *net.TCPAddr) {
+	addr := func(ip, port []byte) *net.TCPAddr {
+		if len(port) != 2 {
+			return &net.TCPAddr{IP: net.IP(ip)}
+		}
+		return &net.TCPAddr{IP: net.IP(ip), Port: int(binary.BigEndian.Uint16(port))}
+	}
+	return addr(k.net.Src().Raw(), k.tcp.Src().Raw()), addr(k.net.Dst().Raw(), k.tcp.Dst().Raw())
+}
+
+// lookupProcesses finds the local processes of both ends of the connection
+func (pair *httpStreamPair) lookupProcesses() {
+	client, server := pair.upStream.key.tcpAddrs()
+	pair.clientProcess = pair.processes.LookupProcess(client, server)
+	pair.serverProcess = pair.processes.LookupProcess(server, client)
+}
@@ -0,0 +1,43 @@
+package ngnet
+
+import (
+	"net"
+	"testing"
+)
+
+// fakeProcesses owns the sockets of one local IP
+type fakeProcesses struct {
+	ip net.IP
+}
+
+func (p fakeProcesses) LookupProcess(local, remote *net.TCPAddr) *Process {
+	if !local.IP.Equal(p.ip) {
+		return nil
+	}
+	return &Process{PID: local.Port, Exe: "/usr/bin/curl"}
+}
+
+func TestProcessLookup(t *testing.T) {
+	eventChan := make(chan Event, 1024)
+	f := NewHTTPStreamFactory(eventChan)
+	f.SetProcessLookup(fakeProcesses{net.ParseIP("192.168.10.73")})
+	runDump(t, f, eventChan)
+	n := 0
+	for e := range eventChan {
+		req, ok := e.(HTTPRequestEvent)
+		if !ok {
+			continue
+		}
+		n++
+		if req.ServerProcess != nil {
+			t.Error("unexpected server process:", req.ServerProcess)
+		}
+		client, _ := net.ResolveTCPAddr("tcp", req.ClientAddr)
+		if p := req.ClientProcess; p == nil || p.PID != client.Port {
+			t.Errorf("bad client process of %s: %+v", req.ClientAddr, p)
+		}
+	}
+	if n != 84 {
+		t.Error("unexpected request count:", n)
+	}
+}
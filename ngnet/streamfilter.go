@@ -0,0 +1,115 @@
+package ngnet
+
+import (
+	"hash/fnv"
+	"strings"
+
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// StreamFilter drops TCP connections before their HTTP messages are parsed.
+// Hosts are matched against the Host header of the first request without
+// port, "*.example.com" matches the subdomains of example.com. Paths are
+// prefixes of the URI of the first request. Empty lists match everything.
+type StreamFilter struct {
+	SampleRate float64 // fraction of the connections kept, 0 keeps all
+	AllowHosts []string
+	DenyHosts  []string
+	AllowPaths []string
+	DenyPaths  []string
+}
+
+// StreamFilterStats counts the connections dropped by the StreamFilter
+type StreamFilterStats struct {
+	SampledOut uint64
+	Denied     uint64
+}
+
+// endpoints returns the endpoints of the connection in a fixed order,
+// whatever the direction of the stream, and whether the stream goes from
+// the first endpoint to the second.
+func endpoints(key streamKey) (a string, b string, forward bool) {
+	a = key.net.Src().String() + ":" + key.tcp.Src().String()
+	b = key.net.Dst().String() + ":" + key.tcp.Dst().String()
+	if a > b {
+		return b, a, false
+	}
+	return a, b, true
+}
+
+// sampled tells whether the connection is kept by the sampling. The
+// decision only depends on the endpoints of the connection, so both
+// directions of it get the same result.
+func (f *StreamFilter) sampled(key streamKey) bool {
+	if f.SampleRate <= 0 || f.SampleRate >= 1 {
+		return true
+	}
+	a, b, _ := endpoints(key)
+	h := fnv.New64a()
+	h.Write([]byte(a + "|" + b))
+	return h.Sum64()%1000000 < uint64(f.SampleRate*1000000)
+}
+
+func matchHost(patterns []string, host string) bool {
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "*.") {
+			if strings.HasSuffix(host, strings.ToLower(p[1:])) {
+				return true
+			}
+		} else if strings.EqualFold(p, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPath(prefixes []string, uri string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(uri, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed tells whether the connection whose first request has the host
+// and uri is kept
+func (f *StreamFilter) allowed(host string, uri string) bool {
+	host = strings.ToLower(host)
+	if p := strings.LastIndex(host, ":"); p != -1 && !strings.HasSuffix(host, "]") {
+		host = host[:p]
+	}
+	if len(f.AllowHosts) > 0 && !matchHost(f.AllowHosts, host) {
+		return false
+	}
+	if matchHost(f.DenyHosts, host) {
+		return false
+	}
+	if len(f.AllowPaths) > 0 && !matchPath(f.AllowPaths, uri) {
+		return false
+	}
+	return !matchPath(f.DenyPaths, uri)
+}
+
+func hostHeader(headers []HTTPHeaderItem) string {
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, "Host") {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+func (f *StreamFilter) checksRequest() bool {
+	return len(f.AllowHosts) > 0 || len(f.DenyHosts) > 0 ||
+		len(f.AllowPaths) > 0 || len(f.DenyPaths) > 0
+}
+
+// discardStream is the tcpassembly.Stream of a dropped connection
+type discardStream struct{}
+
+// Reassembled is called by tcpassembly
+func (discardStream) Reassembled([]tcpassembly.Reassembly) {}
+
+// ReassemblyComplete is called by tcpassembly
+func (discardStream) ReassemblyComplete() {}
@@ -0,0 +1,100 @@
+package ngnet
+
+import (
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+func runDump(t *testing.T, f HTTPStreamFactory, eventChan chan Event) {
+	handle, err := pcap.OpenOffline("dump.pcapng")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assembler := tcpassembly.NewAssembler(tcpassembly.NewStreamPool(f))
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	for packet := range packetSource.Packets() {
+		netLayer := packet.NetworkLayer()
+		tcp, _ := packet.TransportLayer().(*layers.TCP)
+		if netLayer == nil || tcp == nil {
+			continue
+		}
+		assembler.AssembleWithTimestamp(netLayer.NetworkFlow(), tcp, packet.Metadata().CaptureInfo.Timestamp)
+	}
+	assembler.FlushAll()
+	f.Wait()
+	close(eventChan)
+}
+
+func TestStreamFilterAllowed(t *testing.T) {
+	f := StreamFilter{
+		AllowHosts: []string{"api.example.com", "*.example.org"},
+		DenyPaths:  []string{"/health"},
+	}
+	cases := []struct {
+		host, uri string
+		allowed   bool
+	}{
+		{"api.example.com", "/users", true},
+		{"API.example.com:8080", "/users", true},
+		{"www.example.com", "/users", false},
+		{"a.b.example.org", "/", true},
+		{"example.org", "/", false},
+		{"api.example.com", "/healthz", false},
+		{"", "/", false},
+	}
+	for _, c := range cases {
+		if f.allowed(c.host, c.uri) != c.allowed {
+			t.Errorf("allowed(%q, %q) should be %v", c.host, c.uri, c.allowed)
+		}
+	}
+}
+
+func TestStreamFilterDump(t *testing.T) {
+	eventChan := make(chan Event, 1024)
+	f := NewFilteredHTTPStreamFactory(eventChan, StreamFilter{
+		AllowHosts: []string{"www.zj.10086.cn"},
+		DenyPaths:  []string{"/index4/js"},
+	})
+	runDump(t, f, eventChan)
+	n := 0
+	for e := range eventChan {
+		if req, ok := e.(HTTPRequestEvent); ok {
+			n++
+			if host := hostHeader(req.Headers); host != "www.zj.10086.cn" {
+				t.Error("request to unexpected host:", host)
+			}
+		}
+	}
+	// the dump has 84 requests to www.zj.10086.cn
+	if n == 0 || n == 84 || f.FilterStats().Denied == 0 {
+		t.Error("unexpected result:", n, f.FilterStats())
+	}
+}
+
+func TestStreamFilterSample(t *testing.T) {
+	seqs := func() map[string]bool {
+		eventChan := make(chan Event, 1024)
+		f := NewFilteredHTTPStreamFactory(eventChan, StreamFilter{SampleRate: 0.5})
+		runDump(t, f, eventChan)
+		conns := make(map[string]bool)
+		for e := range eventChan {
+			if req, ok := e.(HTTPRequestEvent); ok {
+				conns[req.ClientAddr] = true
+			}
+		}
+		return conns
+	}
+	first, second := seqs(), seqs()
+	if len(first) == 0 || len(first) != len(second) {
+		t.Fatal("unexpected sampled connections:", len(first), len(second))
+	}
+	for c := range first {
+		if !second[c] {
+			t.Error("sampling is not deterministic:", c)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package ngnet
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// StreamStats counts the data parsed by the HTTPStreamFactory
+type StreamStats struct {
+	Bytes       uint64            // bytes reassembled from the TCP streams
+	ParseErrors map[string]uint64 // connections which stopped being parsed, by reason
+	DroppedDNS  uint64            // DNS events dropped because the event channel was full
+}
+
+// Reasons of the parse errors
+const (
+	ParseErrorTruncated     = "truncated"      // the stream ended in the middle of a message
+	ParseErrorRequestLine   = "request_line"   // bad HTTP request line
+	ParseErrorResponseLine  = "response_line"  // bad HTTP status line
+	ParseErrorHeader        = "header"         // bad header line
+	ParseErrorChunked       = "chunked"        // bad chunked encoding
+	ParseErrorContentLength = "content_length" // bad Content-Length header
+	ParseErrorOther         = "other"
+)
+
+type streamStats struct {
+	bytes  uint64 // accessed atomically, keep it 64-bit aligned
+	mutex  sync.Mutex
+	errors map[string]uint64
+}
+
+func newStreamStats() *streamStats {
+	s := new(streamStats)
+	s.errors = make(map[string]uint64)
+	return s
+}
+
+// parseError counts the value recovered from a panic of the parser
+func (s *streamStats) parseError(r interface{}) {
+	reason := ParseErrorOther
+	if e, ok := r.(*parseError); ok {
+		reason = e.reason
+	}
+	s.mutex.Lock()
+	s.errors[reason]++
+	s.mutex.Unlock()
+}
+
+func (s *streamStats) get() StreamStats {
+	var stats StreamStats
+	stats.Bytes = atomic.LoadUint64(&s.bytes)
+	stats.ParseErrors = make(map[string]uint64)
+	s.mutex.Lock()
+	for reason, n := range s.errors {
+		stats.ParseErrors[reason] = n
+	}
+	s.mutex.Unlock()
+	return stats
+}
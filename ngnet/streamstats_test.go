@@ -0,0 +1,30 @@
+package ngnet
+
+import (
+	"testing"
+)
+
+func TestStreamStats(t *testing.T) {
+	eventChan := make(chan Event, 1024)
+	f := NewHTTPStreamFactory(eventChan)
+	runDump(t, f, eventChan)
+	stats := f.Stats()
+	if stats.Bytes == 0 {
+		t.Error("no bytes counted")
+	}
+	// every connection of the dump is closed after a complete response
+	if len(stats.ParseErrors) != 0 {
+		t.Error("unexpected parse errors:", stats.ParseErrors)
+	}
+}
+
+func TestParseErrorReason(t *testing.T) {
+	s := newStreamStats()
+	func() {
+		defer func() { s.parseError(recover()) }()
+		getContentInfo([]HTTPHeaderItem{{Name: "Content-Length", Value: "x"}})
+	}()
+	if s.get().ParseErrors[ParseErrorContentLength] != 1 {
+		t.Error("bad parse errors:", s.get().ParseErrors)
+	}
+}
@@ -0,0 +1,296 @@
+// Package ngproc finds the local processes owning TCP connections, from the
+// socket tables /proc/net/tcp and /proc/net/tcp6 and the file descriptors
+// /proc/<pid>/fd of the processes. It works on Linux only.
+//
+// A connection is found by its local and remote addresses. The server end of
+// a connection accepted but not seen in the tables yet is attributed to the
+// process listening on the local port, if the address is one of the host's. The sockets of the processes in other
+// network namespaces, like most containers, are not in the tables of
+// netgraph's namespace: run netgraph in the namespace of the container, or
+// capture on the host the connections made by the host network.
+package ngproc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ga0/netgraph/ngnet"
+)
+
+// MinRescan is the default of Table.MinRescan
+const MinRescan = 100 * time.Millisecond
+
+// tcpListen is the state of a listening socket in /proc/net/tcp
+const tcpListen = "0A"
+
+// ErrUnsupported is returned by New on systems without /proc
+var ErrUnsupported = errors.New("finding the processes of the connections is supported on Linux only")
+
+// Table finds the processes owning the local TCP sockets. The owners of the
+// sockets are read again from the file descriptors of all the processes
+// when a new socket is looked up, at most every MinRescan. It is safe for
+// concurrent use.
+type Table struct {
+	MinRescan time.Duration
+
+	root      string // "/proc"
+	mutex     sync.Mutex
+	owners    map[uint64]int // socket inode -> pid
+	scanned   time.Time
+	processes map[int]*ngnet.Process
+	users     map[string]string // uid -> name
+
+	interfaceAddrs func() ([]net.Addr, error) // net.InterfaceAddrs
+	localIPs       map[string]bool
+	addrsRead      time.Time
+}
+
+func newTable(root string) *Table {
+	t := new(Table)
+	t.MinRescan = MinRescan
+	t.root = root
+	t.owners = make(map[uint64]int)
+	t.processes = make(map[int]*ngnet.Process)
+	t.users = make(map[string]string)
+	t.interfaceAddrs = net.InterfaceAddrs
+	return t
+}
+
+// isLocal tells whether ip is an address of the host. The addresses of the
+// interfaces are read again when an unknown one is looked up, at most every
+// MinRescan.
+func (t *Table) isLocal(ip net.IP) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.localIPs[ip.String()] {
+		return true
+	}
+	if t.localIPs != nil && time.Since(t.addrsRead) < t.MinRescan {
+		return false
+	}
+	t.localIPs = make(map[string]bool)
+	t.addrsRead = time.Now()
+	addrs, _ := t.interfaceAddrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			t.localIPs[n.IP.String()] = true
+		}
+	}
+	return t.localIPs[ip.String()]
+}
+
+// socket is an entry of /proc/net/tcp
+type socket struct {
+	local, remote *net.TCPAddr
+	state         string
+	inode         uint64
+}
+
+// parseAddr parses an address of /proc/net/tcp like "0100007F:0050", the IP
+// is made of 32-bit words in host byte order
+func parseAddr(s string) (*net.TCPAddr, error) {
+	p := strings.IndexByte(s, ':')
+	if p == -1 {
+		return nil, errors.New("bad address " + s)
+	}
+	raw, err := hex.DecodeString(s[:p])
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return nil, errors.New("bad address " + s)
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		binary.NativeEndian.PutUint32(ip[i:], binary.BigEndian.Uint32(raw[i:]))
+	}
+	port, err := strconv.ParseUint(s[p+1:], 16, 16)
+	if err != nil {
+		return nil, errors.New("bad address " + s)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readSockets reads the sockets of a table like /proc/net/tcp
+func readSockets(name string) ([]socket, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var sockets []socket
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		local, err1 := parseAddr(fields[1])
+		remote, err2 := parseAddr(fields[2])
+		inode, err3 := strconv.ParseUint(fields[9], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		sockets = append(sockets, socket{local, remote, fields[3], inode})
+	}
+	return sockets, scanner.Err()
+}
+
+// findSocket returns the inode of the socket connected from local to
+// remote, or of the socket listening on local, 0 if there is none. A socket
+// listening on all the addresses is used only if local is an address of the
+// host, not for the connections between other hosts seen on a mirror port.
+func (t *Table) findSocket(local, remote *net.TCPAddr) uint64 {
+	var listening uint64
+	for _, name := range []string{"net/tcp", "net/tcp6"} {
+		sockets, _ := readSockets(filepath.Join(t.root, name))
+		for _, s := range sockets {
+			if s.inode == 0 || s.local.Port != local.Port {
+				continue
+			}
+			if s.state == tcpListen {
+				if s.local.IP.Equal(local.IP) || (s.local.IP.IsUnspecified() && t.isLocal(local.IP)) {
+					listening = s.inode
+				}
+				continue
+			}
+			if s.local.IP.Equal(local.IP) && s.remote.IP.Equal(remote.IP) && s.remote.Port == remote.Port {
+				return s.inode
+			}
+		}
+	}
+	return listening
+}
+
+// scan reads the owners of the sockets from the file descriptors of the
+// processes, and forgets the processes which are gone
+func (t *Table) scan() {
+	owners := make(map[uint64]int)
+	dirs, _ := os.ReadDir(t.root)
+	for _, d := range dirs {
+		pid, err := strconv.Atoi(d.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join(t.root, d.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode, err := strconv.ParseUint(strings.TrimSuffix(link[len("socket:["):], "]"), 10, 64)
+			if err == nil {
+				owners[inode] = pid
+			}
+		}
+	}
+	alive := make(map[int]bool)
+	for _, pid := range owners {
+		alive[pid] = true
+	}
+	for pid := range t.processes {
+		if !alive[pid] {
+			delete(t.processes, pid)
+		}
+	}
+	t.owners = owners
+	t.scanned = time.Now()
+}
+
+// LookupProcess returns the process owning the socket with the local
+// address connected to the remote address, nil if it is not found
+func (t *Table) LookupProcess(local, remote *net.TCPAddr) *ngnet.Process {
+	inode := t.findSocket(local, remote)
+	if inode == 0 {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	pid, ok := t.owners[inode]
+	if !ok && time.Since(t.scanned) >= t.MinRescan {
+		t.scan()
+		pid, ok = t.owners[inode]
+	}
+	if !ok {
+		return nil
+	}
+	p := t.processes[pid]
+	if p == nil {
+		p = t.readProcess(pid)
+		t.processes[pid] = p
+	}
+	return p
+}
+
+// containerID finds a 64 hex digits container ID in a cgroup path, like
+// /docker/<id> or /system.slice/docker-<id>.scope
+var containerID = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// readProcess reads the description of a process
+func (t *Table) readProcess(pid int) *ngnet.Process {
+	dir := filepath.Join(t.root, strconv.Itoa(pid))
+	p := &ngnet.Process{PID: pid}
+	p.Exe, _ = os.Readlink(filepath.Join(dir, "exe"))
+	if cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+		p.Cmdline = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+	}
+	if status, err := os.ReadFile(filepath.Join(dir, "status")); err == nil {
+		for _, line := range strings.Split(string(status), "\n") {
+			if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "Uid:" {
+				p.User = t.userName(fields[1])
+				break
+			}
+		}
+	}
+	if cgroup, err := os.ReadFile(filepath.Join(dir, "cgroup")); err == nil {
+		p.Cgroup = cgroupPath(string(cgroup))
+		if ids := containerID.FindAllString(p.Cgroup, -1); len(ids) > 0 {
+			p.ContainerID = ids[len(ids)-1]
+		}
+	}
+	return p
+}
+
+// cgroupPath returns the path of the unified hierarchy in /proc/<pid>/cgroup,
+// or the first path of the other hierarchies which is not the root
+func cgroupPath(cgroup string) string {
+	path := ""
+	for _, line := range strings.Split(strings.TrimSpace(cgroup), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 || parts[2] == "/" {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			return parts[2]
+		}
+		if path == "" {
+			path = parts[2]
+		}
+	}
+	return path
+}
+
+func (t *Table) userName(uid string) string {
+	name, ok := t.users[uid]
+	if !ok {
+		name = uid
+		if u, err := user.LookupId(uid); err == nil {
+			name = u.Username
+		}
+		t.users[uid] = name
+	}
+	return name
+}
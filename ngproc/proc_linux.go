@@ -0,0 +1,11 @@
+package ngproc
+
+import "os"
+
+// New creates a Table of the processes of /proc
+func New() (*Table, error) {
+	if _, err := os.Stat("/proc/net/tcp"); err != nil {
+		return nil, err
+	}
+	return newTable("/proc"), nil
+}
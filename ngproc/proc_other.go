@@ -0,0 +1,8 @@
+//go:build !linux
+
+package ngproc
+
+// New returns ErrUnsupported, the processes are found in /proc on Linux only
+func New() (*Table, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,109 @@
+package ngproc
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const tcpTable = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 100 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:C350 0100007F:1F90 01 00000000:00000000 00:00000000 00000000  1000        0 200 1 0000000000000000 20 4 30 10 -1
+   2: 0100007F:C351 0100007F:1F90 06 00000000:00000000 03:00000000 00000000     0        0 0 3 0000000000000000
+`
+
+const tcp6Table = `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0000000000000000FFFF00000A00000A:D431 0000000000000000FFFF00000B00000A:0050 01 00000000:00000000 00:00000000 00000000  1000        0 300 1 0000000000000000 20 4 30 10 -1
+`
+
+func writeFile(t *testing.T, name, content string) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func addProcess(t *testing.T, root string, pid, exe, cmdline, cgroup string, sockets ...string) {
+	dir := filepath.Join(root, pid)
+	writeFile(t, filepath.Join(dir, "cmdline"), cmdline)
+	writeFile(t, filepath.Join(dir, "status"), "Name:\tx\nUid:\t4242\t4242\t4242\t4242\n")
+	writeFile(t, filepath.Join(dir, "cgroup"), cgroup)
+	if err := os.Symlink(exe, filepath.Join(dir, "exe")); err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(dir, "fd"), 0755)
+	for i, s := range sockets {
+		if err := os.Symlink("socket:["+s+"]", filepath.Join(dir, "fd", string(rune('3'+i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func addr(ip string, port int) *net.TCPAddr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+func TestLookupProcess(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "net", "tcp"), tcpTable)
+	writeFile(t, filepath.Join(root, "net", "tcp6"), tcp6Table)
+	id := "4f1c3a6b2e8d9f0a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f607182"
+	addProcess(t, root, "10", "/usr/sbin/nginx", "nginx\x00-g\x00daemon off;\x00",
+		"12:memory:/\n0::/system.slice/nginx.service\n", "100")
+	addProcess(t, root, "20", "/usr/bin/curl", "curl\x00http://127.0.0.1:8080/\x00",
+		"0::/system.slice/docker-"+id+".scope\n", "200", "300")
+	table := newTable(root)
+	table.interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)}}, nil
+	}
+
+	p := table.LookupProcess(addr("127.0.0.1", 50000), addr("127.0.0.1", 8080))
+	if p == nil || p.PID != 20 || p.Exe != "/usr/bin/curl" || p.Cmdline != "curl http://127.0.0.1:8080/" {
+		t.Fatalf("bad client process %+v", p)
+	}
+	if p.ContainerID != id || p.Cgroup != "/system.slice/docker-"+id+".scope" || p.User == "" {
+		t.Errorf("bad client process %+v", p)
+	}
+	// the server end is attributed to the listening process
+	p = table.LookupProcess(addr("127.0.0.1", 8080), addr("127.0.0.1", 50000))
+	if p == nil || p.PID != 10 || p.Cgroup != "/system.slice/nginx.service" || p.ContainerID != "" {
+		t.Errorf("bad server process %+v", p)
+	}
+	// IPv4 connection of an IPv6 socket
+	p = table.LookupProcess(addr("10.0.0.10", 54321), addr("10.0.0.11", 80))
+	if p == nil || p.PID != 20 {
+		t.Errorf("bad process of the IPv6 socket %+v", p)
+	}
+	// closed socket, and unknown one
+	if p := table.LookupProcess(addr("127.0.0.1", 50001), addr("127.0.0.1", 8080)); p != nil {
+		t.Errorf("closed socket should have no process %+v", p)
+	}
+	if p := table.LookupProcess(addr("10.0.0.1", 1234), addr("10.0.0.2", 80)); p != nil {
+		t.Errorf("remote socket should have no process %+v", p)
+	}
+	// connections between other hosts to the port of the local listener,
+	// and from a remote client whose source port is the same
+	if p := table.LookupProcess(addr("10.0.0.3", 8080), addr("10.0.0.4", 40000)); p != nil {
+		t.Errorf("foreign server should have no process %+v", p)
+	}
+	if p := table.LookupProcess(addr("10.0.0.5", 8080), addr("127.0.0.1", 80)); p != nil {
+		t.Errorf("remote client should have no process %+v", p)
+	}
+}
+
+func TestParseAddr(t *testing.T) {
+	a, err := parseAddr("0100007F:0050")
+	if err != nil || !a.IP.Equal(net.ParseIP("127.0.0.1")) || a.Port != 80 {
+		t.Errorf("bad address %v %v", a, err)
+	}
+	a, err = parseAddr("00000000000000000000000001000000:1F90")
+	if err != nil || !a.IP.Equal(net.ParseIP("::1")) || a.Port != 8080 {
+		t.Errorf("bad address %v %v", a, err)
+	}
+	if _, err := parseAddr("0100007F"); err == nil {
+		t.Error("bad address should be rejected")
+	}
+}
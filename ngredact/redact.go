@@ -0,0 +1,359 @@
+// Package ngredact removes secrets from the HTTP events before they are
+// written or sent anywhere. Headers, URL query parameters, form fields, JSON
+// keys and regular expression matches in bodies are masked, hashed or
+// dropped by rules. The built-in rules cover the common secrets, e.g. the
+// Authorization header and password fields.
+package ngredact
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ga0/netgraph/ngnet"
+)
+
+// Config is the JSON config file of the redaction, e.g.
+//
+//	{
+//	    "hash_key": "a secret shared by the netgraph instances",
+//	    "rules": [
+//	        {"header": "X-Session", "mode": "hash"},
+//	        {"json_path": "card.number", "mode": "drop"},
+//	        {"regex": "\\b\\d{3}-\\d{2}-\\d{4}\\b"}
+//	    ]
+//	}
+type Config struct {
+	Builtin      *bool  `json:"builtin,omitempty"`        // use the built-in rules, true if not set
+	HashKey      string `json:"hash_key,omitempty"`       // key of the hash mode, a random one if not set
+	AllowRawPcap bool   `json:"allow_raw_pcap,omitempty"` // allow writing packets which can't be redacted
+	Rules        []Rule `json:"rules,omitempty"`          // applied after the built-in rules, replacing those of the same name
+}
+
+// LoadConfig reads a config file
+func LoadConfig(name string) (*Config, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	c := new(Config)
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("bad redaction config %s: %v", name, err)
+	}
+	return c, nil
+}
+
+// Redactor redacts HTTP events
+type Redactor struct {
+	headers map[string]*compiledRule
+	query   map[string]*compiledRule
+	form    map[string]*compiledRule
+	json    []*compiledRule
+	regex   []*compiledRule
+}
+
+// New creates a Redactor. A nil config uses the built-in rules.
+func New(config *Config) (*Redactor, error) {
+	if config == nil {
+		config = new(Config)
+	}
+	hashKey := []byte(config.HashKey)
+	if len(hashKey) == 0 {
+		hashKey = make([]byte, 32)
+		if _, err := rand.Read(hashKey); err != nil {
+			return nil, err
+		}
+	}
+	var rules []Rule
+	if config.Builtin == nil || *config.Builtin {
+		rules = append(rules, builtinRules...)
+	}
+	rules = append(rules, config.Rules...)
+
+	r := new(Redactor)
+	r.headers = make(map[string]*compiledRule)
+	r.query = make(map[string]*compiledRule)
+	r.form = make(map[string]*compiledRule)
+	// index of the JSON and regex rules by path and pattern, to keep the
+	// order of the rules
+	jsonRules := make(map[string]int)
+	regexRules := make(map[string]int)
+	for _, rule := range rules {
+		c, err := compileRule(rule, hashKey)
+		if err != nil {
+			return nil, err
+		}
+		// a later rule of the same name replaces the former one
+		switch {
+		case c.header != "":
+			r.headers[c.header] = c
+		case c.query != "":
+			r.query[c.query] = c
+		case c.form != "":
+			r.form[c.form] = c
+		case c.jsonPath != nil:
+			r.json = replaceRule(r.json, jsonRules, strings.Join(c.jsonPath, "."), c)
+		default:
+			r.regex = replaceRule(r.regex, regexRules, c.regex.String(), c)
+		}
+	}
+	return r, nil
+}
+
+// replaceRule replaces the rule of the same name in rules, or appends it
+func replaceRule(rules []*compiledRule, index map[string]int, name string, c *compiledRule) []*compiledRule {
+	if i, ok := index[name]; ok {
+		rules[i] = c
+		return rules
+	}
+	index[name] = len(rules)
+	return append(rules, c)
+}
+
+// Redact returns the event with its secrets redacted. Events other than
+// HTTP requests, responses and transactions are returned as they are.
+func (r *Redactor) Redact(e ngnet.Event) ngnet.Event {
+	switch v := e.(type) {
+	case ngnet.HTTPRequestEvent:
+		v.URI = r.redactURL(v.URI)
+		v.Body = r.redactBody(v.Headers, v.Body)
+		v.Headers = r.redactHeaders(v.Headers)
+		return v
+	case ngnet.HTTPResponseEvent:
+		v.Body = r.redactBody(v.Headers, v.Body)
+		v.Headers = r.redactHeaders(v.Headers)
+		return v
+	case ngnet.TransactionEvent:
+		v.Request = r.Redact(v.Request).(ngnet.HTTPRequestEvent)
+		if v.Response != nil {
+			resp := r.Redact(*v.Response).(ngnet.HTTPResponseEvent)
+			v.Response = &resp
+		}
+		return v
+	}
+	return e
+}
+
+func (r *Redactor) redactHeaders(headers []ngnet.HTTPHeaderItem) []ngnet.HTTPHeaderItem {
+	var redacted []ngnet.HTTPHeaderItem
+	for _, h := range headers {
+		name := strings.ToLower(h.Name)
+		if c := r.headers[name]; c != nil {
+			if c.mode == ModeDrop {
+				continue
+			}
+			h.Value = c.value(h.Value)
+		} else if name == "referer" || name == "location" {
+			h.Value = r.redactURL(h.Value)
+		}
+		redacted = append(redacted, h)
+	}
+	return redacted
+}
+
+// redactParams redacts the parameters of a query string or form body
+func redactParams(s string, rules map[string]*compiledRule) string {
+	if len(rules) == 0 || s == "" {
+		return s
+	}
+	params := strings.Split(s, "&")
+	var redacted []string
+	changed := false
+	for _, p := range params {
+		k, v := p, ""
+		if i := strings.Index(p, "="); i != -1 {
+			k, v = p[:i], p[i+1:]
+		}
+		name, err := url.QueryUnescape(k)
+		if err != nil {
+			name = k
+		}
+		c := rules[strings.ToLower(name)]
+		if c == nil {
+			redacted = append(redacted, p)
+			continue
+		}
+		changed = true
+		if c.mode == ModeDrop {
+			continue
+		}
+		value, err := url.QueryUnescape(v)
+		if err != nil {
+			value = v
+		}
+		redacted = append(redacted, k+"="+url.QueryEscape(c.value(value)))
+	}
+	if !changed {
+		return s
+	}
+	return strings.Join(redacted, "&")
+}
+
+func (r *Redactor) redactURL(u string) string {
+	p := strings.Index(u, "?")
+	if p == -1 {
+		return u
+	}
+	query, fragment := u[p+1:], ""
+	if i := strings.Index(query, "#"); i != -1 {
+		query, fragment = query[:i], query[i:]
+	}
+	query = redactParams(query, r.query)
+	if query == "" {
+		return u[:p] + fragment
+	}
+	return u[:p] + "?" + query + fragment
+}
+
+func contentType(headers []ngnet.HTTPHeaderItem) string {
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, "Content-Type") {
+			return strings.ToLower(h.Value)
+		}
+	}
+	return ""
+}
+
+func (r *Redactor) redactBody(headers []ngnet.HTTPHeaderItem, body []byte) []byte {
+	if len(body) == 0 || !utf8.Valid(body) {
+		return body
+	}
+	ct := contentType(headers)
+	if strings.Contains(ct, "application/x-www-form-urlencoded") {
+		body = []byte(redactParams(string(body), r.form))
+	} else if strings.Contains(ct, "json") && len(r.json) > 0 {
+		body = r.redactJSONBody(body)
+	}
+	for _, c := range r.regex {
+		body = c.redactMatches(body)
+	}
+	return body
+}
+
+func (c *compiledRule) redactMatches(body []byte) []byte {
+	group := 0
+	if c.regex.NumSubexp() > 0 {
+		group = 1
+	}
+	matches := c.regex.FindAllSubmatchIndex(body, -1)
+	if matches == nil {
+		return body
+	}
+	var b bytes.Buffer
+	last := 0
+	for _, m := range matches {
+		start, end := m[2*group], m[2*group+1]
+		if start < 0 {
+			continue
+		}
+		b.Write(body[last:start])
+		b.WriteString(c.value(string(body[start:end])))
+		last = end
+	}
+	b.Write(body[last:])
+	return b.Bytes()
+}
+
+func (r *Redactor) redactJSONBody(body []byte) []byte {
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return body
+	}
+	changed := false
+	for _, c := range r.json {
+		var ok bool
+		if v, ok = c.redactJSON(v, c.jsonPath); ok {
+			changed = true
+		}
+	}
+	if !changed {
+		return body
+	}
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		return body
+	}
+	return bytes.TrimRight(b.Bytes(), "\n")
+}
+
+func (c *compiledRule) jsonValue(v interface{}) interface{} {
+	if c.mode != ModeHash {
+		return Masked
+	}
+	if s, ok := v.(string); ok {
+		return c.value(s)
+	}
+	data, _ := json.Marshal(v)
+	return c.value(string(data))
+}
+
+// redactJSON redacts the values selected by path, it returns the new value
+// of v and whether something is redacted
+func (c *compiledRule) redactJSON(v interface{}, path []string) (interface{}, bool) {
+	anyDepth := path[0] == ""
+	key := path[len(path)-1]
+	if !anyDepth {
+		key = path[0]
+	}
+	changed := false
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, child := range x {
+			if key == "*" || strings.ToLower(k) == key {
+				if anyDepth || len(path) == 1 {
+					if c.mode == ModeDrop {
+						delete(x, k)
+					} else {
+						x[k] = c.jsonValue(child)
+					}
+					changed = true
+					continue
+				}
+				var ok bool
+				if x[k], ok = c.redactJSON(child, path[1:]); ok {
+					changed = true
+				}
+			} else if anyDepth {
+				var ok bool
+				if x[k], ok = c.redactJSON(child, path); ok {
+					changed = true
+				}
+			}
+		}
+	case []interface{}:
+		if !anyDepth && key != "*" {
+			return v, false
+		}
+		var kept []interface{}
+		for _, child := range x {
+			if !anyDepth && len(path) == 1 {
+				changed = true
+				if c.mode != ModeDrop {
+					kept = append(kept, c.jsonValue(child))
+				}
+				continue
+			}
+			rest := path
+			if !anyDepth {
+				rest = path[1:]
+			}
+			child, ok := c.redactJSON(child, rest)
+			changed = changed || ok
+			kept = append(kept, child)
+		}
+		if kept == nil {
+			kept = []interface{}{}
+		}
+		return kept, changed
+	}
+	return v, changed
+}
@@ -0,0 +1,153 @@
+package ngredact
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ga0/netgraph/ngnet"
+)
+
+func header(headers []ngnet.HTTPHeaderItem, name string) (string, bool) {
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value, true
+		}
+	}
+	return "", false
+}
+
+func TestBuiltinRules(t *testing.T) {
+	r, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req ngnet.HTTPRequestEvent
+	req.URI = "/login?user=bob&access_token=abc%20def&x=1#top"
+	req.Headers = []ngnet.HTTPHeaderItem{
+		{Name: "Authorization", Value: "Bearer secret"},
+		{Name: "Cookie", Value: "session=123"},
+		{Name: "Content-Type", Value: "application/x-www-form-urlencoded"},
+		{Name: "Referer", Value: "http://example.com/?token=t"},
+	}
+	req.Body = []byte("user=bob&Password=hunter2")
+	out := r.Redact(req).(ngnet.HTTPRequestEvent)
+
+	if out.URI != "/login?user=bob&access_token=%5BREDACTED%5D&x=1#top" {
+		t.Error("bad URI:", out.URI)
+	}
+	if v, _ := header(out.Headers, "Authorization"); v != Masked {
+		t.Error("bad Authorization:", v)
+	}
+	if v, _ := header(out.Headers, "Cookie"); !strings.HasPrefix(v, "hash:") {
+		t.Error("bad Cookie:", v)
+	}
+	if v, _ := header(out.Headers, "Referer"); v != "http://example.com/?token=%5BREDACTED%5D" {
+		t.Error("bad Referer:", v)
+	}
+	if string(out.Body) != "user=bob&Password=%5BREDACTED%5D" {
+		t.Error("bad body:", string(out.Body))
+	}
+	// the original event is not changed
+	if req.Headers[0].Value != "Bearer secret" {
+		t.Error("original event changed")
+	}
+
+	// the request and the response of a transaction
+	tr := ngnet.NewTransactionEvent(req)
+	tr.Response = &ngnet.HTTPResponseEvent{Headers: []ngnet.HTTPHeaderItem{{Name: "Set-Cookie", Value: "session=123"}}}
+	redacted := r.Redact(*tr).(ngnet.TransactionEvent)
+	if v, _ := header(redacted.Request.Headers, "Authorization"); v != Masked {
+		t.Error("bad Authorization of transaction:", v)
+	}
+	if v, _ := header(redacted.Response.Headers, "Set-Cookie"); !strings.HasPrefix(v, "hash:") || tr.Response.Headers[0].Value != "session=123" {
+		t.Error("bad Set-Cookie of transaction:", v)
+	}
+}
+
+func TestHashIsStable(t *testing.T) {
+	r, err := New(&Config{HashKey: "k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := func(cookie string) string {
+		var resp ngnet.HTTPResponseEvent
+		resp.Headers = []ngnet.HTTPHeaderItem{{Name: "Set-Cookie", Value: cookie}}
+		v, _ := header(r.Redact(resp).(ngnet.HTTPResponseEvent).Headers, "Set-Cookie")
+		return v
+	}
+	if hash("a=1") != hash("a=1") || hash("a=1") == hash("a=2") {
+		t.Error("hash should show equality only")
+	}
+}
+
+func TestUserRules(t *testing.T) {
+	builtin := false
+	r, err := New(&Config{
+		Builtin: &builtin,
+		Rules: []Rule{
+			{Header: "x-session", Mode: ModeDrop},
+			{JSONPath: "user.password", Mode: ModeDrop},
+			{JSONPath: "cards[*].number"},
+			{JSONPath: "..ssn", Mode: ModeHash},
+			{Regex: `secret=(\w+)`},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp ngnet.HTTPResponseEvent
+	resp.Headers = []ngnet.HTTPHeaderItem{
+		{Name: "Content-Type", Value: "application/json; charset=utf-8"},
+		{Name: "X-Session", Value: "s"},
+		{Name: "Authorization", Value: "kept"},
+	}
+	resp.Body = []byte(`{"user":{"name":"<bob>","password":"p"},"cards":[{"number":1234}],"people":[{"SSN":"1"}],"note":"secret=xyz"}`)
+	out := r.Redact(resp).(ngnet.HTTPResponseEvent)
+
+	if _, ok := header(out.Headers, "X-Session"); ok {
+		t.Error("X-Session is not dropped")
+	}
+	if v, _ := header(out.Headers, "Authorization"); v != "kept" {
+		t.Error("built-in rules are used:", v)
+	}
+	body := string(out.Body)
+	for _, s := range []string{`"name":"<bob>"`, `"number":"[REDACTED]"`, `"SSN":"hash:`, `secret=[REDACTED]`} {
+		if !strings.Contains(body, s) {
+			t.Errorf("body %s should contain %s", body, s)
+		}
+	}
+	if strings.Contains(body, "password") {
+		t.Error("password is not dropped:", body)
+	}
+}
+
+func TestUserRuleReplacesBuiltin(t *testing.T) {
+	r, err := New(&Config{HashKey: "k", Rules: []Rule{{JSONPath: "$..Password", Mode: ModeHash}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := func(password string) string {
+		var req ngnet.HTTPRequestEvent
+		req.Headers = []ngnet.HTTPHeaderItem{{Name: "Content-Type", Value: "application/json"}}
+		req.Body = []byte(`{"password":"` + password + `"}`)
+		return string(r.Redact(req).(ngnet.HTTPRequestEvent).Body)
+	}
+	if !strings.Contains(hash("one"), "hash:") || hash("one") == hash("two") {
+		t.Errorf("the built-in mask is used: %s %s", hash("one"), hash("two"))
+	}
+}
+
+func TestBadRules(t *testing.T) {
+	for _, rule := range []Rule{
+		{},
+		{Header: "a", Query: "b"},
+		{Header: "a", Mode: "erase"},
+		{Regex: "("},
+		{JSONPath: "a..b"},
+		{JSONPath: "..a.b"},
+	} {
+		if _, err := New(&Config{Rules: []Rule{rule}}); err == nil {
+			t.Errorf("rule %+v should be rejected", rule)
+		}
+	}
+}
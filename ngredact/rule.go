@@ -0,0 +1,163 @@
+package ngredact
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Modes of the rules
+const (
+	ModeMask = "mask" // replace the value with Masked
+	ModeHash = "hash" // replace the value with a keyed hash of it, equal values get equal hashes
+	ModeDrop = "drop" // remove the header, parameter, JSON key or matched text
+)
+
+// Masked replaces the values redacted in mask mode
+const Masked = "[REDACTED]"
+
+// Rule selects the data to redact with exactly one of Header, Query, Form,
+// JSONPath or Regex. Names are case-insensitive.
+type Rule struct {
+	Header   string `json:"header,omitempty"`    // request or response header
+	Query    string `json:"query,omitempty"`     // URL query parameter
+	Form     string `json:"form,omitempty"`      // parameter of an application/x-www-form-urlencoded body
+	JSONPath string `json:"json_path,omitempty"` // like "user.password", "items[*].card" or "..password" for any depth
+	Regex    string `json:"regex,omitempty"`     // text of the bodies, only the first group if the regex has groups
+	Mode     string `json:"mode,omitempty"`      // mask (default), hash or drop
+}
+
+func (r Rule) String() string {
+	switch {
+	case r.Header != "":
+		return "header " + r.Header
+	case r.Query != "":
+		return "query " + r.Query
+	case r.Form != "":
+		return "form " + r.Form
+	case r.JSONPath != "":
+		return "json_path " + r.JSONPath
+	}
+	return "regex " + r.Regex
+}
+
+// builtinRules redact the common secrets
+var builtinRules = func() []Rule {
+	rules := []Rule{
+		{Header: "Authorization"},
+		{Header: "Proxy-Authorization"},
+		{Header: "Cookie", Mode: ModeHash},
+		{Header: "Set-Cookie", Mode: ModeHash},
+		{Header: "X-Api-Key"},
+		{Header: "X-Auth-Token"},
+		{Regex: `AKIA[0-9A-Z]{16}`},
+		{Regex: `-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`},
+	}
+	for _, name := range []string{
+		"password", "passwd", "pwd", "secret", "token", "access_token",
+		"refresh_token", "id_token", "api_key", "apikey", "client_secret",
+	} {
+		rules = append(rules, Rule{Query: name}, Rule{Form: name}, Rule{JSONPath: ".." + name})
+	}
+	return rules
+}()
+
+// BuiltinRules returns the rules used unless the config disables them
+func BuiltinRules() []Rule {
+	return append([]Rule(nil), builtinRules...)
+}
+
+// redaction applies a mode to values
+type redaction struct {
+	mode    string
+	hashKey []byte
+}
+
+func (r redaction) value(v string) string {
+	if r.mode == ModeHash {
+		mac := hmac.New(sha256.New, r.hashKey)
+		mac.Write([]byte(v))
+		return "hash:" + hex.EncodeToString(mac.Sum(nil))[:16]
+	}
+	if r.mode == ModeDrop {
+		return ""
+	}
+	return Masked
+}
+
+type compiledRule struct {
+	redaction
+	header   string
+	query    string
+	form     string
+	jsonPath []string // "*" matches any key or element, a first "" matches any depth
+	regex    *regexp.Regexp
+}
+
+func parseJSONPath(p string) ([]string, error) {
+	p = strings.TrimPrefix(p, "$")
+	if strings.HasPrefix(p, "..") {
+		name := p[2:]
+		if name == "" || strings.ContainsAny(name, ".[]") {
+			return nil, fmt.Errorf("bad json_path %q, use ..name for a key at any depth", p)
+		}
+		return []string{"", strings.ToLower(name)}, nil
+	}
+	p = strings.TrimPrefix(p, ".")
+	p = strings.Replace(p, "[*]", ".*", -1)
+	var path []string
+	for _, k := range strings.Split(p, ".") {
+		if k == "" {
+			return nil, fmt.Errorf("bad json_path %q", p)
+		}
+		path = append(path, strings.ToLower(k))
+	}
+	return path, nil
+}
+
+func compileRule(r Rule, hashKey []byte) (*compiledRule, error) {
+	c := new(compiledRule)
+	c.mode = r.Mode
+	c.hashKey = hashKey
+	switch c.mode {
+	case "":
+		c.mode = ModeMask
+	case ModeMask, ModeHash, ModeDrop:
+	default:
+		return nil, fmt.Errorf("rule %v: unknown mode %q", r, r.Mode)
+	}
+	n := 0
+	if r.Header != "" {
+		c.header = strings.ToLower(r.Header)
+		n++
+	}
+	if r.Query != "" {
+		c.query = strings.ToLower(r.Query)
+		n++
+	}
+	if r.Form != "" {
+		c.form = strings.ToLower(r.Form)
+		n++
+	}
+	if r.JSONPath != "" {
+		var err error
+		if c.jsonPath, err = parseJSONPath(r.JSONPath); err != nil {
+			return nil, err
+		}
+		n++
+	}
+	if r.Regex != "" {
+		var err error
+		if c.regex, err = regexp.Compile(r.Regex); err != nil {
+			return nil, fmt.Errorf("rule %v: %v", r, err)
+		}
+		n++
+	}
+	if n != 1 {
+		return nil, fmt.Errorf("rule %+v must set exactly one of header, query, form, json_path and regex", r)
+	}
+	return c, nil
+}
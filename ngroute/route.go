@@ -0,0 +1,195 @@
+// Package ngroute groups the URL paths of HTTP requests into route templates,
+// e.g. "/users/81723/orders/3f2b8c1e-7a4d-4c2e-9b1a-0d5e6f7a8b9c" is
+// "/users/{id}/orders/{uuid}".
+//
+// A segment is replaced by a placeholder if it looks like an id: {id} for
+// numbers, {uuid} for UUIDs and {hex} for long hex strings. The other
+// segments are learned from the paths seen so far: when more than
+// MaxLiterals different values follow the same route prefix, the segment is
+// a parameter and is replaced by {param}. Patterns given by the user, like
+// "/repos/{owner}/{repo}", take precedence over the learned routes.
+package ngroute
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Placeholders of the segments
+const (
+	ID    = "{id}"
+	UUID  = "{uuid}"
+	Hex   = "{hex}"
+	Param = "{param}"
+)
+
+// DefaultMaxLiterals is the default of Router.MaxLiterals
+const DefaultMaxLiterals = 50
+
+// maxNodes limits the memory used to learn the routes. Once it is reached,
+// the segments never seen before are replaced by {param}.
+const maxNodes = 100000
+
+var (
+	numberSegment = regexp.MustCompile(`^[0-9]+$`)
+	uuidSegment   = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexSegment    = regexp.MustCompile(`^[0-9a-fA-F]*[0-9][0-9a-fA-F]*$`)
+)
+
+// classify returns the placeholder of a segment which looks like an id, or
+// "" if it does not. An extension is kept, "123.jpg" is "{id}.jpg".
+func classify(segment string) string {
+	stem, ext := segment, ""
+	if p := strings.LastIndexByte(segment, '.'); p > 0 {
+		stem, ext = segment[:p], segment[p:]
+	}
+	switch {
+	case numberSegment.MatchString(stem):
+		return ID + ext
+	case uuidSegment.MatchString(stem):
+		return UUID + ext
+	case len(stem) >= 16 && hexSegment.MatchString(stem):
+		return Hex + ext
+	}
+	return ""
+}
+
+type node struct {
+	literals map[string]*node // nil once the segment is a parameter
+	typed    map[string]*node // children of the placeholders
+	param    *node
+}
+
+func newNode() *node {
+	return &node{literals: make(map[string]*node), typed: make(map[string]*node)}
+}
+
+type pattern struct {
+	text     string
+	segments []string // "" matches any segment
+	rest     bool     // the last segment "*" matches the rest of the path
+}
+
+func parsePattern(text string) (*pattern, error) {
+	if !strings.HasPrefix(text, "/") {
+		return nil, fmt.Errorf("route pattern %q must start with /", text)
+	}
+	p := &pattern{text: text}
+	segments := strings.Split(text[1:], "/")
+	for i, s := range segments {
+		switch {
+		case s == "*" && i == len(segments)-1:
+			p.rest = true
+			continue
+		case strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}"):
+			s = ""
+		case strings.ContainsAny(s, "{}*"):
+			return nil, fmt.Errorf("bad segment %q of route pattern %q", s, text)
+		}
+		p.segments = append(p.segments, s)
+	}
+	return p, nil
+}
+
+func (p *pattern) match(segments []string) bool {
+	if p.rest {
+		if len(segments) <= len(p.segments) {
+			return false
+		}
+	} else if len(segments) != len(p.segments) {
+		return false
+	}
+	for i, s := range p.segments {
+		if s != "" && s != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Router returns the route templates of the paths. It is safe for
+// concurrent use.
+type Router struct {
+	MaxLiterals int // different values of a segment before it is a parameter
+
+	patterns []*pattern
+	mutex    sync.Mutex
+	root     *node
+	nodes    int
+}
+
+// New creates a Router with the patterns of the user. In a pattern, a
+// segment "{name}" matches any segment, and a last segment "*" matches the
+// rest of the path. The first matching pattern is the route.
+func New(patterns []string) (*Router, error) {
+	r := new(Router)
+	r.MaxLiterals = DefaultMaxLiterals
+	r.root = newNode()
+	for _, text := range patterns {
+		p, err := parsePattern(text)
+		if err != nil {
+			return nil, err
+		}
+		r.patterns = append(r.patterns, p)
+	}
+	return r, nil
+}
+
+// Route returns the route template of the path of uri, the query is ignored
+func (r *Router) Route(uri string) string {
+	if p := strings.IndexAny(uri, "?#"); p != -1 {
+		uri = uri[:p]
+	}
+	if !strings.HasPrefix(uri, "/") {
+		// "*" of OPTIONS, or the authority of CONNECT
+		return uri
+	}
+	segments := strings.Split(uri[1:], "/")
+	for _, p := range r.patterns {
+		if p.match(segments) {
+			return p.text
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	n := r.root
+	for i, s := range segments {
+		if t := classify(s); t != "" {
+			segments[i] = t
+			n = r.child(n.typed, t)
+			continue
+		}
+		if n.literals != nil {
+			if c := n.literals[s]; c != nil {
+				n = c
+				continue
+			}
+			if len(n.literals) >= r.MaxLiterals {
+				// too many values, the segment is a parameter
+				n.literals = nil
+			} else if r.nodes < maxNodes {
+				n = r.child(n.literals, s)
+				continue
+			}
+		}
+		if n.param == nil {
+			n.param = newNode()
+		}
+		segments[i] = Param
+		n = n.param
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+func (r *Router) child(children map[string]*node, key string) *node {
+	c := children[key]
+	if c == nil {
+		c = newNode()
+		children[key] = c
+		r.nodes++
+	}
+	return c
+}
@@ -0,0 +1,80 @@
+package ngroute
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	r, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		uri, route string
+	}{
+		{"/users/81723/orders/3f2b8c1e-7a4d-4c2e-9b1a-0d5e6f7a8b9c?x=1", "/users/{id}/orders/{uuid}"},
+		{"/_upload/1426666665941.jpg", "/_upload/{id}.jpg"},
+		{"/commits/9fceb02d0ae598e95dc970b74767f19372d61af8", "/commits/{hex}"},
+		{"/static/app.js#top", "/static/app.js"},
+		{"/", "/"},
+		{"/v2/", "/v2/"},
+		{"*", "*"},
+	}
+	for _, c := range cases {
+		if route := r.Route(c.uri); route != c.route {
+			t.Errorf("route of %s is %s, should be %s", c.uri, route, c.route)
+		}
+	}
+}
+
+func TestHighCardinality(t *testing.T) {
+	r, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.MaxLiterals = 3
+	for _, name := range []string{"alice", "bob", "carol"} {
+		if route := r.Route("/users/" + name + "/repos"); route != "/users/"+name+"/repos" {
+			t.Error("bad route:", route)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		uri := fmt.Sprintf("/users/user-%c/repos", 'a'+i)
+		if route := r.Route(uri); route != "/users/{param}/repos" {
+			t.Error("bad route:", route)
+		}
+	}
+	// the values learned before are parameters too once there are too many
+	if route := r.Route("/users/alice/repos"); route != "/users/{param}/repos" {
+		t.Error("bad route:", route)
+	}
+	if route := r.Route("/static/a.css"); route != "/static/a.css" {
+		t.Error("bad route:", route)
+	}
+}
+
+func TestPatterns(t *testing.T) {
+	r, err := New([]string{"/repos/{owner}/{repo}", "/files/*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		uri, route string
+	}{
+		{"/repos/ga0/netgraph?tab=1", "/repos/{owner}/{repo}"},
+		{"/repos/ga0/netgraph/issues/12", "/repos/ga0/netgraph/issues/{id}"},
+		{"/files/a/b/c.txt", "/files/*"},
+		{"/files", "/files"},
+	}
+	for _, c := range cases {
+		if route := r.Route(c.uri); route != c.route {
+			t.Errorf("route of %s is %s, should be %s", c.uri, route, c.route)
+		}
+	}
+	for _, bad := range []string{"repos", "/a/{b", "/a/*/b"} {
+		if _, err := New([]string{bad}); err == nil {
+			t.Errorf("pattern %q should be rejected", bad)
+		}
+	}
+}
@@ -8,21 +8,61 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/ga0/netgraph/ngfilter"
+	"github.com/ga0/netgraph/nggraph"
+	"github.com/ga0/netgraph/ngnet"
+	"github.com/ga0/netgraph/ngstats"
+	"github.com/ga0/netgraph/ngstore"
 	"github.com/ga0/netgraph/web"
 	"golang.org/x/net/websocket"
 )
 
 // NGClient is the websocket client
 type NGClient struct {
+	dropped   uint64 // accessed atomically, keep it 64-bit aligned
+	missed    uint64 // live events not sent while paused, accessed atomically
+	reported  uint64
+	paused    int32 // accessed atomically
 	eventChan chan interface{}
+	syncChan  chan interface{}
+	replyChan chan []interface{}
+	closed    chan struct{}
+	closeOnce sync.Once
 	server    *NGServer
 	ws        *websocket.Conn
+
+	filterMutex sync.Mutex
+	filter      *ngfilter.Filter // nil means all events
+	liveFilter  *eventFilter
+}
+
+// closingEvent is the last message sent to the clients before the server stops
+type closingEvent struct {
+	Type   string
+	Reason string
+}
+
+// droppedEvent tells the client how many events were dropped because it was too slow
+type droppedEvent struct {
+	Type  string
+	Count uint64
+}
+
+// filterErrorEvent tells the client why its filter expression was rejected
+type filterErrorEvent struct {
+	Type  string
+	Error string
 }
 
 func (c *NGClient) recvAndProcessCommand() {
@@ -32,27 +72,171 @@ func (c *NGClient) recvAndProcessCommand() {
 		if err != nil {
 			return
 		}
-		if len(msg) > 0 {
-			if msg == "sync" {
-				c.server.sync(c)
-			}
+		msg = strings.TrimSpace(msg)
+		if strings.HasPrefix(msg, "{") {
+			c.processJSONCommand(msg)
+		} else if msg == "sync" {
+			c.server.sync(c)
+		} else if msg == "filter" || strings.HasPrefix(msg, "filter ") {
+			c.processFilterCommand(strings.TrimSpace(strings.TrimPrefix(msg, "filter")))
+		} else if msg == "" {
+			c.reply(newErrorReply(nil, "empty command"))
 		} else {
-			panic("empty command")
+			c.reply(newErrorReply(nil, fmt.Sprintf("unknown command %q", msg)))
 		}
 	}
 }
 
+// processFilterCommand handles "filter <expression>", which makes the server
+// send only the events of the transactions matching the expression.
+// "filter" alone removes the filter.
+func (c *NGClient) processFilterCommand(expr string) {
+	var f *ngfilter.Filter
+	if expr != "" {
+		var err error
+		f, err = ngfilter.Parse(expr)
+		if err != nil {
+			c.reply(filterErrorEvent{"FilterError", err.Error()})
+			return
+		}
+	}
+	c.setFilter(f)
+}
+
+func (c *NGClient) setFilter(f *ngfilter.Filter) {
+	c.filterMutex.Lock()
+	defer c.filterMutex.Unlock()
+	c.filter = f
+	c.liveFilter = nil
+	if f != nil {
+		c.liveFilter = newEventFilter(f)
+	}
+}
+
+func (c *NGClient) currentFilter() *ngfilter.Filter {
+	c.filterMutex.Lock()
+	defer c.filterMutex.Unlock()
+	return c.filter
+}
+
+func (c *NGClient) send(ev interface{}) {
+	json, err := json.Marshal(ev)
+	if err == nil {
+		websocket.Message.Send(c.ws, string(json))
+	}
+}
+
 func (c *NGClient) transmitEvents() {
-	for ev := range c.eventChan {
-		json, err := json.Marshal(ev)
-		if err == nil {
-			websocket.Message.Send(c.ws, string(json))
+	for {
+		select {
+		case <-c.closed:
+			return
+		case ev := <-c.eventChan:
+			c.send(ev)
+		case ev := <-c.syncChan:
+			if closing, ok := ev.(closingEvent); ok {
+				c.sendQueued()
+				c.send(closing)
+				c.ws.Close()
+				c.close()
+				return
+			}
+			c.send(ev)
+		}
+		if dropped := atomic.LoadUint64(&c.dropped); dropped != c.reported {
+			c.reported = dropped
+			c.send(droppedEvent{"Dropped", dropped})
+		}
+	}
+}
+
+// sendQueued sends the events in the queue of the client
+func (c *NGClient) sendQueued() {
+	for {
+		select {
+		case ev := <-c.eventChan:
+			c.send(ev)
+		default:
+			return
+		}
+	}
+}
+
+/*
+   push never blocks, so a slow client cannot stall the other clients or the capture.
+   If the queue of the client is full, the event is dropped, or the client is
+   disconnected if the server is configured so.
+*/
+func (c *NGClient) push(e ngnet.Event) {
+	events := []ngnet.Event{e}
+	c.filterMutex.Lock()
+	if c.liveFilter != nil {
+		events = c.liveFilter.push(e)
+	}
+	c.filterMutex.Unlock()
+	if atomic.LoadInt32(&c.paused) != 0 {
+		atomic.AddUint64(&c.missed, uint64(len(events)))
+		return
+	}
+	for _, ev := range events {
+		c.enqueue(ev)
+	}
+}
+
+func (c *NGClient) enqueue(e interface{}) {
+	select {
+	case <-c.closed:
+	case c.eventChan <- e:
+	default:
+		if c.server.disconnectSlowClient {
+			log.Println("websocket client is too slow, disconnect", c.ws.Request().RemoteAddr)
+			c.close()
+		} else {
+			atomic.AddUint64(&c.dropped, 1)
+		}
+	}
+}
+
+// streamEvents sends the events to the client without blocking live events
+func (c *NGClient) streamEvents(events []interface{}) {
+	for _, ev := range events {
+		select {
+		case <-c.closed:
+			return
+		case c.syncChan <- ev:
+		}
+	}
+}
+
+// reply sends the events to the client in the order of the calls, after the
+// events of the previous replies
+func (c *NGClient) reply(events ...interface{}) {
+	select {
+	case <-c.closed:
+	case c.replyChan <- events:
+	}
+}
+
+func (c *NGClient) transmitReplies() {
+	for {
+		select {
+		case <-c.closed:
+			return
+		case events := <-c.replyChan:
+			c.streamEvents(events)
 		}
 	}
 }
 
+// close stops the goroutines of the client. It may be called with the lock
+// of the server: instead of ws.Close, which waits for the write in progress,
+// the deadline of the connection fails the writes and the reads, and the
+// connection is closed when the handler returns.
 func (c *NGClient) close() {
-	close(c.eventChan)
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.ws.SetDeadline(time.Now())
+	})
 }
 
 // NewNGClient creates NGClient
@@ -60,7 +244,10 @@ func NewNGClient(ws *websocket.Conn, server *NGServer) *NGClient {
 	c := new(NGClient)
 	c.server = server
 	c.ws = ws
-	c.eventChan = make(chan interface{}, 16)
+	c.eventChan = make(chan interface{}, server.clientQueueSize)
+	c.syncChan = make(chan interface{})
+	c.replyChan = make(chan []interface{}, 16)
+	c.closed = make(chan struct{})
 	return c
 }
 
@@ -70,8 +257,15 @@ type NGServer struct {
 	staticFileDir        string
 	connectedClient      map[*websocket.Conn]*NGClient
 	connectedClientMutex *sync.Mutex
-	eventBuffer          []interface{}
-	saveEvent            bool
+	store                ngstore.Store
+	clientQueueSize      int
+	disconnectSlowClient bool
+	security             *serverSecurity
+	mux                  *http.ServeMux
+	server               *http.Server
+	metrics              *httpMetrics
+	endpoints            *ngstats.Aggregator
+	graph                *nggraph.Graph
 	wg                   sync.WaitGroup
 }
 
@@ -83,26 +277,60 @@ func (s *NGServer) websocketHandler(ws *websocket.Conn) {
 	s.connectedClientMutex.Unlock()
 
 	go c.transmitEvents()
+	go c.transmitReplies()
 	c.recvAndProcessCommand()
-	c.close()
 
 	s.connectedClientMutex.Lock()
 	delete(s.connectedClient, ws)
 	s.connectedClientMutex.Unlock()
+	c.close()
 }
 
 // PushEvent dispatches the event received from ngnet to all clients connected with websocket.
-func (s *NGServer) PushEvent(e interface{}) {
-	if s.saveEvent {
-		s.eventBuffer = append(s.eventBuffer, e)
+// The transactions are counted, the clients get their requests and responses.
+func (s *NGServer) PushEvent(e ngnet.Event) {
+	if t, ok := e.(ngnet.TransactionEvent); ok {
+		s.countTransaction(&t)
+		return
+	}
+	if s.store != nil && !isDNSEvent(e) {
+		s.store.Add(e)
 	}
 	s.connectedClientMutex.Lock()
 	for _, c := range s.connectedClient {
-		c.eventChan <- e
+		c.push(e)
 	}
 	s.connectedClientMutex.Unlock()
 }
 
+// countTransaction updates the metrics, the statistics of the endpoints and
+// the dependency graph with a completed transaction
+func (s *NGServer) countTransaction(t *httpTransaction) {
+	if t.Response == nil {
+		return
+	}
+	s.metrics.observe(t)
+	s.endpoints.Add(ngstats.Transaction{
+		Host:     requestHost(t.Request),
+		Route:    t.Request.Route,
+		Start:    t.Request.Start,
+		Status:   t.Response.Code,
+		Duration: transactionDuration(t),
+		BytesIn:  len(t.Request.Body),
+		BytesOut: len(t.Response.Body),
+	})
+	s.graph.Add(nggraph.Transaction{
+		ClientAddr: t.Request.ClientAddr,
+		ServerAddr: t.Request.ServerAddr,
+		Host:       headerValue(t.Request.Headers, "Host"),
+		ClientName: t.Request.ClientName,
+		ServerName: t.Request.ServerName,
+		Start:      t.Request.Start,
+		Status:     t.Response.Code,
+		Duration:   transactionDuration(t),
+	})
+}
+
 // Wait waits for serving
 func (s *NGServer) Wait() {
 	s.wg.Wait()
@@ -110,12 +338,83 @@ func (s *NGServer) Wait() {
 
 /*
    If the flag '-s' is set and the browser sent a 'sync' command,
-   the NGServer will push all the http message buffered in eventBuffer to
+   the NGServer will push all the http message saved in store to
    the client.
 */
 func (s *NGServer) sync(c *NGClient) {
-	for _, ev := range s.eventBuffer {
-		c.eventChan <- ev
+	if s.store == nil {
+		return
+	}
+	events := s.savedEvents(c.currentFilter(), time.Time{}, 0)
+	c.reply(append(messages(events), newStoreStatsEvent(s.store.Stats()))...)
+}
+
+// savedEvents returns the saved events passing the filter f (all if nil),
+// from since on (all if zero), and only the newest limit events if limit is
+// not 0.
+func (s *NGServer) savedEvents(f *ngfilter.Filter, since time.Time, limit int) []ngnet.Event {
+	var events []ngnet.Event
+	if since.IsZero() {
+		events = s.store.Events()
+	} else {
+		events = s.store.Since(since)
+	}
+	if f != nil {
+		events = filterEvents(f, events)
+	}
+	if limit > 0 && len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	return events
+}
+
+// messages converts events to messages for NGClient.reply
+func messages(events []ngnet.Event) []interface{} {
+	m := make([]interface{}, len(events), len(events)+2)
+	for i, e := range events {
+		m[i] = e
+	}
+	return m
+}
+
+// storeStatsEvent tells the clients how many events are saved and evicted
+type storeStatsEvent struct {
+	Type string
+	ngstore.Stats
+}
+
+func newStoreStatsEvent(stats ngstore.Stats) storeStatsEvent {
+	return storeStatsEvent{"StoreStats", stats}
+}
+
+func (s *NGServer) broadcastStoreStats() {
+	var last ngstore.Stats
+	for range time.Tick(5 * time.Second) {
+		stats := s.store.Stats()
+		if stats == last {
+			continue
+		}
+		last = stats
+		s.connectedClientMutex.Lock()
+		for _, c := range s.connectedClient {
+			c.enqueue(newStoreStatsEvent(stats))
+		}
+		s.connectedClientMutex.Unlock()
+	}
+}
+
+/*
+   Export the http message saved in store as a HAR document.
+*/
+func (s *NGServer) handleExportHAR(w http.ResponseWriter, r *http.Request) {
+	if s.store == nil {
+		http.Error(w, "events are not saved, run netgraph with option -s", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="netgraph.har"`)
+	if err := writeHAR(w, pairEvents(s.store.Events())); err != nil {
+		log.Println("Cannot write HAR:", err)
 	}
 }
 
@@ -123,13 +422,13 @@ func (s *NGServer) sync(c *NGClient) {
    Handle static files (.html, .js, .css).
 */
 func (s *NGServer) handleStaticFile(w http.ResponseWriter, r *http.Request) {
-	uri := r.RequestURI
+	uri := r.URL.Path
 	if uri == "/" {
 		uri = "/index.html"
 	}
 	c, err := web.GetContent(uri)
 	if err != nil {
-		log.Println(r.RequestURI)
+		log.Println(r.URL.Path)
 		http.NotFound(w, r)
 		return
 	}
@@ -138,15 +437,65 @@ func (s *NGServer) handleStaticFile(w http.ResponseWriter, r *http.Request) {
 
 func (s *NGServer) listenAndServe() {
 	defer s.wg.Done()
-	err := http.ListenAndServe(s.addr, nil)
-	if err != nil {
+	var err error
+	if s.server.TLSConfig != nil {
+		err = s.server.ListenAndServeTLS("", "")
+	} else {
+		err = s.server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalln(err)
 	}
 }
 
+// Close tells the websocket clients the reason, stops the web server and
+// closes the store. The clients and the requests in progress are given the
+// timeout to finish. Wait returns once it is stopped.
+func (s *NGServer) Close(reason string, timeout time.Duration) {
+	s.connectedClientMutex.Lock()
+	var clients []*NGClient
+	for _, c := range s.connectedClient {
+		clients = append(clients, c)
+	}
+	s.connectedClientMutex.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for _, c := range clients {
+		go c.reply(closingEvent{"Closing", reason})
+	}
+	for _, c := range clients {
+		select {
+		case <-c.closed:
+		case <-time.After(time.Until(deadline)):
+			c.close()
+		}
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		s.server.Close()
+	}
+	if s.store != nil {
+		if err := s.store.Close(); err != nil {
+			log.Println("Cannot close store:", err)
+		}
+	}
+}
+
 // Serve the web page
 func (s *NGServer) Serve() {
-	http.Handle("/data", websocket.Handler(s.websocketHandler))
+	s.mux.Handle("/data", websocket.Server{
+		Handler:   s.websocketHandler,
+		Handshake: s.security.checkOrigin,
+	})
+	s.mux.HandleFunc("/export.har", s.handleExportHAR)
+	s.mux.HandleFunc("/api/transactions", s.handleAPITransactions)
+	s.mux.HandleFunc("/api/transactions/", s.handleAPITransaction)
+	s.mux.HandleFunc("/api/connections/", s.handleAPIConnection)
+	s.mux.HandleFunc("/api/endpoints", s.handleAPIEndpoints)
+	s.mux.HandleFunc("/api/graph", s.handleAPIGraph)
+	s.mux.HandleFunc("/metrics", s.handleMetrics)
 
 	/*
 	   If './client' directory exists, create a FileServer with it,
@@ -155,20 +504,43 @@ func (s *NGServer) Serve() {
 	_, err := os.Stat("client")
 	if err == nil {
 		fs := http.FileServer(http.Dir("client"))
-		http.Handle("/", fs)
+		s.mux.Handle("/", fs)
 	} else {
-		http.HandleFunc("/", s.handleStaticFile)
+		s.mux.HandleFunc("/", s.handleStaticFile)
+	}
+	if s.store != nil {
+		go s.broadcastStoreStats()
+	}
+	s.server = &http.Server{
+		Addr:      s.addr,
+		Handler:   s.security.wrap(s.mux),
+		TLSConfig: s.security.tlsConfig,
 	}
 	s.wg.Add(1)
 	go s.listenAndServe()
 }
 
-// NewNGServer creates NGServer
-func NewNGServer(addr string, saveEvent bool) *NGServer {
+// NewNGServer creates NGServer.
+// The events are saved in store to be synced to new clients, unless store is nil.
+// Each websocket client has a queue of clientQueueSize events. When the queue
+// is full, events are dropped, or the client is disconnected if
+// disconnectSlowClient is set. security sets the TLS, the authentication
+// and the allowed websocket origins, nil serves plain HTTP to everyone.
+func NewNGServer(addr string, store ngstore.Store, clientQueueSize int, disconnectSlowClient bool, security *serverSecurity) *NGServer {
 	s := new(NGServer)
 	s.addr = addr
+	s.security = security
+	if s.security == nil {
+		s.security = new(serverSecurity)
+	}
+	s.mux = http.NewServeMux()
 	s.connectedClient = make(map[*websocket.Conn]*NGClient)
 	s.connectedClientMutex = &sync.Mutex{}
-	s.saveEvent = saveEvent
+	s.store = store
+	s.clientQueueSize = clientQueueSize
+	s.disconnectSlowClient = disconnectSlowClient
+	s.metrics = newHTTPMetrics()
+	s.endpoints = ngstats.NewAggregator()
+	s.graph = nggraph.New()
 	return s
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ga0/netgraph/ngnet"
+	"golang.org/x/net/websocket"
+)
+
+// newTestClient connects a websocket client to s and waits until the server
+// knows it
+func newTestClient(t *testing.T, s *NGServer) *websocket.Conn {
+	ts := httptest.NewServer(websocket.Server{Handler: s.websocketHandler})
+	t.Cleanup(ts.Close)
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/data", "", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		s.connectedClientMutex.Lock()
+		n := len(s.connectedClient)
+		s.connectedClientMutex.Unlock()
+		if n > 0 {
+			return ws
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("client not connected")
+		}
+	}
+}
+
+func TestSlowClientDoesntBlockPush(t *testing.T) {
+	s := NewNGServer("", nil, 64, true, nil)
+	newTestClient(t, s) // never reads
+
+	// the first events fill the socket buffers, so the writer of the
+	// client is blocked in a write when the next ones fill its queue
+	body := bytes.Repeat([]byte("x"), 1<<20)
+	push := func(n int) {
+		for i := 0; i < n; i++ {
+			var e ngnet.HTTPRequestEvent
+			e.Body = body
+			s.PushEvent(e)
+		}
+	}
+	push(32)
+	time.Sleep(500 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		push(128)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("PushEvent is blocked by the slow client")
+	}
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		s.connectedClientMutex.Lock()
+		n := len(s.connectedClient)
+		s.connectedClientMutex.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("slow client not disconnected")
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package ngsink
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileWriter appends the records to a file, one per line. The file is
+// rotated when it is larger than maxSize or older than maxAge: it is renamed
+// <name>.1, the former <name>.1 becomes <name>.2 and so on, and the files
+// after maxFiles are removed.
+type fileWriter struct {
+	name     string
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+	mutex    sync.Mutex
+	file     *os.File
+	writer   *bufio.Writer
+	size     int64
+	opened   time.Time
+}
+
+// parseSize parses a size like "100MB"
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+	s = strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return n * unit, nil
+}
+
+func newFileWriter(u *url.URL, params url.Values) (Writer, error) {
+	w := new(fileWriter)
+	w.name = u.Path
+	if u.Opaque != "" {
+		w.name = u.Opaque // file:events.ndjson, relative to the current directory
+	}
+	if w.name == "" {
+		return nil, fmt.Errorf("no file name")
+	}
+	var err error
+	if w.maxSize, err = parseSize(param(params, "max_size", "100MB")); err != nil {
+		return nil, err
+	}
+	if w.maxAge, err = durationParam(params, "max_age", 0); err != nil {
+		return nil, err
+	}
+	if w.maxFiles, err = intParam(params, "max_files", 5); err != nil {
+		return nil, err
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *fileWriter) open() error {
+	f, err := os.OpenFile(w.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.writer = bufio.NewWriter(f)
+	w.size = info.Size()
+	w.opened = time.Now()
+	return nil
+}
+
+func (w *fileWriter) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.writer.Flush()
+	if e := w.file.Close(); err == nil {
+		err = e
+	}
+	w.file = nil
+	return err
+}
+
+// rotate renames the files and opens a new one
+func (w *fileWriter) rotate() error {
+	if err := w.closeFile(); err != nil {
+		return err
+	}
+	if w.maxFiles == 0 {
+		os.Remove(w.name)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", w.name, w.maxFiles))
+		for i := w.maxFiles - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", w.name, i), fmt.Sprintf("%s.%d", w.name, i+1))
+		}
+		if err := os.Rename(w.name, w.name+".1"); err != nil {
+			return err
+		}
+	}
+	return w.open()
+}
+
+func (w *fileWriter) Write(records []Record) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	for _, r := range records {
+		if w.size > 0 && ((w.maxSize > 0 && w.size+int64(len(r.Value))+1 > w.maxSize) ||
+			(w.maxAge > 0 && time.Since(w.opened) >= w.maxAge)) {
+			if err := w.rotate(); err != nil {
+				return err
+			}
+		}
+		w.writer.Write(r.Value)
+		if err := w.writer.WriteByte('\n'); err != nil {
+			return err
+		}
+		w.size += int64(len(r.Value)) + 1
+	}
+	return w.writer.Flush()
+}
+
+// Reopen opens the file again, after it was moved by another program
+func (w *fileWriter) Reopen() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err := w.closeFile(); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+func (w *fileWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.closeFile()
+}
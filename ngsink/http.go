@@ -0,0 +1,78 @@
+package ngsink
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// httpWriter posts the batches as NDJSON, one record per line. The user and
+// password of the URL are sent with basic authentication, the "token"
+// parameter as a bearer token. The parameters which are not options of the
+// sink are passed on to the collector in the query of the URL.
+type httpWriter struct {
+	url    string
+	user   *url.Userinfo
+	token  string
+	client *http.Client
+	buffer bytes.Buffer
+}
+
+func newHTTPWriter(u *url.URL, params url.Values) (Writer, error) {
+	w := new(httpWriter)
+	w.user = u.User
+	w.token = param(params, "token", "")
+	timeout, err := durationParam(params, "timeout", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	w.client = &http.Client{Timeout: timeout}
+	// the options of the sink are already removed, the collector gets the
+	// other parameters
+	c := *u
+	c.User = nil
+	c.RawQuery = params.Encode()
+	w.url = c.String()
+	for name := range params {
+		delete(params, name)
+	}
+	return w, nil
+}
+
+func (w *httpWriter) Write(records []Record) error {
+	w.buffer.Reset()
+	for _, r := range records {
+		w.buffer.Write(r.Value)
+		w.buffer.WriteByte('\n')
+	}
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(w.buffer.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if w.user != nil {
+		password, _ := w.user.Password()
+		req.SetBasicAuth(w.user.Username(), password)
+	}
+	if w.token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.token)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+func (w *httpWriter) Close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
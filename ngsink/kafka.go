@@ -0,0 +1,467 @@
+package ngsink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kafka API keys and versions, the oldest ones supported by the brokers from
+// Kafka 1.0 to 4.x
+const (
+	kafkaProduce         = 0
+	kafkaProduceVersion  = 3
+	kafkaMetadata        = 3
+	kafkaMetadataVersion = 4
+)
+
+// kafkaMaxResponse is the max size of a response
+const kafkaMaxResponse = 64 << 20
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaError is an error code of a Kafka response
+type kafkaError int16
+
+var kafkaErrors = map[kafkaError]string{
+	1: "OFFSET_OUT_OF_RANGE", 2: "CORRUPT_MESSAGE", 3: "UNKNOWN_TOPIC_OR_PARTITION",
+	5: "LEADER_NOT_AVAILABLE", 6: "NOT_LEADER_OR_FOLLOWER", 7: "REQUEST_TIMED_OUT",
+	10: "MESSAGE_TOO_LARGE", 17: "INVALID_TOPIC_EXCEPTION", 18: "RECORD_LIST_TOO_LARGE",
+	19: "NOT_ENOUGH_REPLICAS", 20: "NOT_ENOUGH_REPLICAS_AFTER_APPEND", 29: "TOPIC_AUTHORIZATION_FAILED",
+	35: "UNSUPPORTED_VERSION",
+}
+
+func (e kafkaError) Error() string {
+	if s, ok := kafkaErrors[e]; ok {
+		return s
+	}
+	return "kafka error " + strconv.Itoa(int(e))
+}
+
+// kafkaEncoder writes the types of the Kafka protocol
+type kafkaEncoder struct {
+	bytes.Buffer
+}
+
+func (e *kafkaEncoder) int8(v int8)   { e.WriteByte(byte(v)) }
+func (e *kafkaEncoder) int16(v int16) { e.Write(binary.BigEndian.AppendUint16(nil, uint16(v))) }
+func (e *kafkaEncoder) int32(v int32) { e.Write(binary.BigEndian.AppendUint32(nil, uint32(v))) }
+func (e *kafkaEncoder) int64(v int64) { e.Write(binary.BigEndian.AppendUint64(nil, uint64(v))) }
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.WriteString(s)
+}
+
+func (e *kafkaEncoder) varint(v int64) {
+	e.Write(binary.AppendVarint(nil, v))
+}
+
+// varbytes writes the length as a varint, -1 for nil
+func (e *kafkaEncoder) varbytes(b []byte) {
+	if b == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(b)))
+	e.Write(b)
+}
+
+// kafkaDecoder reads the types of the Kafka protocol, the first error is
+// kept and the following reads return zero values
+type kafkaDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.data) < n {
+		d.err = errors.New("short Kafka response")
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// string reads a string, or a nullable string which is "" if null
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+// array reads the length of an array, 0 if null
+func (d *kafkaDecoder) array() int {
+	n := int(d.int32())
+	if n < 0 || n > len(d.data) {
+		return 0
+	}
+	return n
+}
+
+// kafkaRecordBatch encodes records as a record batch of magic 2
+func kafkaRecordBatch(records []Record) []byte {
+	first, max := records[0].Time, records[0].Time
+	for _, r := range records {
+		if r.Time.Before(first) {
+			first = r.Time
+		}
+		if r.Time.After(max) {
+			max = r.Time
+		}
+	}
+	var body kafkaEncoder // from the attributes, covered by the CRC
+	body.int16(0)         // attributes: no compression, create time
+	body.int32(int32(len(records) - 1))
+	body.int64(first.UnixMilli())
+	body.int64(max.UnixMilli())
+	body.int64(-1) // producer id
+	body.int16(-1) // producer epoch
+	body.int32(-1) // base sequence
+	body.int32(int32(len(records)))
+	var record kafkaEncoder
+	for i, r := range records {
+		record.Reset()
+		record.int8(0) // attributes
+		record.varint(r.Time.UnixMilli() - first.UnixMilli())
+		record.varint(int64(i))
+		record.varbytes(r.Key)
+		record.varbytes(r.Value)
+		record.varint(0) // headers
+		body.varint(int64(record.Len()))
+		body.Write(record.Bytes())
+	}
+
+	var batch kafkaEncoder
+	batch.int64(0) // base offset
+	batch.int32(int32(4 + 1 + 4 + body.Len()))
+	batch.int32(0) // partition leader epoch
+	batch.int8(2)  // magic
+	batch.Write(binary.BigEndian.AppendUint32(nil, crc32.Checksum(body.Bytes(), castagnoli)))
+	batch.Write(body.Bytes())
+	return batch.Bytes()
+}
+
+// murmur2 is the hash of the keys of the default partitioner of Kafka, so
+// the records of a key go to the same partition as with the Java client
+func murmur2(data []byte) int32 {
+	const seed, m, r = uint32(0x9747b28c), uint32(0x5bd1e995), 24
+	h := seed ^ uint32(len(data))
+	n := len(data) / 4
+	for i := 0; i < n; i++ {
+		k := binary.LittleEndian.Uint32(data[i*4:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[n*4:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// kafkaWriter produces the records to the partitions of a topic, by the
+// hash of their key, or in turn for the records without key
+type kafkaWriter struct {
+	bootstrap     []string
+	topic         string
+	acks          int16
+	clientID      string
+	timeout       time.Duration
+	correlationID int32
+	conns         map[string]net.Conn // by address
+	leaders       []string            // address of the leader of each partition, nil until the metadata is read
+	next          int                 // partition of the next record without key
+}
+
+func newKafkaWriter(u *url.URL, params url.Values) (Writer, error) {
+	w := new(kafkaWriter)
+	w.bootstrap = splitHosts(u.Host)
+	for i, h := range w.bootstrap {
+		if _, _, err := net.SplitHostPort(h); err != nil {
+			w.bootstrap[i] = net.JoinHostPort(h, "9092")
+		}
+	}
+	w.topic = strings.Trim(u.Path, "/")
+	if len(w.bootstrap) == 0 || w.topic == "" {
+		return nil, errors.New("use kafka://broker:9092/topic")
+	}
+	acks, err := strconv.Atoi(param(params, "acks", "1"))
+	if err != nil || acks < -1 || acks > 1 {
+		return nil, errors.New("bad acks, use -1 (all), 0 or 1")
+	}
+	w.acks = int16(acks)
+	w.clientID = param(params, "client_id", "netgraph")
+	if w.timeout, err = durationParam(params, "timeout", 10*time.Second); err != nil {
+		return nil, err
+	}
+	w.conns = make(map[string]net.Conn)
+	return w, nil
+}
+
+func (w *kafkaWriter) conn(addr string) (net.Conn, error) {
+	if c := w.conns[addr]; c != nil {
+		return c, nil
+	}
+	c, err := net.DialTimeout("tcp", addr, w.timeout)
+	if err != nil {
+		return nil, err
+	}
+	w.conns[addr] = c
+	return c, nil
+}
+
+// reset closes the connections and forgets the metadata, after an error
+func (w *kafkaWriter) reset() {
+	for addr, c := range w.conns {
+		c.Close()
+		delete(w.conns, addr)
+	}
+	w.leaders = nil
+}
+
+// request sends a request and reads its response, without response if
+// noResponse is set
+func (w *kafkaWriter) request(addr string, apiKey, version int16, body []byte, noResponse bool) (*kafkaDecoder, error) {
+	c, err := w.conn(addr)
+	if err != nil {
+		return nil, err
+	}
+	w.correlationID++
+	var req kafkaEncoder
+	req.int32(0) // size, set below
+	req.int16(apiKey)
+	req.int16(version)
+	req.int32(w.correlationID)
+	req.string(w.clientID)
+	req.Write(body)
+	data := req.Bytes()
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+	c.SetDeadline(time.Now().Add(w.timeout))
+	if _, err := c.Write(data); err != nil {
+		return nil, err
+	}
+	if noResponse {
+		return nil, nil
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(c, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > kafkaMaxResponse {
+		return nil, fmt.Errorf("bad Kafka response size %d", n)
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(c, resp); err != nil {
+		return nil, err
+	}
+	d := &kafkaDecoder{data: resp}
+	if id := d.int32(); id != w.correlationID {
+		return nil, fmt.Errorf("Kafka response %d to request %d", id, w.correlationID)
+	}
+	return d, nil
+}
+
+// metadata reads the leaders of the partitions of the topic from one of the
+// bootstrap brokers
+func (w *kafkaWriter) metadata() error {
+	var body kafkaEncoder
+	body.int32(1)
+	body.string(w.topic)
+	body.int8(1) // allow auto topic creation
+	var lastErr error
+	for _, addr := range w.bootstrap {
+		d, err := w.request(addr, kafkaMetadata, kafkaMetadataVersion, body.Bytes(), false)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		d.int32() // throttle time
+		brokers := make(map[int32]string)
+		for i, n := 0, d.array(); i < n; i++ {
+			id := d.int32()
+			host := d.string()
+			port := d.int32()
+			d.string() // rack
+			brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		}
+		d.string() // cluster id
+		d.int32()  // controller id
+		var leaders []string
+		for i, n := 0, d.array(); i < n; i++ {
+			topicErr := kafkaError(d.int16())
+			name := d.string()
+			d.int8() // internal
+			partitions := d.array()
+			if name == w.topic && topicErr != 0 {
+				return fmt.Errorf("topic %s: %v", w.topic, topicErr)
+			}
+			if name == w.topic {
+				leaders = make([]string, partitions)
+			}
+			for j := 0; j < partitions; j++ {
+				d.int16() // error
+				index := d.int32()
+				leader := d.int32()
+				for k, n := 0, d.array(); k < n; k++ {
+					d.int32() // replica
+				}
+				for k, n := 0, d.array(); k < n; k++ {
+					d.int32() // in sync replica
+				}
+				if name == w.topic && index >= 0 && int(index) < len(leaders) {
+					leaders[index] = brokers[leader]
+				}
+			}
+		}
+		if d.err != nil {
+			return d.err
+		}
+		if len(leaders) == 0 {
+			return fmt.Errorf("topic %s has no partition", w.topic)
+		}
+		for i, l := range leaders {
+			if l == "" {
+				return fmt.Errorf("partition %d of %s has no leader", i, w.topic)
+			}
+		}
+		w.leaders = leaders
+		return nil
+	}
+	return lastErr
+}
+
+func (w *kafkaWriter) partition(key []byte) int {
+	if key == nil {
+		p := w.next % len(w.leaders)
+		w.next++
+		return p
+	}
+	return int(murmur2(key)&0x7fffffff) % len(w.leaders)
+}
+
+func (w *kafkaWriter) Write(records []Record) error {
+	err := w.produce(records)
+	if err != nil {
+		w.reset()
+	}
+	return err
+}
+
+// produce sends one request to the leader of each partition of the records
+func (w *kafkaWriter) produce(records []Record) error {
+	if w.leaders == nil {
+		if err := w.metadata(); err != nil {
+			return err
+		}
+	}
+	partitions := make(map[int][]Record)
+	for _, r := range records {
+		p := w.partition(r.Key)
+		partitions[p] = append(partitions[p], r)
+	}
+	byLeader := make(map[string][]int)
+	for p := range partitions {
+		byLeader[w.leaders[p]] = append(byLeader[w.leaders[p]], p)
+	}
+	for addr, ps := range byLeader {
+		var body kafkaEncoder
+		body.int16(-1) // transactional id
+		body.int16(w.acks)
+		body.int32(int32(w.timeout / time.Millisecond))
+		body.int32(1)
+		body.string(w.topic)
+		body.int32(int32(len(ps)))
+		for _, p := range ps {
+			batch := kafkaRecordBatch(partitions[p])
+			body.int32(int32(p))
+			body.int32(int32(len(batch)))
+			body.Write(batch)
+		}
+		d, err := w.request(addr, kafkaProduce, kafkaProduceVersion, body.Bytes(), w.acks == 0)
+		if err != nil {
+			return err
+		}
+		if d == nil {
+			continue
+		}
+		for i, n := 0, d.array(); i < n; i++ {
+			d.string() // topic
+			for j, n := 0, d.array(); j < n; j++ {
+				p := d.int32()
+				code := kafkaError(d.int16())
+				d.int64() // base offset
+				d.int64() // log append time
+				if code != 0 {
+					return fmt.Errorf("partition %d: %v", p, code)
+				}
+			}
+		}
+		if d.err != nil {
+			return d.err
+		}
+	}
+	return nil
+}
+
+func (w *kafkaWriter) Close() error {
+	w.reset()
+	return nil
+}
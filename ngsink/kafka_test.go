@@ -0,0 +1,243 @@
+package ngsink
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBroker is a Kafka broker stand-in with one topic, it answers the
+// Metadata and Produce requests and decodes the produced records
+type fakeBroker struct {
+	t          *testing.T
+	listener   net.Listener
+	topic      string
+	partitions int
+	mutex      sync.Mutex
+	records    map[int32][]string // values by partition
+	keys       map[string]int32   // partition by key
+	failFirst  bool               // answer the first produce with NOT_LEADER_OR_FOLLOWER
+}
+
+func newFakeBroker(t *testing.T, topic string, partitions int) *fakeBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{t: t, listener: l, topic: topic, partitions: partitions,
+		records: make(map[int32][]string), keys: make(map[string]int32)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(c)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) serve(c net.Conn) {
+	defer c.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(c, size[:]); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(c, data); err != nil {
+			return
+		}
+		d := &kafkaDecoder{data: data}
+		apiKey, version, correlationID := d.int16(), d.int16(), d.int32()
+		d.string() // client id
+		var resp kafkaEncoder
+		resp.int32(0)
+		resp.int32(correlationID)
+		switch {
+		case apiKey == kafkaMetadata && version == kafkaMetadataVersion:
+			b.metadata(d, &resp)
+		case apiKey == kafkaProduce && version == kafkaProduceVersion:
+			if !b.produce(d, &resp) {
+				continue // acks=0
+			}
+		default:
+			b.t.Errorf("unexpected request %d v%d", apiKey, version)
+			return
+		}
+		out := resp.Bytes()
+		binary.BigEndian.PutUint32(out, uint32(len(out)-4))
+		c.Write(out)
+	}
+}
+
+func (b *fakeBroker) metadata(d *kafkaDecoder, resp *kafkaEncoder) {
+	if d.array() != 1 || d.string() != b.topic || d.int8() != 1 {
+		b.t.Error("bad metadata request")
+	}
+	host, port, _ := net.SplitHostPort(b.listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	resp.int32(0) // throttle
+	resp.int32(1)
+	resp.int32(7) // node id
+	resp.string(host)
+	resp.int32(int32(p))
+	resp.int16(-1) // rack
+	resp.int16(-1) // cluster id
+	resp.int32(7)  // controller
+	resp.int32(1)
+	resp.int16(0)
+	resp.string(b.topic)
+	resp.int8(0)
+	resp.int32(int32(b.partitions))
+	for i := 0; i < b.partitions; i++ {
+		resp.int16(0)
+		resp.int32(int32(i))
+		resp.int32(7) // leader
+		resp.int32(1)
+		resp.int32(7) // replicas
+		resp.int32(1)
+		resp.int32(7) // isr
+	}
+}
+
+// produce decodes a Produce request, it returns false if acks is 0
+func (b *fakeBroker) produce(d *kafkaDecoder, resp *kafkaEncoder) bool {
+	d.string() // transactional id
+	acks := d.int16()
+	d.int32() // timeout
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	code := int16(0)
+	if b.failFirst {
+		b.failFirst = false
+		code = 6
+	}
+	resp.int32(1)
+	for i, n := 0, d.array(); i < n; i++ {
+		resp.string(d.string())
+		partitions := d.array()
+		resp.int32(int32(partitions))
+		for j := 0; j < partitions; j++ {
+			p := d.int32()
+			batch := d.next(int(d.int32()))
+			if code == 0 {
+				b.decodeBatch(p, batch)
+			}
+			resp.int32(p)
+			resp.int16(code)
+			resp.int64(0)
+			resp.int64(-1)
+		}
+	}
+	resp.int32(0) // throttle
+	if d.err != nil {
+		b.t.Error(d.err)
+	}
+	return acks != 0
+}
+
+func (b *fakeBroker) decodeBatch(p int32, batch []byte) {
+	d := &kafkaDecoder{data: batch}
+	d.int64() // base offset
+	if int(d.int32()) != len(d.data) {
+		b.t.Error("bad batch length")
+	}
+	d.int32() // leader epoch
+	if d.int8() != 2 {
+		b.t.Error("bad magic")
+	}
+	crc := uint32(d.int32())
+	if crc32.Checksum(d.data, castagnoli) != crc {
+		b.t.Error("bad CRC")
+	}
+	d.int16()
+	d.int32()
+	first := d.int64()
+	d.next(8 + 8 + 2 + 4)
+	n := int(d.int32())
+	for i := 0; i < n; i++ {
+		size, _ := binary.Varint(d.data)
+		d.next(len(binary.AppendVarint(nil, size)))
+		r := d.next(int(size))
+		r = r[1:]
+		delta, k := binary.Varint(r)
+		r = r[k:]
+		if first+delta != time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli() {
+			b.t.Error("bad timestamp")
+		}
+		_, k = binary.Varint(r) // offset delta
+		r = r[k:]
+		keyLen, k := binary.Varint(r)
+		r = r[k:]
+		key := "null"
+		if keyLen >= 0 {
+			key = string(r[:keyLen])
+			r = r[keyLen:]
+		}
+		valueLen, k := binary.Varint(r)
+		r = r[k:]
+		b.records[p] = append(b.records[p], string(r[:valueLen]))
+		b.keys[key] = p
+	}
+}
+
+func TestKafka(t *testing.T) {
+	b := newFakeBroker(t, "events", 3)
+	defer b.listener.Close()
+	b.failFirst = true
+	s, err := Open("kafka://" + b.listener.Addr().String() + "/events?backoff=1ms&batch=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{"0.0", "1.0", "2.0", "3.0", "0.0"}
+	for i, k := range keys {
+		r := record(strconv.Itoa(i))
+		r.Key = []byte(k)
+		s.Add(r)
+	}
+	s.Close(5 * time.Second)
+	if st := s.Stats(); st.Sent != 5 || st.Failed != 0 {
+		t.Errorf("bad stats %+v", st)
+	}
+	total := 0
+	for _, values := range b.records {
+		total += len(values)
+	}
+	if total != 5 || len(b.keys) != 4 {
+		t.Errorf("bad records %v %v", b.records, b.keys)
+	}
+	// the partition of the Java client, the hashes are the ones of librdkafka's tests
+	if uint32(murmur2([]byte("kafka"))) != 0xd067cf64 || uint32(murmur2([]byte("giberish123456789"))) != 0x8f552b0c {
+		t.Error("bad murmur2")
+	}
+	for k, p := range b.keys {
+		if want := murmur2([]byte(k)) & 0x7fffffff % 3; p != want {
+			t.Errorf("key %s in partition %d, want %d", k, p, want)
+		}
+	}
+
+	// without key and acks, in turn
+	b.mutex.Lock()
+	b.records = make(map[int32][]string)
+	b.mutex.Unlock()
+	s, _ = Open("kafka://" + b.listener.Addr().String() + "/events?acks=0")
+	for i := 0; i < 3; i++ {
+		r := record(strconv.Itoa(i))
+		r.Key = nil
+		s.Add(r)
+	}
+	s.Close(5 * time.Second)
+	time.Sleep(50 * time.Millisecond)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(b.records) != 3 {
+		t.Errorf("bad records %v", b.records)
+	}
+}
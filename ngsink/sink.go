@@ -0,0 +1,369 @@
+// Package ngsink forwards the events of netgraph to external systems. A Sink
+// buffers the records, sends them in batches with a Writer and retries the
+// failed batches:
+//
+//	syslog+udp://host:514, syslog+tcp://host:601   RFC 5424 syslog, one message per record
+//	http://host/path, https://host/path            POST of a batch of records as NDJSON
+//	kafka://broker1:9092,broker2:9092/topic         produced with the Kafka protocol
+//	file:///path/events.ndjson                      appended to a file rotated by size
+//
+// Sinks are opened from a URL, whose query sets the options of the Sink and
+// of the Writer, e.g. kafka://localhost:9092/netgraph?acks=-1&batch=500.
+// An unknown parameter is an error, except for http and https, which pass
+// it on to the collector.
+package ngsink
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Drop policies, what is dropped when the buffer is full
+const (
+	DropNewest = "newest" // the records added
+	DropOldest = "oldest" // the records buffered for the longest time
+)
+
+// maxBackoff is the longest wait between two retries
+const maxBackoff = 30 * time.Second
+
+// Record is an event to send
+type Record struct {
+	Time  time.Time
+	Type  string // like "request", the message ID of syslog
+	Key   []byte // the Kafka key, the records with the same key go to the same partition
+	Value []byte // the event in JSON
+}
+
+// Writer sends batches of records
+type Writer interface {
+	Write(records []Record) error
+	Close() error
+}
+
+// Options of a Sink, set by the parameters of the URL
+type Options struct {
+	Buffer  int           // max records buffered, "buffer"
+	Batch   int           // max records of a batch, "batch"
+	Flush   time.Duration // max time a record waits for a batch to be full, "flush"
+	Retries int           // retries of a failed batch before it is dropped, "retries"
+	Backoff time.Duration // wait before the first retry, doubled at each retry, "backoff"
+	Drop    string        // DropNewest or DropOldest, "drop"
+}
+
+// DefaultOptions are the options of the parameters not set
+var DefaultOptions = Options{
+	Buffer:  10000,
+	Batch:   100,
+	Flush:   time.Second,
+	Retries: 3,
+	Backoff: 500 * time.Millisecond,
+	Drop:    DropNewest,
+}
+
+// Stats count the records of a Sink
+type Stats struct {
+	Sent      uint64 // records written
+	Dropped   uint64 // records dropped because the buffer was full
+	Failed    uint64 // records dropped after the retries of their batch failed
+	Truncated uint64 // records cut to the max size of the writer, like a syslog datagram, also counted in Sent
+}
+
+// Sink sends records with a Writer from a goroutine. It is safe for
+// concurrent use.
+type Sink struct {
+	name    string
+	writer  Writer
+	options Options
+
+	mutex   sync.Mutex
+	cond    *sync.Cond // signaled when records are added, the sink is closed or Flush expired
+	buffer  []Record
+	stats   Stats
+	closing bool
+	stop    chan struct{} // closed to give up the retries
+	done    chan struct{} // closed when the goroutine ended
+}
+
+// New creates a Sink writing with w. name is used in the logs.
+func New(name string, w Writer, options Options) *Sink {
+	s := new(Sink)
+	s.name = name
+	s.writer = w
+	s.options = options
+	s.cond = sync.NewCond(&s.mutex)
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run()
+	return s
+}
+
+// Open creates a Sink from a URL, see the package documentation
+func Open(rawurl string) (*Sink, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	params := u.Query()
+	options, err := parseOptions(params)
+	if err != nil {
+		return nil, fmt.Errorf("sink %s: %v", Redact(u), err)
+	}
+	var w Writer
+	switch u.Scheme {
+	case "syslog+udp", "syslog+tcp":
+		w, err = newSyslogWriter(u, params)
+	case "http", "https":
+		w, err = newHTTPWriter(u, params)
+	case "kafka":
+		w, err = newKafkaWriter(u, params)
+	case "file":
+		w, err = newFileWriter(u, params)
+	default:
+		err = fmt.Errorf("unknown scheme %q, use syslog+udp, syslog+tcp, http, https, kafka or file", u.Scheme)
+	}
+	if err == nil {
+		for name := range params {
+			err = fmt.Errorf("unknown parameter %q", name)
+			w.Close()
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sink %s: %v", Redact(u), err)
+	}
+	return New(Redact(u), w, options), nil
+}
+
+// Redact returns the URL without its password and token, to be logged
+func Redact(u *url.URL) string {
+	c := *u
+	if _, ok := u.User.Password(); ok {
+		c.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	if q := u.Query(); q.Get("token") != "" {
+		q.Set("token", "xxxxx")
+		c.RawQuery = q.Encode()
+	}
+	return c.String()
+}
+
+// param removes a parameter from params and returns it, def if it is not set
+func param(params url.Values, name, def string) string {
+	v, ok := params[name]
+	delete(params, name)
+	if !ok || len(v) == 0 {
+		return def
+	}
+	return v[len(v)-1]
+}
+
+func intParam(params url.Values, name string, def int) (int, error) {
+	v := param(params, name, "")
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad %s %q", name, v)
+	}
+	return n, nil
+}
+
+func durationParam(params url.Values, name string, def time.Duration) (time.Duration, error) {
+	v := param(params, name, "")
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("bad %s %q", name, v)
+	}
+	return d, nil
+}
+
+func parseOptions(params url.Values) (o Options, err error) {
+	o = DefaultOptions
+	if o.Buffer, err = intParam(params, "buffer", o.Buffer); err != nil {
+		return
+	}
+	if o.Batch, err = intParam(params, "batch", o.Batch); err != nil {
+		return
+	}
+	if o.Flush, err = durationParam(params, "flush", o.Flush); err != nil {
+		return
+	}
+	if o.Retries, err = intParam(params, "retries", o.Retries); err != nil {
+		return
+	}
+	if o.Backoff, err = durationParam(params, "backoff", o.Backoff); err != nil {
+		return
+	}
+	o.Drop = param(params, "drop", o.Drop)
+	if o.Drop != DropNewest && o.Drop != DropOldest {
+		return o, fmt.Errorf("bad drop %q, use newest or oldest", o.Drop)
+	}
+	if o.Buffer == 0 || o.Batch == 0 {
+		return o, errors.New("buffer and batch must be positive")
+	}
+	return o, nil
+}
+
+// String returns the URL of the sink, without password
+func (s *Sink) String() string {
+	return s.name
+}
+
+// Add buffers a record, or drops it if the buffer is full
+func (s *Sink) Add(r Record) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closing {
+		s.stats.Dropped++
+		return
+	}
+	if len(s.buffer) >= s.options.Buffer {
+		s.stats.Dropped++
+		if s.options.Drop == DropNewest {
+			return
+		}
+		s.buffer = s.buffer[1:]
+	}
+	s.buffer = append(s.buffer, r)
+	s.cond.Signal()
+}
+
+// Stats returns the counts of the records
+func (s *Sink) Stats() Stats {
+	s.mutex.Lock()
+	stats := s.stats
+	s.mutex.Unlock()
+	if t, ok := s.writer.(interface{ Truncated() uint64 }); ok {
+		stats.Truncated = t.Truncated()
+	}
+	return stats
+}
+
+// Reopen reopens the file of a file sink, it does nothing for the others
+func (s *Sink) Reopen() error {
+	if r, ok := s.writer.(interface{ Reopen() error }); ok {
+		return r.Reopen()
+	}
+	return nil
+}
+
+// next waits for a batch, a full one or the records buffered for Flush. It
+// returns nil when the sink is closed and the buffer empty.
+func (s *Sink) next() []Record {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for len(s.buffer) == 0 && !s.closing {
+		s.cond.Wait()
+	}
+	if len(s.buffer) < s.options.Batch && !s.closing {
+		expired := false
+		timer := time.AfterFunc(s.options.Flush, func() {
+			s.mutex.Lock()
+			expired = true
+			s.cond.Signal()
+			s.mutex.Unlock()
+		})
+		for !expired && len(s.buffer) < s.options.Batch && !s.closing {
+			s.cond.Wait()
+		}
+		timer.Stop()
+	}
+	n := len(s.buffer)
+	if n == 0 {
+		return nil
+	}
+	if n > s.options.Batch {
+		n = s.options.Batch
+	}
+	batch := make([]Record, n)
+	copy(batch, s.buffer)
+	s.buffer = s.buffer[n:]
+	return batch
+}
+
+func (s *Sink) run() {
+	defer close(s.done)
+	failing := false
+	for {
+		batch := s.next()
+		if batch == nil {
+			return
+		}
+		err := s.write(batch)
+		s.mutex.Lock()
+		if err == nil {
+			s.stats.Sent += uint64(len(batch))
+		} else {
+			s.stats.Failed += uint64(len(batch))
+		}
+		s.mutex.Unlock()
+		// log the first failure and the recovery only
+		if err != nil && !failing {
+			log.Printf("Sink %s: %d records dropped: %v\n", s.name, len(batch), err)
+		} else if err == nil && failing {
+			log.Printf("Sink %s: recovered\n", s.name)
+		}
+		failing = err != nil
+	}
+}
+
+// write writes a batch, it retries with a backoff until the sink is stopped
+func (s *Sink) write(batch []Record) error {
+	backoff := s.options.Backoff
+	for i := 0; ; i++ {
+		err := s.writer.Write(batch)
+		if err == nil || i == s.options.Retries {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-s.stop:
+			return err
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Close sends the buffered records, waiting at most timeout, and closes the
+// writer. The records not sent by then are dropped.
+func (s *Sink) Close(timeout time.Duration) error {
+	s.mutex.Lock()
+	s.closing = true
+	s.cond.Broadcast()
+	s.mutex.Unlock()
+	select {
+	case <-s.done:
+	case <-time.After(timeout):
+		close(s.stop)
+		s.mutex.Lock()
+		s.stats.Dropped += uint64(len(s.buffer))
+		s.buffer = nil
+		s.mutex.Unlock()
+		<-s.done
+	}
+	return s.writer.Close()
+}
+
+// splitHosts splits the host of a URL like "host1:9092,host2:9092"
+func splitHosts(host string) []string {
+	var hosts []string
+	for _, h := range strings.Split(host, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
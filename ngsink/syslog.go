@@ -0,0 +1,141 @@
+package ngsink
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// syslogFacilities are the facilities of the "facility" parameter
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogInfo is the severity of the messages
+const syslogInfo = 6
+
+// maxUDPMessage is the size of the longest message sent over UDP, a bit less
+// than the max payload of a datagram. The longer messages are truncated.
+const maxUDPMessage = 65000
+
+// syslogWriter sends RFC 5424 messages over UDP, one datagram per message,
+// or over TCP with the octet counting framing of RFC 6587
+type syslogWriter struct {
+	network  string
+	addr     string
+	priority int
+	hostname string
+	app      string
+	timeout  time.Duration
+	conn     net.Conn
+	buffer   bytes.Buffer
+
+	truncated uint64 // messages truncated to maxUDPMessage, accessed atomically
+}
+
+func newSyslogWriter(u *url.URL, params url.Values) (Writer, error) {
+	w := new(syslogWriter)
+	w.network = strings.TrimPrefix(u.Scheme, "syslog+")
+	w.addr = u.Host
+	if u.Port() == "" {
+		w.addr = net.JoinHostPort(u.Hostname(), "514")
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("no host")
+	}
+	facility, ok := syslogFacilities[param(params, "facility", "local0")]
+	if !ok {
+		return nil, fmt.Errorf("unknown facility")
+	}
+	w.priority = facility*8 + syslogInfo
+	w.hostname, _ = os.Hostname()
+	if w.hostname == "" {
+		w.hostname = "-"
+	}
+	w.app = param(params, "app", "netgraph")
+	var err error
+	if w.timeout, err = durationParam(params, "timeout", 10*time.Second); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// syslogName returns a header field of printable ASCII, at most max bytes
+func syslogName(s string, max int) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c <= ' ' || c > '~' {
+			b[i] = '_'
+		}
+	}
+	if len(b) > max {
+		b = b[:max]
+	}
+	if len(b) == 0 {
+		return "-"
+	}
+	return string(b)
+}
+
+// format appends the message of a record to the buffer:
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID - MSG
+func (w *syslogWriter) format(r Record) []byte {
+	w.buffer.Reset()
+	fmt.Fprintf(&w.buffer, "<%d>1 %s %s %s %d %s - ", w.priority,
+		r.Time.UTC().Format("2006-01-02T15:04:05.000000Z"), syslogName(w.hostname, 255),
+		syslogName(w.app, 48), os.Getpid(), syslogName(r.Type, 32))
+	w.buffer.Write(r.Value)
+	return w.buffer.Bytes()
+}
+
+func (w *syslogWriter) Write(records []Record) error {
+	if w.conn == nil {
+		conn, err := net.DialTimeout(w.network, w.addr, w.timeout)
+		if err != nil {
+			return err
+		}
+		w.conn = conn
+	}
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	for i, r := range records {
+		msg := w.format(r)
+		var err error
+		if w.network == "tcp" {
+			_, err = w.conn.Write(append([]byte(strconv.Itoa(len(msg))+" "), msg...))
+		} else {
+			if len(msg) > maxUDPMessage {
+				msg = msg[:maxUDPMessage]
+				atomic.AddUint64(&w.truncated, 1)
+			}
+			_, err = w.conn.Write(msg)
+		}
+		if err != nil {
+			// the batch is sent again from the start, on a new connection
+			w.conn.Close()
+			w.conn = nil
+			return fmt.Errorf("message %d of %d: %v", i+1, len(records), err)
+		}
+	}
+	return nil
+}
+
+// Truncated returns the number of messages truncated to fit in a datagram
+func (w *syslogWriter) Truncated() uint64 {
+	return atomic.LoadUint64(&w.truncated)
+}
+
+func (w *syslogWriter) Close() error {
+	if w.conn != nil {
+		return w.conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+// Package ngstats aggregates the HTTP transactions per endpoint, the host and
+// route of the requests, over sliding windows of 1, 5 and 15 minutes.
+//
+// Windows are made of 15 second slots, and end at the newest transaction
+// seen, so a pcap file read long after its capture still has statistics.
+// Set Aggregator.Clock for a live capture, so the statistics of an endpoint
+// which stopped receiving requests go down.
+package ngstats
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SlotDuration is the resolution of the windows
+const SlotDuration = 15 * time.Second
+
+// MaxWindow is the longest window
+const MaxWindow = 15 * time.Minute
+
+const numSlots = int(MaxWindow / SlotDuration)
+
+// Windows are the windows of the statistics
+var Windows = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// DefaultMaxEndpoints is the default of Aggregator.MaxEndpoints
+const DefaultMaxEndpoints = 10000
+
+// Other is the host and route of the transactions counted after
+// MaxEndpoints endpoints
+const Other = "other"
+
+// Transaction is what the Aggregator counts of an HTTP transaction
+type Transaction struct {
+	Host     string
+	Route    string
+	Start    time.Time
+	Status   uint
+	Duration time.Duration
+	BytesIn  int // request body size
+	BytesOut int // response body size
+}
+
+// EndpointStats are the statistics of an endpoint over a window
+type EndpointStats struct {
+	Host            string            `json:"host"`
+	Route           string            `json:"route"`
+	Requests        uint64            `json:"requests"`
+	Rate            float64           `json:"rate"`              // requests per second over the window
+	Status          map[string]uint64 `json:"status"`            // requests by status class, like "2xx"
+	ClientErrorRate float64           `json:"client_error_rate"` // fraction of 4xx responses
+	ServerErrorRate float64           `json:"server_error_rate"` // fraction of 5xx responses
+	P50             float64           `json:"p50_ms"`
+	P90             float64           `json:"p90_ms"`
+	P99             float64           `json:"p99_ms"`
+	BytesIn         uint64            `json:"bytes_in"`
+	BytesOut        uint64            `json:"bytes_out"`
+}
+
+// slot counts the transactions of a SlotDuration
+type slot struct {
+	index    int64 // start time / SlotDuration
+	requests uint64
+	status   [6]uint64 // by code / 100, other codes at 0
+	bytesIn  uint64
+	bytesOut uint64
+	latency  *Sketch // seconds
+}
+
+type endpointKey struct {
+	host, route string
+}
+
+type endpoint struct {
+	slots [numSlots]slot
+	last  int64 // index of the newest slot
+}
+
+// Aggregator keeps the statistics of the endpoints. It is safe for
+// concurrent use.
+type Aggregator struct {
+	Clock        func() time.Time // nil means the windows end at the newest transaction
+	MaxEndpoints int
+
+	mutex     sync.Mutex
+	endpoints map[endpointKey]*endpoint
+	newest    int64 // index of the newest slot
+}
+
+// NewAggregator creates an Aggregator
+func NewAggregator() *Aggregator {
+	a := new(Aggregator)
+	a.MaxEndpoints = DefaultMaxEndpoints
+	a.endpoints = make(map[endpointKey]*endpoint)
+	return a
+}
+
+func slotIndex(t time.Time) int64 {
+	return t.UnixNano() / int64(SlotDuration)
+}
+
+// now returns the index of the last slot of the windows
+func (a *Aggregator) now() int64 {
+	now := a.newest
+	if a.Clock != nil {
+		if clock := slotIndex(a.Clock()); clock > now {
+			now = clock
+		}
+	}
+	return now
+}
+
+// expire forgets the endpoints without transactions in MaxWindow
+func (a *Aggregator) expire() {
+	now := a.now()
+	for k, e := range a.endpoints {
+		if e.last <= now-int64(numSlots) {
+			delete(a.endpoints, k)
+		}
+	}
+}
+
+// Add counts a transaction
+func (a *Aggregator) Add(t Transaction) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	index := slotIndex(t.Start)
+	if index > a.newest {
+		advanced := a.newest != 0
+		a.newest = index
+		if advanced {
+			a.expire()
+		}
+	}
+	if index <= a.now()-int64(numSlots) {
+		return
+	}
+	key := endpointKey{t.Host, t.Route}
+	e := a.endpoints[key]
+	if e == nil {
+		if len(a.endpoints) >= a.MaxEndpoints {
+			key = endpointKey{Other, Other}
+			e = a.endpoints[key]
+		}
+		if e == nil {
+			e = new(endpoint)
+			a.endpoints[key] = e
+		}
+	}
+	s := &e.slots[index%int64(numSlots)]
+	if s.index != index {
+		*s = slot{index: index, latency: NewSketch()}
+	}
+	if index > e.last {
+		e.last = index
+	}
+	s.requests++
+	class := t.Status / 100
+	if class > 5 {
+		class = 0
+	}
+	s.status[class]++
+	s.bytesIn += uint64(t.BytesIn)
+	s.bytesOut += uint64(t.BytesOut)
+	s.latency.Add(t.Duration.Seconds())
+}
+
+// Stats returns the statistics of the endpoints with transactions in the
+// window, which is rounded up to SlotDuration
+func (a *Aggregator) Stats(window time.Duration) []EndpointStats {
+	if window > MaxWindow {
+		window = MaxWindow
+	}
+	n := int64((window + SlotDuration - 1) / SlotDuration)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	first := a.now() - n + 1
+	var stats []EndpointStats
+	for k, e := range a.endpoints {
+		if e.last < first {
+			continue
+		}
+		st := EndpointStats{Host: k.host, Route: k.route, Status: make(map[string]uint64)}
+		var status [6]uint64
+		latency := NewSketch()
+		for i := range e.slots {
+			s := &e.slots[i]
+			if s.index < first || s.requests == 0 {
+				continue
+			}
+			st.Requests += s.requests
+			for c, count := range s.status {
+				status[c] += count
+			}
+			st.BytesIn += s.bytesIn
+			st.BytesOut += s.bytesOut
+			latency.Merge(s.latency)
+		}
+		if st.Requests == 0 {
+			continue
+		}
+		for c, count := range status {
+			if count == 0 {
+				continue
+			}
+			if c == 0 {
+				st.Status[Other] = count
+			} else {
+				st.Status[fmt.Sprintf("%dxx", c)] = count
+			}
+		}
+		st.Rate = float64(st.Requests) / (time.Duration(n) * SlotDuration).Seconds()
+		st.ClientErrorRate = float64(status[4]) / float64(st.Requests)
+		st.ServerErrorRate = float64(status[5]) / float64(st.Requests)
+		st.P50 = latency.Quantile(0.5) * 1000
+		st.P90 = latency.Quantile(0.9) * 1000
+		st.P99 = latency.Quantile(0.99) * 1000
+		stats = append(stats, st)
+	}
+	return stats
+}
+
+// SortFields are the fields accepted by Sort
+var SortFields = []string{"host", "route", "requests", "rate", "client_error_rate",
+	"server_error_rate", "p50", "p90", "p99", "bytes_in", "bytes_out"}
+
+// Sort sorts the statistics by a field of SortFields, host and route
+// break ties
+func Sort(stats []EndpointStats, field string, desc bool) error {
+	var key func(s *EndpointStats) float64
+	switch field {
+	case "host", "route":
+	case "requests":
+		key = func(s *EndpointStats) float64 { return float64(s.Requests) }
+	case "rate":
+		key = func(s *EndpointStats) float64 { return s.Rate }
+	case "client_error_rate":
+		key = func(s *EndpointStats) float64 { return s.ClientErrorRate }
+	case "server_error_rate":
+		key = func(s *EndpointStats) float64 { return s.ServerErrorRate }
+	case "p50":
+		key = func(s *EndpointStats) float64 { return s.P50 }
+	case "p90":
+		key = func(s *EndpointStats) float64 { return s.P90 }
+	case "p99":
+		key = func(s *EndpointStats) float64 { return s.P99 }
+	case "bytes_in":
+		key = func(s *EndpointStats) float64 { return float64(s.BytesIn) }
+	case "bytes_out":
+		key = func(s *EndpointStats) float64 { return float64(s.BytesOut) }
+	default:
+		return fmt.Errorf("bad sort field %q, use one of %s", field, strings.Join(SortFields, ", "))
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		a, b := &stats[i], &stats[j]
+		if key != nil && key(a) != key(b) {
+			return (key(a) < key(b)) != desc
+		}
+		if field == "route" && a.Route != b.Route {
+			return (a.Route < b.Route) != desc
+		}
+		if a.Host != b.Host {
+			return (a.Host < b.Host) != desc
+		}
+		return (a.Route < b.Route) != desc
+	})
+	return nil
+}
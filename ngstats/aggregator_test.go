@@ -0,0 +1,123 @@
+package ngstats
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSketch(t *testing.T) {
+	a, b := NewSketch(), NewSketch()
+	for i := 1; i <= 1000; i++ {
+		if i%2 == 0 {
+			a.Add(float64(i))
+		} else {
+			b.Add(float64(i))
+		}
+	}
+	a.Merge(b)
+	if a.Count() != 1000 {
+		t.Fatal("bad count:", a.Count())
+	}
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		want := q * 999
+		if got := a.Quantile(q); math.Abs(got-want-1)/want > 0.02 {
+			t.Errorf("quantile %v is %v, should be about %v", q, got, want+1)
+		}
+	}
+	if NewSketch().Quantile(0.5) != 0 {
+		t.Error("quantile of an empty sketch should be 0")
+	}
+}
+
+func TestWindows(t *testing.T) {
+	a := NewAggregator()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	add := func(route string, at time.Duration, status uint, d time.Duration) {
+		a.Add(Transaction{Host: "h", Route: route, Start: start.Add(at), Status: status,
+			Duration: d, BytesIn: 10, BytesOut: 100})
+	}
+	// 10 minutes ago, 4 minutes ago, now
+	add("/a", 0, 200, 10*time.Millisecond)
+	add("/a", 6*time.Minute, 500, 100*time.Millisecond)
+	add("/a", 10*time.Minute, 404, time.Second)
+	add("/b", 10*time.Minute, 200, time.Millisecond)
+
+	find := func(stats []EndpointStats, route string) *EndpointStats {
+		for i := range stats {
+			if stats[i].Route == route {
+				return &stats[i]
+			}
+		}
+		return nil
+	}
+	cases := []struct {
+		window   time.Duration
+		requests uint64
+	}{
+		{time.Minute, 1},
+		{5 * time.Minute, 2},
+		{15 * time.Minute, 3},
+	}
+	for _, c := range cases {
+		s := find(a.Stats(c.window), "/a")
+		if s == nil || s.Requests != c.requests {
+			t.Errorf("window %v: bad stats %+v", c.window, s)
+		}
+	}
+	s := find(a.Stats(5*time.Minute), "/a")
+	if s.Status["5xx"] != 1 || s.Status["4xx"] != 1 || s.ServerErrorRate != 0.5 || s.ClientErrorRate != 0.5 {
+		t.Errorf("bad status %+v", s)
+	}
+	if s.BytesIn != 20 || s.BytesOut != 200 || s.Rate != 2.0/300 {
+		t.Errorf("bad bytes or rate %+v", s)
+	}
+	if math.Abs(s.P99-1000)/1000 > 0.02 || math.Abs(s.P50-100)/100 > 0.02 {
+		t.Errorf("bad latency %+v", s)
+	}
+
+	// the old transactions are forgotten
+	add("/a", 30*time.Minute, 200, time.Millisecond)
+	if s := find(a.Stats(15*time.Minute), "/a"); s == nil || s.Requests != 1 {
+		t.Errorf("bad stats after 20 minutes %+v", s)
+	}
+	if find(a.Stats(15*time.Minute), "/b") != nil {
+		t.Error("/b should be expired")
+	}
+}
+
+func TestClock(t *testing.T) {
+	a := NewAggregator()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	a.Clock = func() time.Time { return now }
+	a.Add(Transaction{Host: "h", Route: "/", Start: now})
+	if len(a.Stats(time.Minute)) != 1 {
+		t.Fatal("no stats")
+	}
+	now = now.Add(2 * time.Minute)
+	if len(a.Stats(time.Minute)) != 0 {
+		t.Error("the window should end at the clock")
+	}
+}
+
+func TestMaxEndpointsAndSort(t *testing.T) {
+	a := NewAggregator()
+	a.MaxEndpoints = 2
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, route := range []string{"/a", "/b", "/c", "/d", "/b"} {
+		a.Add(Transaction{Host: "h", Route: route, Start: start, Duration: time.Duration(i) * time.Millisecond})
+	}
+	stats := a.Stats(time.Minute)
+	if err := Sort(stats, "requests", true); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 3 || stats[0].Requests != 2 || stats[len(stats)-1].Route != "/a" {
+		t.Errorf("bad stats %+v", stats)
+	}
+	if err := Sort(stats, "route", false); err != nil || stats[0].Route != "/a" || stats[2].Route != Other {
+		t.Errorf("bad sort by route %+v", stats)
+	}
+	if Sort(stats, "size", false) == nil {
+		t.Error("bad sort field should be rejected")
+	}
+}
@@ -0,0 +1,85 @@
+package ngstats
+
+import (
+	"math"
+	"sort"
+)
+
+// sketchAccuracy is the relative error of the quantiles
+const sketchAccuracy = 0.01
+
+// minSketchValue is the smallest positive value told apart from 0
+const minSketchValue = 1e-9
+
+var (
+	sketchGamma    = (1 + sketchAccuracy) / (1 - sketchAccuracy)
+	sketchLogGamma = math.Log(sketchGamma)
+)
+
+// Sketch estimates the quantiles of positive values with a relative error
+// of 1%. Values are counted in buckets of exponentially growing width, so
+// sketches are merged by adding the counts of their buckets.
+type Sketch struct {
+	bins  map[int]uint64
+	zeros uint64 // values below minSketchValue
+	count uint64
+}
+
+// NewSketch creates an empty Sketch
+func NewSketch() *Sketch {
+	return &Sketch{bins: make(map[int]uint64)}
+}
+
+// Add adds a value
+func (s *Sketch) Add(v float64) {
+	s.count++
+	if v < minSketchValue {
+		s.zeros++
+		return
+	}
+	s.bins[int(math.Ceil(math.Log(v)/sketchLogGamma))]++
+}
+
+// Merge adds the values of o
+func (s *Sketch) Merge(o *Sketch) {
+	for k, n := range o.bins {
+		s.bins[k] += n
+	}
+	s.zeros += o.zeros
+	s.count += o.count
+}
+
+// Count returns the number of values
+func (s *Sketch) Count() uint64 {
+	return s.count
+}
+
+// Quantile returns the estimated q-quantile (0 <= q <= 1), or 0 if the
+// sketch is empty
+func (s *Sketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	// nearest rank
+	rank := uint64(math.Ceil(q*float64(s.count))) - 1
+	if q <= 0 {
+		rank = 0
+	}
+	if rank < s.zeros {
+		return 0
+	}
+	keys := make([]int, 0, len(s.bins))
+	for k := range s.bins {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	n := s.zeros
+	for _, k := range keys {
+		n += s.bins[k]
+		if n > rank {
+			// the middle of the bucket (gamma^(k-1), gamma^k] in relative terms
+			return 2 * math.Pow(sketchGamma, float64(k)) / (sketchGamma + 1)
+		}
+	}
+	return 2 * math.Pow(sketchGamma, float64(keys[len(keys)-1])) / (sketchGamma + 1)
+}
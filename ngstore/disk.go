@@ -0,0 +1,493 @@
+package ngstore
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ga0/netgraph/ngnet"
+)
+
+const (
+	// a segment is sealed when this much uncompressed data is written to it
+	segmentRawBytes = 8 * 1024 * 1024
+	// or when its events span this long, so retention by age works with little traffic
+	segmentMaxSpan = time.Hour
+	segmentSuffix  = ".ndjson.gz"
+	indexSuffix    = ".idx"
+	flushInterval  = time.Second
+)
+
+// segmentIndex describes the events in a segment file
+type segmentIndex struct {
+	Events int
+	Bytes  int64
+	Oldest time.Time
+	Newest time.Time
+	MinSeq uint
+	MaxSeq uint
+}
+
+func (idx *segmentIndex) add(seq uint, start time.Time) {
+	if idx.Events == 0 || seq < idx.MinSeq {
+		idx.MinSeq = seq
+	}
+	if idx.Events == 0 || seq > idx.MaxSeq {
+		idx.MaxSeq = seq
+	}
+	if idx.Events == 0 || start.Before(idx.Oldest) {
+		idx.Oldest = start
+	}
+	if idx.Events == 0 || start.After(idx.Newest) {
+		idx.Newest = start
+	}
+	idx.Events++
+}
+
+type segment struct {
+	number int
+	path   string
+	index  segmentIndex
+}
+
+type countingWriter struct {
+	w     io.Writer
+	count *int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.count += int64(n)
+	return n, err
+}
+
+// DiskStore is a Store appending events to gzip compressed segment files
+// in a directory, one JSON object per line. Each sealed segment has an index
+// file with its time range and StreamSeq range, so queries skip the segments
+// they don't need. Old segments are removed to keep the store in its limits.
+// The events in the directory are loaded again when the store is reopened.
+// The events are flushed to the active segment every second, and it is
+// sealed by Close.
+type DiskStore struct {
+	mutex    sync.Mutex
+	dir      string
+	limits   Limits
+	sealed   []*segment
+	active   *segment
+	file     *os.File
+	gzip     *gzip.Writer
+	rawBytes int64
+	dirty    bool // events written since the last flush
+	nextSeq  uint
+	closed   chan struct{}
+
+	evicted      uint64
+	evictedBytes uint64
+}
+
+// NewDiskStore opens or creates a DiskStore in dir
+func NewDiskStore(dir string, limits Limits) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := new(DiskStore)
+	s.dir = dir
+	s.limits = limits
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	s.applyLimits()
+	if err := s.newSegment(); err != nil {
+		return nil, err
+	}
+	s.closed = make(chan struct{})
+	go s.flushLoop()
+	return s, nil
+}
+
+func segmentPath(dir string, number int) string {
+	return filepath.Join(dir, fmt.Sprintf("segment-%08d%s", number, segmentSuffix))
+}
+
+func (s *DiskStore) load() error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "segment-*"+segmentSuffix))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		seg := new(segment)
+		seg.path = path
+		name := strings.TrimSuffix(filepath.Base(path), segmentSuffix)
+		if _, err := fmt.Sscanf(name, "segment-%d", &seg.number); err != nil {
+			continue
+		}
+		if err := s.loadIndex(seg); err != nil {
+			return err
+		}
+		if seg.index.Events == 0 {
+			os.Remove(path)
+			os.Remove(path + indexSuffix)
+			continue
+		}
+		if seg.index.MaxSeq+1 > s.nextSeq {
+			s.nextSeq = seg.index.MaxSeq + 1
+		}
+		s.sealed = append(s.sealed, seg)
+	}
+	return nil
+}
+
+// loadIndex reads the index of a segment, or rebuilds it if the segment
+// was not sealed, e.g. the process was killed.
+func (s *DiskStore) loadIndex(seg *segment) error {
+	if b, err := ioutil.ReadFile(seg.path + indexSuffix); err == nil {
+		if json.Unmarshal(b, &seg.index) == nil {
+			return nil
+		}
+	}
+	log.Printf("rebuild index of segment %s\n", seg.path)
+	seg.index = segmentIndex{}
+	err := readSegment(seg.path, -1, func(e ngnet.Event) {
+		seq, start, _ := EventInfo(e)
+		seg.index.add(seq, start)
+	})
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(seg.path); err == nil {
+		seg.index.Bytes = fi.Size()
+	}
+	return writeIndex(seg)
+}
+
+func writeIndex(seg *segment) error {
+	b, err := json.Marshal(seg.index)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(seg.path+indexSuffix, b, 0644)
+}
+
+// decodeEvent decodes an event encoded as JSON by the Type field. The
+// events saved by a former version get the fields of the current one.
+func decodeEvent(b []byte) (ngnet.Event, error) {
+	var t struct{ Type string }
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, err
+	}
+	switch t.Type {
+	case ngnet.KindHTTPRequest:
+		var e ngnet.HTTPRequestEvent
+		err := json.Unmarshal(b, &e)
+		return ngnet.Upgrade(e), err
+	case ngnet.KindHTTPResponse:
+		var e ngnet.HTTPResponseEvent
+		err := json.Unmarshal(b, &e)
+		return ngnet.Upgrade(e), err
+	}
+	return nil, fmt.Errorf("unknown event type %q", t.Type)
+}
+
+// readSegment calls f for each event in the first size bytes of a segment,
+// all of it if size is negative. A truncated segment is read up to the last
+// complete event.
+func readSegment(path string, size int64, f func(e ngnet.Event)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if size >= 0 {
+		r = io.LimitReader(file, size)
+	}
+	zr, err := gzip.NewReader(bufio.NewReader(r))
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	lines := bufio.NewReader(zr)
+	for {
+		line, err := lines.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			if e, derr := decodeEvent(line); derr == nil {
+				f(e)
+			} else {
+				log.Printf("bad event in segment %s: %v\n", path, derr)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *DiskStore) newSegment() error {
+	seg := new(segment)
+	if n := len(s.sealed); n > 0 {
+		seg.number = s.sealed[n-1].number + 1
+	}
+	seg.path = segmentPath(s.dir, seg.number)
+	file, err := os.OpenFile(seg.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	s.active = seg
+	s.file = file
+	s.gzip = gzip.NewWriter(countingWriter{file, &seg.index.Bytes})
+	s.rawBytes = 0
+	return nil
+}
+
+func (s *DiskStore) seal() error {
+	seg := s.active
+	s.active = nil
+	err := s.gzip.Close()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if seg.index.Events == 0 {
+		os.Remove(seg.path)
+		return nil
+	}
+	s.sealed = append(s.sealed, seg)
+	return writeIndex(seg)
+}
+
+func (s *DiskStore) totals() (events int, bytes int64) {
+	for _, seg := range s.sealed {
+		events += seg.index.Events
+		bytes += seg.index.Bytes
+	}
+	if s.active != nil {
+		events += s.active.index.Events
+		bytes += s.active.index.Bytes
+	}
+	return
+}
+
+// applyLimits removes the oldest sealed segments until the store is in its limits
+func (s *DiskStore) applyLimits() {
+	var newest time.Time
+	for _, seg := range s.sealed {
+		if seg.index.Newest.After(newest) {
+			newest = seg.index.Newest
+		}
+	}
+	if s.active != nil && s.active.index.Newest.After(newest) {
+		newest = s.active.index.Newest
+	}
+	for len(s.sealed) > 0 {
+		events, bytes := s.totals()
+		oldest := s.sealed[0]
+		over := (s.limits.MaxEvents > 0 && events > s.limits.MaxEvents) ||
+			(s.limits.MaxBytes > 0 && bytes > s.limits.MaxBytes) ||
+			(s.limits.MaxAge > 0 && newest.Sub(oldest.index.Newest) > s.limits.MaxAge)
+		if !over {
+			break
+		}
+		os.Remove(oldest.path)
+		os.Remove(oldest.path + indexSuffix)
+		s.evicted += uint64(oldest.index.Events)
+		s.evictedBytes += uint64(oldest.index.Bytes)
+		s.sealed = s.sealed[1:]
+	}
+}
+
+// NextSeq returns the StreamSeq following the ones saved in the store,
+// so the streams captured after a restart don't mix with the saved ones.
+func (s *DiskStore) NextSeq() uint {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.nextSeq
+}
+
+// Add implements Store
+func (s *DiskStore) Add(e ngnet.Event) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Println("cannot encode event:", err)
+		return
+	}
+	b = append(b, '\n')
+	seq, start, _ := EventInfo(e)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.active == nil {
+		return
+	}
+	if _, err := s.gzip.Write(b); err != nil {
+		log.Println("cannot write event:", err)
+		return
+	}
+	s.active.index.add(seq, start)
+	s.rawBytes += int64(len(b))
+	s.dirty = true
+	if seq+1 > s.nextSeq {
+		s.nextSeq = seq + 1
+	}
+
+	idx := &s.active.index
+	if s.rawBytes >= segmentRawBytes || idx.Newest.Sub(idx.Oldest) >= segmentMaxSpan {
+		if err := s.seal(); err != nil {
+			log.Println("cannot seal segment:", err)
+		}
+		s.applyLimits()
+		if err := s.newSegment(); err != nil {
+			log.Println("cannot create segment:", err)
+		}
+	}
+}
+
+// flush writes the events buffered by gzip to the active segment
+func (s *DiskStore) flush() {
+	if s.active != nil && s.dirty {
+		if err := s.gzip.Flush(); err != nil {
+			log.Println("cannot flush segment:", err)
+		}
+		s.dirty = false
+	}
+}
+
+func (s *DiskStore) flushLoop() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+			s.mutex.Lock()
+			s.flush()
+			s.mutex.Unlock()
+		}
+	}
+}
+
+// segmentView is a segment as it was when a read started
+type segmentView struct {
+	path  string
+	index segmentIndex
+	size  int64 // bytes to read, the flushed part of the active segment, -1 for a sealed segment
+}
+
+// read calls f for the events of the segments selected by match. The
+// segments are read without holding the mutex, so Add is not blocked.
+func (s *DiskStore) read(match func(idx *segmentIndex) bool, f func(e ngnet.Event)) {
+	s.mutex.Lock()
+	s.flush()
+	var views []segmentView
+	for _, seg := range s.sealed {
+		views = append(views, segmentView{seg.path, seg.index, -1})
+	}
+	if s.active != nil {
+		views = append(views, segmentView{s.active.path, s.active.index, s.active.index.Bytes})
+	}
+	s.mutex.Unlock()
+
+	for _, v := range views {
+		if v.index.Events == 0 || !match(&v.index) {
+			continue
+		}
+		// a sealed segment may have been evicted since
+		if err := readSegment(v.path, v.size, f); err != nil && !os.IsNotExist(err) {
+			log.Printf("cannot read segment %s: %v\n", v.path, err)
+		}
+	}
+}
+
+// Events implements Store
+func (s *DiskStore) Events() []ngnet.Event {
+	var events []ngnet.Event
+	s.read(func(*segmentIndex) bool { return true }, func(e ngnet.Event) {
+		events = append(events, e)
+	})
+	return events
+}
+
+// Since implements Store
+func (s *DiskStore) Since(t time.Time) []ngnet.Event {
+	var events []ngnet.Event
+	s.read(func(idx *segmentIndex) bool {
+		return !idx.Newest.Before(t)
+	}, func(e ngnet.Event) {
+		if _, start, _ := EventInfo(e); !start.Before(t) {
+			events = append(events, e)
+		}
+	})
+	return events
+}
+
+// BySeq implements Store
+func (s *DiskStore) BySeq(seq uint) []ngnet.Event {
+	var events []ngnet.Event
+	s.read(func(idx *segmentIndex) bool {
+		return seq >= idx.MinSeq && seq <= idx.MaxSeq
+	}, func(e ngnet.Event) {
+		if eseq, _, _ := EventInfo(e); eseq == seq {
+			events = append(events, e)
+		}
+	})
+	return events
+}
+
+// Stats implements Store
+func (s *DiskStore) Stats() Stats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var st Stats
+	st.Limits = s.limits
+	st.Events, st.Bytes = s.totals()
+	st.EvictedEvents = s.evicted
+	st.EvictedBytes = s.evictedBytes
+	segs := s.sealed
+	if s.active != nil {
+		segs = append(segs[:len(segs):len(segs)], s.active)
+	}
+	for _, seg := range segs {
+		if seg.index.Events == 0 {
+			continue
+		}
+		if st.Oldest.IsZero() || seg.index.Oldest.Before(st.Oldest) {
+			st.Oldest = seg.index.Oldest
+		}
+		if seg.index.Newest.After(st.Newest) {
+			st.Newest = seg.index.Newest
+		}
+	}
+	return st
+}
+
+// Close implements Store, the active segment is sealed
+func (s *DiskStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	select {
+	case <-s.closed:
+		return nil
+	default:
+		close(s.closed)
+	}
+	if s.active == nil {
+		return nil
+	}
+	return s.seal()
+}
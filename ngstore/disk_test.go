@@ -0,0 +1,158 @@
+package ngstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ga0/netgraph/ngnet"
+)
+
+func TestDiskStoreReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ngstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewDiskStore(dir, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint(0); i < 10; i++ {
+		s.Add(request(i%3, t0.Add(time.Duration(i)*time.Second), "body"))
+	}
+	var resp ngnet.HTTPResponseEvent
+	resp.Type = "HTTPResponse"
+	resp.StreamSeq = 1
+	resp.Start = t0.Add(time.Minute)
+	resp.Code = 200
+	s.Add(resp)
+
+	// the active segment can be read before it is sealed
+	if n := len(s.Events()); n != 11 {
+		t.Error("unexpected event count:", n)
+	}
+	s.Close()
+
+	s, err = NewDiskStore(dir, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	events := s.Events()
+	if len(events) != 11 {
+		t.Fatal("unexpected event count after reopen:", len(events))
+	}
+	if req := events[0].(ngnet.HTTPRequestEvent); string(req.Body) != "body" || !req.Start.Equal(t0) {
+		t.Error("bad event after reopen:", req)
+	}
+	if r, ok := events[10].(ngnet.HTTPResponseEvent); !ok || r.Code != 200 {
+		t.Error("bad response after reopen:", events[10])
+	}
+	// the events saved without ID, like by a former netgraph, get one
+	if r := events[10].(ngnet.HTTPResponseEvent); r.ID != "1.0:response" || r.RequestID != "1.0:request" {
+		t.Error("bad ID after reopen:", r.ID, r.RequestID)
+	}
+	if n := len(s.BySeq(1)); n != 4 {
+		t.Error("unexpected events of stream 1:", n)
+	}
+	if n := len(s.Since(t0.Add(8 * time.Second))); n != 3 {
+		t.Error("unexpected events since:", n)
+	}
+	if s.NextSeq() != 3 {
+		t.Error("unexpected next seq:", s.NextSeq())
+	}
+}
+
+func TestDiskStoreUnsealedSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ngstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewDiskStore(dir, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(request(0, t0, ""))
+	s.Add(request(1, t0, ""))
+	// simulate a killed process: flushed but never sealed
+	s.Events()
+
+	s2, err := NewDiskStore(dir, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	if n := len(s2.Events()); n != 2 {
+		t.Error("unexpected event count:", n)
+	}
+}
+
+func TestDiskStoreFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ngstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewDiskStore(dir, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Add(request(0, t0, ""))
+	// the event is flushed without another Add or a read
+	deadline := time.Now().Add(3 * flushInterval)
+	for {
+		var n int
+		readSegment(segmentPath(dir, 0), -1, func(ngnet.Event) { n++ })
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("event not flushed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestDiskStoreRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ngstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// every reopen seals a segment with one event
+	for i := uint(0); i < 5; i++ {
+		s, err := NewDiskStore(dir, Limits{MaxAge: 90 * time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Add(request(i, t0.Add(time.Duration(i)*time.Minute), ""))
+		s.Close()
+	}
+	s, err := NewDiskStore(dir, Limits{MaxAge: 90 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if seqs := seqsOf(s.Events()); !equalSeqs(seqs, []uint{3, 4}) {
+		t.Error("unexpected events:", seqs)
+	}
+	segs, _ := filepath.Glob(filepath.Join(dir, "*"))
+	for _, seg := range segs {
+		if !strings.Contains(seg, "segment-") {
+			t.Error("unexpected file:", seg)
+		}
+	}
+	if st := s.Stats(); st.Events != 2 {
+		t.Error("unexpected stats:", st)
+	}
+}
@@ -0,0 +1,196 @@
+package ngstore
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ga0/netgraph/ngnet"
+)
+
+const initialCapacity = 1024
+
+type entry struct {
+	id    uint64
+	event ngnet.Event
+	seq   uint
+	start time.Time
+	// index is the max start time of this and all the previous entries,
+	// so the entries are sorted by index even if the events are not sorted by start.
+	index time.Time
+	size  int64
+}
+
+// MemoryStore is a Store keeping events in a ring buffer
+type MemoryStore struct {
+	mutex        sync.RWMutex
+	limits       Limits
+	entries      []entry
+	head         int // position of the oldest entry
+	count        int
+	nextID       uint64
+	bytes        int64
+	bySeq        map[uint][]uint64
+	evicted      uint64
+	evictedBytes uint64
+}
+
+// NewMemoryStore creates MemoryStore
+func NewMemoryStore(limits Limits) *MemoryStore {
+	s := new(MemoryStore)
+	s.limits = limits
+	capacity := initialCapacity
+	if limits.MaxEvents > 0 && limits.MaxEvents < capacity {
+		capacity = limits.MaxEvents
+	}
+	s.entries = make([]entry, capacity)
+	s.bySeq = make(map[uint][]uint64)
+	return s
+}
+
+func (s *MemoryStore) at(i int) *entry {
+	return &s.entries[(s.head+i)%len(s.entries)]
+}
+
+// get returns the entry with the id, it must be in the store
+func (s *MemoryStore) get(id uint64) *entry {
+	return s.at(int(id - s.at(0).id))
+}
+
+func (s *MemoryStore) grow() {
+	entries := make([]entry, len(s.entries)*2)
+	for i := 0; i < s.count; i++ {
+		entries[i] = *s.at(i)
+	}
+	s.entries = entries
+	s.head = 0
+}
+
+func (s *MemoryStore) evictOldest() {
+	e := s.at(0)
+	ids := s.bySeq[e.seq]
+	if len(ids) <= 1 {
+		delete(s.bySeq, e.seq)
+	} else {
+		s.bySeq[e.seq] = ids[1:]
+	}
+	s.bytes -= e.size
+	s.evicted++
+	s.evictedBytes += uint64(e.size)
+	*e = entry{}
+	s.head = (s.head + 1) % len(s.entries)
+	s.count--
+}
+
+func (s *MemoryStore) overLimits() bool {
+	if s.count == 0 {
+		return false
+	}
+	l := s.limits
+	if l.MaxEvents > 0 && s.count > l.MaxEvents {
+		return true
+	}
+	if l.MaxBytes > 0 && s.bytes > l.MaxBytes {
+		return true
+	}
+	newest := s.at(s.count - 1).index
+	if l.MaxAge > 0 && newest.Sub(s.at(0).index) > l.MaxAge {
+		return true
+	}
+	return false
+}
+
+// Add implements Store
+func (s *MemoryStore) Add(ev ngnet.Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.count == len(s.entries) {
+		if s.limits.MaxEvents > 0 && s.count >= s.limits.MaxEvents {
+			s.evictOldest()
+		} else {
+			s.grow()
+		}
+	}
+
+	var e entry
+	e.id = s.nextID
+	e.event = ev
+	e.seq, e.start, e.size = EventInfo(ev)
+	e.index = e.start
+	if s.count > 0 {
+		if last := s.at(s.count - 1).index; last.After(e.index) {
+			e.index = last
+		}
+	}
+	s.nextID++
+	s.count++
+	*s.at(s.count - 1) = e
+	s.bytes += e.size
+	s.bySeq[e.seq] = append(s.bySeq[e.seq], e.id)
+
+	for s.overLimits() {
+		s.evictOldest()
+	}
+}
+
+// Events implements Store
+func (s *MemoryStore) Events() []ngnet.Event {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	events := make([]ngnet.Event, 0, s.count)
+	for i := 0; i < s.count; i++ {
+		events = append(events, s.at(i).event)
+	}
+	return events
+}
+
+// Since implements Store
+func (s *MemoryStore) Since(t time.Time) []ngnet.Event {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	first := sort.Search(s.count, func(i int) bool {
+		return !s.at(i).index.Before(t)
+	})
+	var events []ngnet.Event
+	for i := first; i < s.count; i++ {
+		if e := s.at(i); !e.start.Before(t) {
+			events = append(events, e.event)
+		}
+	}
+	return events
+}
+
+// BySeq implements Store
+func (s *MemoryStore) BySeq(seq uint) []ngnet.Event {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	ids := s.bySeq[seq]
+	events := make([]ngnet.Event, 0, len(ids))
+	for _, id := range ids {
+		events = append(events, s.get(id).event)
+	}
+	return events
+}
+
+// Stats implements Store
+func (s *MemoryStore) Stats() Stats {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var st Stats
+	st.Limits = s.limits
+	st.Events = s.count
+	st.Bytes = s.bytes
+	st.EvictedEvents = s.evicted
+	st.EvictedBytes = s.evictedBytes
+	if s.count > 0 {
+		st.Oldest = s.at(0).start
+		st.Newest = s.at(s.count - 1).index
+	}
+	return st
+}
+
+// Close implements Store
+func (s *MemoryStore) Close() error {
+	return nil
+}
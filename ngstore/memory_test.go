@@ -0,0 +1,107 @@
+package ngstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ga0/netgraph/ngnet"
+)
+
+var t0 = time.Date(2018, 7, 26, 10, 0, 0, 0, time.UTC)
+
+func request(seq uint, start time.Time, body string) ngnet.HTTPRequestEvent {
+	var req ngnet.HTTPRequestEvent
+	req.Type = "HTTPRequest"
+	req.StreamSeq = seq
+	req.Start = start
+	req.End = start
+	req.Method = "GET"
+	req.URI = "/"
+	req.Body = []byte(body)
+	return req
+}
+
+func seqsOf(events []ngnet.Event) (seqs []uint) {
+	for _, e := range events {
+		seqs = append(seqs, e.(ngnet.HTTPRequestEvent).StreamSeq)
+	}
+	return
+}
+
+func equalSeqs(a, b []uint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMemoryStoreMaxEvents(t *testing.T) {
+	s := NewMemoryStore(Limits{MaxEvents: 3})
+	for i := uint(0); i < 10; i++ {
+		s.Add(request(i, t0.Add(time.Duration(i)*time.Second), ""))
+	}
+	if seqs := seqsOf(s.Events()); !equalSeqs(seqs, []uint{7, 8, 9}) {
+		t.Error("unexpected events:", seqs)
+	}
+	st := s.Stats()
+	if st.Events != 3 || st.EvictedEvents != 7 {
+		t.Error("unexpected stats:", st)
+	}
+	if len(s.BySeq(1)) != 0 || len(s.BySeq(8)) != 1 {
+		t.Error("bad StreamSeq index")
+	}
+}
+
+func TestMemoryStoreMaxBytes(t *testing.T) {
+	_, _, size := EventInfo(request(0, t0, "0123456789"))
+	s := NewMemoryStore(Limits{MaxBytes: size * 2})
+	for i := uint(0); i < 5; i++ {
+		s.Add(request(i, t0, "0123456789"))
+	}
+	if seqs := seqsOf(s.Events()); !equalSeqs(seqs, []uint{3, 4}) {
+		t.Error("unexpected events:", seqs)
+	}
+	if s.Stats().Bytes != size*2 {
+		t.Error("unexpected bytes:", s.Stats().Bytes)
+	}
+}
+
+func TestMemoryStoreMaxAge(t *testing.T) {
+	s := NewMemoryStore(Limits{MaxAge: time.Minute})
+	for i := uint(0); i < 5; i++ {
+		s.Add(request(i, t0.Add(time.Duration(i)*30*time.Second), ""))
+	}
+	if seqs := seqsOf(s.Events()); !equalSeqs(seqs, []uint{2, 3, 4}) {
+		t.Error("unexpected events:", seqs)
+	}
+}
+
+func TestMemoryStoreIndexes(t *testing.T) {
+	s := NewMemoryStore(Limits{})
+	// more events than the initial capacity, so the ring buffer grows
+	stream3 := 0
+	for i := 0; i < initialCapacity*3; i++ {
+		s.Add(request(uint(i%7), t0.Add(time.Duration(i)*time.Millisecond), ""))
+		if i%7 == 3 {
+			stream3++
+		}
+	}
+	// an event older than the previous one
+	s.Add(request(100, t0, ""))
+
+	if n := len(s.BySeq(3)); n != stream3 {
+		t.Error("unexpected events of stream 3:", n)
+	}
+	since := s.Since(t0.Add(time.Duration(initialCapacity*3-2) * time.Millisecond))
+	if seqs := seqsOf(since); len(seqs) != 2 {
+		t.Error("unexpected events since:", seqs)
+	}
+	if n := len(s.Since(t0)); n != initialCapacity*3+1 {
+		t.Error("unexpected events since t0:", n)
+	}
+}
@@ -0,0 +1,66 @@
+// Package ngstore saves the HTTP events captured by ngnet,
+// so they can be sent to the clients connected later.
+package ngstore
+
+import (
+	"time"
+
+	"github.com/ga0/netgraph/ngnet"
+)
+
+// Store saves HTTP events. All the methods are safe for concurrent use.
+type Store interface {
+	// Add saves an event, old events may be evicted to keep the store in its limits
+	Add(e ngnet.Event)
+	// Events returns all the saved events, in the order they were added
+	Events() []ngnet.Event
+	// Since returns the saved events which started at or after t
+	Since(t time.Time) []ngnet.Event
+	// BySeq returns the saved events of the TCP connection with the StreamSeq
+	BySeq(seq uint) []ngnet.Event
+	// Stats returns the statistics of the store
+	Stats() Stats
+	// Close releases the resources of the store
+	Close() error
+}
+
+// Limits bounds the size of a store, zero means unlimited
+type Limits struct {
+	MaxEvents int
+	MaxBytes  int64
+	// MaxAge is relative to the newest event, not to the wall clock,
+	// so it also works for events read from a pcap file.
+	MaxAge time.Duration
+}
+
+// Stats is the statistics of a store
+type Stats struct {
+	Limits
+	Events        int
+	Bytes         int64
+	EvictedEvents uint64
+	EvictedBytes  uint64
+	Oldest        time.Time
+	Newest        time.Time
+}
+
+// EventInfo returns the StreamSeq, the start time and the approximate
+// memory size of an event
+func EventInfo(e ngnet.Event) (seq uint, start time.Time, size int64) {
+	const overhead = 256
+	headerSize := func(hs []ngnet.HTTPHeaderItem) (n int64) {
+		for _, h := range hs {
+			n += int64(len(h.Name)+len(h.Value)) + 32
+		}
+		return
+	}
+	switch v := e.(type) {
+	case ngnet.HTTPRequestEvent:
+		size = overhead + int64(len(v.URI)+len(v.Body)) + headerSize(v.Headers)
+		return v.StreamSeq, v.Start, size
+	case ngnet.HTTPResponseEvent:
+		size = overhead + int64(len(v.Reason)+len(v.Body)) + headerSize(v.Headers)
+		return v.StreamSeq, v.Start, size
+	}
+	return 0, time.Time{}, overhead
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ga0/netgraph/ngnet"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// A connection that buffered more than this without matching is given up.
+const maxPendingConnBytes = 16 * 1024 * 1024
+
+// pcapMatchFilter selects the HTTP transactions whose connections are written.
+// Empty fields match everything.
+type pcapMatchFilter struct {
+	host       string
+	pathPrefix string
+	method     string
+	minCode    uint
+	maxCode    uint
+}
+
+// parseCodeRange parses a status code range like "500-599" or "404"
+func parseCodeRange(s string) (min uint, max uint, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	parts := strings.SplitN(s, "-", 2)
+	lo, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad status code range %q", s)
+	}
+	hi := lo
+	if len(parts) == 2 {
+		hi, err = strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 32)
+		if err != nil || hi < lo {
+			return 0, 0, fmt.Errorf("bad status code range %q", s)
+		}
+	}
+	return uint(lo), uint(hi), nil
+}
+
+func (f *pcapMatchFilter) hasCodeRange() bool {
+	return f.maxCode != 0
+}
+
+func (f *pcapMatchFilter) matchRequest(req ngnet.HTTPRequestEvent) bool {
+	if f.method != "" && !strings.EqualFold(f.method, req.Method) {
+		return false
+	}
+	if f.pathPrefix != "" && !strings.HasPrefix(req.URI, f.pathPrefix) {
+		return false
+	}
+	if f.host != "" {
+		host := headerValue(req.Headers, "Host")
+		if p := strings.LastIndex(host, ":"); p != -1 {
+			host = host[:p]
+		}
+		if !strings.EqualFold(f.host, host) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *pcapMatchFilter) matchResponse(resp ngnet.HTTPResponseEvent) bool {
+	if !f.hasCodeRange() {
+		return true
+	}
+	return resp.Code >= f.minCode && resp.Code <= f.maxCode
+}
+
+// connKey identifies a TCP connection regardless of packet direction
+type connKey struct {
+	a, b string
+}
+
+func newConnKey(addr1, addr2 string) connKey {
+	if addr1 > addr2 {
+		addr1, addr2 = addr2, addr1
+	}
+	return connKey{addr1, addr2}
+}
+
+type bufferedPacket struct {
+	ci   gopacket.CaptureInfo
+	data []byte
+}
+
+type bufferedConn struct {
+	matched  bool
+	givenUp  bool
+	packets  []bufferedPacket
+	bytes    int
+	requests []bool // match results of requests waiting for their response
+	lastSeen time.Time
+}
+
+// matchedPcapWriter writes only the packets of connections that carried an
+// HTTP transaction matching the filter. Packets are buffered per connection
+// until the HTTP events of the connection decide whether it is written or
+// dropped.
+type matchedPcapWriter struct {
+	mutex  sync.Mutex
+	name   string
+	file   *os.File
+	writer *pcapgo.Writer
+	filter pcapMatchFilter
+	conns  map[connKey]*bufferedConn
+}
+
+func newMatchedPcapWriter(name string, filter pcapMatchFilter) *matchedPcapWriter {
+	w := new(matchedPcapWriter)
+	w.name = name
+	var err error
+	w.file, w.writer, err = createPcapFile(name)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	w.filter = filter
+	w.conns = make(map[connKey]*bufferedConn)
+	return w
+}
+
+func (w *matchedPcapWriter) getConn(key connKey) *bufferedConn {
+	c, ok := w.conns[key]
+	if !ok {
+		c = new(bufferedConn)
+		w.conns[key] = c
+	}
+	return c
+}
+
+// HandlePacket writes the packet if its connection already matched, otherwise
+// buffers it until a decision can be made.
+func (w *matchedPcapWriter) HandlePacket(packet gopacket.Packet, netFlow gopacket.Flow, tcp *layers.TCP) {
+	tcpFlow := tcp.TransportFlow()
+	key := newConnKey(
+		netFlow.Src().String()+":"+tcpFlow.Src().String(),
+		netFlow.Dst().String()+":"+tcpFlow.Dst().String())
+	ci := packet.Metadata().CaptureInfo
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	c := w.getConn(key)
+	c.lastSeen = ci.Timestamp
+	if c.matched {
+		w.writer.WritePacket(ci, packet.Data())
+		return
+	}
+	if c.givenUp {
+		return
+	}
+	c.packets = append(c.packets, bufferedPacket{ci, packet.Data()})
+	c.bytes += len(packet.Data())
+	if c.bytes > maxPendingConnBytes {
+		log.Printf("output-pcap: connection %s<->%s buffered too much data, dropped\n", key.a, key.b)
+		c.givenUp = true
+		c.packets = nil
+		c.bytes = 0
+	}
+}
+
+func (w *matchedPcapWriter) setMatched(c *bufferedConn) {
+	if c.matched {
+		return
+	}
+	c.matched = true
+	for _, p := range c.packets {
+		w.writer.WritePacket(p.ci, p.data)
+	}
+	c.packets = nil
+	c.bytes = 0
+}
+
+// FlushOlderThan forgets connections which have not seen packets since t.
+// Buffered packets of connections which never matched are discarded.
+func (w *matchedPcapWriter) FlushOlderThan(t time.Time) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for key, c := range w.conns {
+		if c.lastSeen.Before(t) {
+			delete(w.conns, key)
+		}
+	}
+}
+
+// PushEvent implements the function of interface NGHTTPEventHandler
+func (w *matchedPcapWriter) PushEvent(e ngnet.Event) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	switch v := e.(type) {
+	case ngnet.HTTPRequestEvent:
+		c := w.getConn(newConnKey(v.ClientAddr, v.ServerAddr))
+		ok := w.filter.matchRequest(v)
+		if ok && !w.filter.hasCodeRange() {
+			w.setMatched(c)
+		}
+		c.requests = append(c.requests, ok)
+	case ngnet.HTTPResponseEvent:
+		c := w.getConn(newConnKey(v.ClientAddr, v.ServerAddr))
+		if len(c.requests) == 0 {
+			return
+		}
+		reqMatched := c.requests[0]
+		c.requests = c.requests[1:]
+		if reqMatched && w.filter.matchResponse(v) {
+			w.setMatched(c)
+		}
+	}
+}
+
+// Reopen starts a new pcap file after the former one was rotated. The
+// packets of a connection may be split across the files.
+func (w *matchedPcapWriter) Reopen() error {
+	file, writer, err := createPcapFile(w.name)
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.file.Close()
+	w.file, w.writer = file, writer
+	return nil
+}
+
+// Wait implements the function of interface NGHTTPEventHandler.
+// It is called after all events are handled, so the pcap file is complete.
+func (w *matchedPcapWriter) Wait() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.conns = make(map[connKey]*bufferedConn)
+	w.file.Close()
+}
+
+// pcapFileWriter writes all the TCP packets to a pcap file
+type pcapFileWriter struct {
+	mutex  sync.Mutex
+	name   string
+	file   *os.File
+	writer *pcapgo.Writer
+}
+
+func newPcapFileWriter(name string) *pcapFileWriter {
+	w := new(pcapFileWriter)
+	w.name = name
+	var err error
+	w.file, w.writer, err = createPcapFile(name)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return w
+}
+
+// HandlePacket writes a packet
+func (w *pcapFileWriter) HandlePacket(packet gopacket.Packet, netFlow gopacket.Flow, tcp *layers.TCP) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.writer.WritePacket(packet.Metadata().CaptureInfo, packet.Data())
+}
+
+// FlushOlderThan does nothing, the packets are not buffered
+func (w *pcapFileWriter) FlushOlderThan(t time.Time) {
+}
+
+// Reopen starts a new pcap file after the former one was rotated
+func (w *pcapFileWriter) Reopen() error {
+	file, writer, err := createPcapFile(w.name)
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.file.Close()
+	w.file, w.writer = file, writer
+	return nil
+}
+
+// Close closes the pcap file, once the capture is finished
+func (w *pcapFileWriter) Close() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.file.Close()
+}
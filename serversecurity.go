@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// tokenCookie keeps the bearer token given in the URL for the following requests
+const tokenCookie = "netgraph_token"
+
+// serverSecurity is the TLS, the authentication and the websocket origin
+// check of the web server. The zero value serves plain HTTP to everyone.
+type serverSecurity struct {
+	tlsConfig      *tls.Config // nil serves plain HTTP
+	basicUser      string
+	basicPassword  string
+	token          string
+	allowedOrigins []string // empty means the origin must be the server itself
+}
+
+// readSecret returns the value of a flag, or the content of the file if
+// the value is "@file", so secrets don't show in the process list.
+func readSecret(value string) (string, error) {
+	if !strings.HasPrefix(value, "@") {
+		return value, nil
+	}
+	data, err := ioutil.ReadFile(value[1:])
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// setBasicAuth sets the credentials of HTTP basic authentication as "user:password"
+func (s *serverSecurity) setBasicAuth(credentials string) error {
+	credentials, err := readSecret(credentials)
+	if err != nil {
+		return err
+	}
+	p := strings.Index(credentials, ":")
+	if p <= 0 || p == len(credentials)-1 {
+		return errors.New("basic auth credentials must be user:password")
+	}
+	s.basicUser = credentials[:p]
+	s.basicPassword = credentials[p+1:]
+	return nil
+}
+
+func (s *serverSecurity) setToken(token string) error {
+	token, err := readSecret(token)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return errors.New("empty auth token")
+	}
+	s.token = token
+	return nil
+}
+
+// setTLS loads the certificate, or generates a self-signed one if certFile is empty
+func (s *serverSecurity) setTLS(certFile string, keyFile string) error {
+	var cert tls.Certificate
+	var err error
+	if certFile != "" {
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	} else {
+		cert, err = selfSignedCertificate()
+	}
+	if err != nil {
+		return err
+	}
+	s.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	return nil
+}
+
+// selfSignedCertificate generates a certificate for localhost and the host name
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"netgraph"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	log.Printf("generated self-signed certificate, SHA-256 fingerprint %X\n", sha256.Sum256(der))
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func (s *serverSecurity) authRequired() bool {
+	return s.basicUser != "" || s.token != ""
+}
+
+func secretEqual(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// authenticate tells whether the request has valid credentials
+func (s *serverSecurity) authenticate(w http.ResponseWriter, r *http.Request) bool {
+	if s.basicUser != "" {
+		if user, password, ok := r.BasicAuth(); ok {
+			return secretEqual(user, s.basicUser) && secretEqual(password, s.basicPassword)
+		}
+	}
+	if s.token == "" {
+		return false
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return secretEqual(strings.TrimPrefix(auth, "Bearer "), s.token)
+	}
+	if c, err := r.Cookie(tokenCookie); err == nil && secretEqual(c.Value, s.token) {
+		return true
+	}
+	// browsers can't set headers, open the web page with ?token=... once
+	if token := r.URL.Query().Get("token"); token != "" && secretEqual(token, s.token) {
+		http.SetCookie(w, &http.Cookie{
+			Name:     tokenCookie,
+			Value:    s.token,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   s.tlsConfig != nil,
+			SameSite: http.SameSiteStrictMode,
+		})
+		return true
+	}
+	return false
+}
+
+// wrap requires authentication for every request to h
+func (s *serverSecurity) wrap(h http.Handler) http.Handler {
+	if !s.authRequired() {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authenticate(w, r) {
+			if s.basicUser != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="netgraph"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="netgraph"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// checkOrigin is the websocket handshake. It refuses the connections opened
+// by web pages of other sites, which would otherwise use the credentials of
+// the browser. Clients which are not browsers may send no Origin.
+func (s *serverSecurity) checkOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	config.Origin = origin
+	if origin == nil {
+		return nil
+	}
+	if len(s.allowedOrigins) == 0 {
+		if strings.EqualFold(origin.Host, r.Host) {
+			return nil
+		}
+	} else {
+		o := strings.ToLower(origin.Scheme + "://" + origin.Host)
+		for _, allowed := range s.allowedOrigins {
+			if allowed == "*" || strings.ToLower(strings.TrimSuffix(allowed, "/")) == o {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("origin %s is not allowed", origin)
+}
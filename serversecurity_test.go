@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTokenLogin(t *testing.T) {
+	security := &serverSecurity{token: "secret"}
+	s := new(NGServer)
+	h := security.wrap(http.HandlerFunc(s.handleStaticFile))
+
+	// the login link of the README sets the cookie and shows the page
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/?token=secret", nil))
+	if w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Fatalf("login failed: %d", w.Code)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != tokenCookie {
+		t.Fatalf("bad cookies %v", cookies)
+	}
+
+	r := httptest.NewRequest("GET", "/main.js", nil)
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("cookie refused: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/?token=bad", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("bad token accepted: %d", w.Code)
+	}
+}
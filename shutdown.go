@@ -0,0 +1,145 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ga0/netgraph/ngcapture"
+	"github.com/ga0/netgraph/ngnet"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// stopCapture is closed when netgraph is asked to exit
+var stopCapture = make(chan struct{})
+
+// reopenHandlers receives a value when the output files should be reopened
+var reopenHandlers = make(chan struct{}, 1)
+
+// reopener is implemented by the handlers writing files. The files are
+// reopened on SIGHUP, after logrotate moved them.
+type reopener interface {
+	Reopen() error
+}
+
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// handleSignals stops the capture on SIGINT and SIGTERM, the events of the
+// captured packets are still handled. A second one exits at once. SIGHUP
+// reopens the output files.
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			log.Println("Received SIGHUP, reopen output files")
+			notify(reopenHandlers)
+			continue
+		}
+		select {
+		case <-stopCapture:
+			log.Println("Received", sig, "again, exit now")
+			os.Exit(1)
+		default:
+			log.Println("Received", sig, "shutting down")
+			close(stopCapture)
+		}
+	}
+}
+
+func reopenOutputFiles() {
+	if rawPcap != nil {
+		if err := rawPcap.Reopen(); err != nil {
+			log.Println("Cannot reopen pcap file:", err)
+		}
+	}
+	for _, h := range handlers {
+		if r, ok := h.(reopener); ok {
+			if err := r.Reopen(); err != nil {
+				log.Println("Cannot reopen output file:", err)
+			}
+		}
+	}
+}
+
+// reopenOutputFile opens the file set by -o again and closes the old one.
+// The new file is appended to, in case it was not moved.
+func reopenOutputFile(name string, file *os.File) (*os.File, error) {
+	if name == "stdout" {
+		return file, nil
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0755)
+	if err != nil {
+		return file, err
+	}
+	file.Close()
+	return f, nil
+}
+
+// createPcapFile creates a pcap file and writes its header
+func createPcapFile(name string) (*os.File, *pcapgo.Writer, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	w := pcapgo.NewWriter(file)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, w, nil
+}
+
+// runSummary counts what netgraph captured, it is printed at exit
+type runSummary struct {
+	start      time.Time
+	packets    uint64
+	requests   uint
+	responses  uint
+	dnsQueries uint
+	sampledOut uint64
+	denied     uint64
+}
+
+var summary runSummary
+
+func (s *runSummary) count(e ngnet.Event) {
+	switch e.(type) {
+	case ngnet.HTTPRequestEvent:
+		s.requests++
+	case ngnet.HTTPResponseEvent:
+		s.responses++
+	case ngnet.DNSQueryEvent:
+		s.dnsQueries++
+	}
+}
+
+// setStats sets the counters of the capture, and logs the connections
+// dropped by the stream filter
+func (s *runSummary) setStats(stats ngcapture.Stats) {
+	s.packets = stats.Packets
+	if streamFilterSet() {
+		log.Printf("Dropped connections: %d sampled out, %d denied\n", stats.Filter.SampledOut, stats.Filter.Denied)
+		s.sampledOut = stats.Filter.SampledOut
+		s.denied = stats.Filter.Denied
+	}
+}
+
+func (s *runSummary) print() {
+	log.Printf("Summary: %d packets, %d HTTP requests, %d HTTP responses in %v\n",
+		s.packets, s.requests, s.responses, time.Since(s.start).Round(time.Millisecond))
+	if s.dnsQueries != 0 {
+		log.Printf("Summary: %d DNS queries\n", s.dnsQueries)
+	}
+	if s.sampledOut != 0 || s.denied != 0 {
+		log.Printf("Summary: %d connections sampled out, %d denied\n", s.sampledOut, s.denied)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+
+	"github.com/ga0/netgraph/ngfilter"
+	"github.com/ga0/netgraph/ngnet"
+	"github.com/ga0/netgraph/ngsink"
+)
+
+// sinkHandler forwards the HTTP events to a sink of -sink, in the JSON of
+// -format json. The records are keyed by transaction ID, so the events of a
+// transaction go to the same Kafka partition.
+type sinkHandler struct {
+	sink     *ngsink.Sink
+	recorder *jsonRecorder
+	buffer   bytes.Buffer
+	encoder  *json.Encoder
+}
+
+// newSinkHandler opens a sink. Besides the parameters of ngsink, the URL may
+// set "format" (event or pair) and "filter" (a filter expression), which are
+// removed before the sink is opened.
+func newSinkHandler(rawurl string) (NGHTTPEventHandler, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	params := u.Query()
+	format := params.Get("format")
+	expr := params.Get("filter")
+	params.Del("format")
+	params.Del("filter")
+	u.RawQuery = params.Encode()
+	var pair bool
+	switch format {
+	case "", "event":
+	case "pair":
+		pair = true
+	default:
+		return nil, fmt.Errorf("sink %s: unknown format %q, use event or pair", ngsink.Redact(u), format)
+	}
+	var filter *ngfilter.Filter
+	if expr != "" {
+		if filter, err = ngfilter.Parse(expr); err != nil {
+			return nil, fmt.Errorf("sink %s: %v", ngsink.Redact(u), err)
+		}
+	}
+	sink, err := ngsink.Open(u.String())
+	if err != nil {
+		return nil, err
+	}
+	h := new(sinkHandler)
+	h.sink = sink
+	h.recorder = newJSONRecorder(pair)
+	h.encoder = json.NewEncoder(&h.buffer)
+	h.encoder.SetEscapeHTML(false)
+	if filter != nil {
+		return newFilteredHandler(h, filter), nil
+	}
+	return h, nil
+}
+
+func (h *sinkHandler) add(r jsonRecord) {
+	h.buffer.Reset()
+	if err := h.encoder.Encode(r.value); err != nil {
+		log.Println("Cannot encode JSON:", err)
+		return
+	}
+	var key []byte
+	if r.id != "" {
+		key = []byte(r.id)
+	}
+	value := bytes.TrimSuffix(h.buffer.Bytes(), []byte("\n"))
+	h.sink.Add(ngsink.Record{
+		Time:  r.start,
+		Type:  r.kind,
+		Key:   key,
+		Value: append([]byte(nil), value...),
+	})
+}
+
+// PushEvent implements the function of interface NGHTTPEventHandler
+func (h *sinkHandler) PushEvent(e ngnet.Event) {
+	for _, r := range h.recorder.records(e) {
+		h.add(r)
+	}
+}
+
+// Reopen opens the file of a file sink again after it was rotated
+func (h *sinkHandler) Reopen() error {
+	return h.sink.Reopen()
+}
+
+// Wait implements the function of interface NGHTTPEventHandler, it sends
+// the buffered records before the shutdown timeout
+func (h *sinkHandler) Wait() {
+	for _, r := range h.recorder.unanswered() {
+		h.add(r)
+	}
+	if err := h.sink.Close(*shutdownTimeout); err != nil {
+		log.Printf("Cannot close sink %s: %v\n", h.sink, err)
+	}
+	st := h.sink.Stats()
+	log.Printf("Sink %s: %d sent, %d dropped, %d failed, %d truncated\n", h.sink, st.Sent, st.Dropped, st.Failed, st.Truncated)
+}
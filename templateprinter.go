@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/ga0/netgraph/ngnet"
+)
+
+// builtinTemplates can be selected by name with -template
+var builtinTemplates = map[string]string{
+	"combined": `{{.ClientIP}} - - [{{.Start.Format "02/Jan/2006:15:04:05 -0700"}}] ` +
+		`"{{.Method}} {{.URI}} {{.Version}}" {{if .HasResponse}}{{.Status}}{{else}}-{{end}} ` +
+		`{{if .ResponseSize}}{{.ResponseSize}}{{else}}-{{end}} ` +
+		`"{{or (header .RequestHeaders "Referer") "-"}}" "{{or (header .RequestHeaders "User-Agent") "-"}}"`,
+	"curl": `curl -X {{.Method}} {{shellquote .URL}}` +
+		`{{range .RequestHeaders}}{{if ne (lower .Name) "content-length"}} -H {{shellquote (printf "%s: %s" .Name .Value)}}{{end}}{{end}}` +
+		`{{if .RequestBody}} --data-binary {{shellquote .RequestBody}}{{end}}`,
+	"httpie": `{{if .RequestBody}}printf %s {{shellquote .RequestBody}} | {{end}}http {{.Method}} {{shellquote .URL}}` +
+		`{{range .RequestHeaders}}{{if ne (lower .Name) "content-length"}} {{shellquote (printf "%s:%s" .Name .Value)}}{{end}}{{end}}`,
+	"summary": `{{.Start.Format "2006-01-02 15:04:05.000"}} #{{.StreamSeq}} {{.Method}} {{.Host}} {{.Path}} ` +
+		`{{if .HasResponse}}{{.Status}} {{ms .Duration}}ms {{.ResponseSize}}{{else}}- - -{{end}}`,
+}
+
+// templateData is the data a template is rendered with, once per transaction.
+// Response fields are empty if the response was not captured.
+type templateData struct {
+	ID         string        // transaction id, "StreamSeq.n"
+	StreamSeq  uint          // sequence number of the TCP connection
+	Start      time.Time     // first packet of the request
+	End        time.Time     // last packet of the response (or request)
+	Duration   time.Duration // End - Start
+	ClientAddr string        // ip:port
+	ServerAddr string        // ip:port
+	ClientIP   string
+	ServerIP   string
+	ClientName string // DNS name of the client IP, if captured
+	ServerName string // DNS name of the server IP, if captured
+
+	Method         string
+	URI            string // as in the request line
+	URL            string // absolute URL built with the Host header
+	Host           string
+	Path           string
+	Route          string // route template of the path, like /users/{id}
+	Query          string
+	Version        string
+	RequestHeaders []ngnet.HTTPHeaderItem
+	RequestBody    string
+	RequestSize    int
+
+	HasResponse     bool
+	Status          uint
+	Reason          string
+	ResponseVersion string
+	ResponseHeaders []ngnet.HTTPHeaderItem
+	ResponseBody    string
+	ResponseSize    int
+
+	Request  ngnet.HTTPRequestEvent
+	Response *ngnet.HTTPResponseEvent
+}
+
+func hostOf(addr string) string {
+	if p := strings.LastIndex(addr, ":"); p != -1 {
+		return addr[:p]
+	}
+	return addr
+}
+
+func newTemplateData(t *httpTransaction) *templateData {
+	req := t.Request
+	d := new(templateData)
+	d.ID = t.ID
+	d.StreamSeq = req.StreamSeq
+	d.Start = req.Start
+	d.End = req.End
+	d.ClientAddr = req.ClientAddr
+	d.ServerAddr = req.ServerAddr
+	d.ClientIP = hostOf(req.ClientAddr)
+	d.ServerIP = hostOf(req.ServerAddr)
+	d.ClientName = req.ClientName
+	d.ServerName = req.ServerName
+	d.Method = req.Method
+	d.URI = req.URI
+	d.Route = req.Route
+	d.URL = requestURL(req)
+	d.Host = headerValue(req.Headers, "Host")
+	d.Path = req.URI
+	if u, err := url.Parse(d.URL); err == nil {
+		d.Path = u.Path
+		d.Query = u.RawQuery
+		if d.Host == "" {
+			d.Host = u.Host
+		}
+	}
+	d.Version = req.Version
+	d.RequestHeaders = req.Headers
+	d.RequestBody = string(req.Body)
+	d.RequestSize = len(req.Body)
+	d.Request = req
+
+	if resp := t.Response; resp != nil {
+		d.HasResponse = true
+		d.End = resp.End
+		d.Status = resp.Code
+		d.Reason = resp.Reason
+		d.ResponseVersion = resp.Version
+		d.ResponseHeaders = resp.Headers
+		d.ResponseBody = string(resp.Body)
+		d.ResponseSize = len(resp.Body)
+		d.Response = resp
+	}
+	d.Duration = d.End.Sub(d.Start)
+	return d
+}
+
+// shellQuote quotes s for POSIX shells
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+var templateFuncs = template.FuncMap{
+	"header":     headerValue,
+	"shellquote": shellQuote,
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"ms": func(d time.Duration) string {
+		return fmt.Sprintf("%.3f", milliseconds(d))
+	},
+}
+
+// parseOutputTemplate parses a built-in template name, a template text or a template file
+func parseOutputTemplate(text string, file string) (*template.Template, error) {
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		text = string(b)
+	} else if builtin, ok := builtinTemplates[text]; ok {
+		text = builtin
+	}
+	return template.New("output").Funcs(templateFuncs).Parse(text)
+}
+
+// TemplatePrinter renders a text/template for each HTTP transaction
+type TemplatePrinter struct {
+	name     string
+	file     *os.File
+	template *template.Template
+	pairer   *transactionPairer
+	buffer   bytes.Buffer
+}
+
+// NewTemplatePrinter creates TemplatePrinter
+func NewTemplatePrinter(name string, tmpl *template.Template) *TemplatePrinter {
+	p := new(TemplatePrinter)
+	p.name = name
+	p.file = openOutputFile(name)
+	p.template = tmpl
+	p.pairer = newTransactionPairer()
+	p.pairer.expired = p.render
+	return p
+}
+
+func (p *TemplatePrinter) render(t *httpTransaction) {
+	p.buffer.Reset()
+	if err := p.template.Execute(&p.buffer, newTemplateData(t)); err != nil {
+		log.Println("Cannot render template:", err)
+		return
+	}
+	if p.buffer.Len() == 0 {
+		return
+	}
+	if !bytes.HasSuffix(p.buffer.Bytes(), []byte("\n")) {
+		p.buffer.WriteByte('\n')
+	}
+	p.file.Write(p.buffer.Bytes())
+}
+
+// PushEvent implements the function of interface NGHTTPEventHandler
+func (p *TemplatePrinter) PushEvent(e ngnet.Event) {
+	if t, completed := p.pairer.push(e); completed {
+		p.render(t)
+	}
+}
+
+// Reopen opens the output file again after it was rotated
+func (p *TemplatePrinter) Reopen() (err error) {
+	p.file, err = reopenOutputFile(p.name, p.file)
+	return err
+}
+
+// Wait implements the function of interface NGHTTPEventHandler
+func (p *TemplatePrinter) Wait() {
+	for _, t := range p.pairer.unanswered() {
+		p.render(t)
+	}
+	if p.file != os.Stdout {
+		p.file.Close()
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ga0/netgraph/ngnet"
+)
+
+// httpTransaction is an HTTP request and its response.
+// Response is nil if the response has not been captured.
+type httpTransaction = ngnet.TransactionEvent
+
+// requestHost returns the lower case Host header of the request, or the
+// server IP if there is none
+func requestHost(req ngnet.HTTPRequestEvent) string {
+	if host := headerValue(req.Headers, "Host"); host != "" {
+		return strings.ToLower(host)
+	}
+	return hostOf(req.ServerAddr)
+}
+
+// pendingTimeout is the time after which a request without response is
+// forgotten, like the TCP assembler closes the idle connections
+const pendingTimeout = 2 * time.Minute
+
+// transactionPairer matches the responses to their requests
+// by StreamSeq and RequestSeq. The requests still without response
+// pendingTimeout after the newest request are forgotten.
+type transactionPairer struct {
+	pending    map[string]*httpTransaction
+	newest     time.Time // start of the newest request
+	lastExpiry time.Time // newest when the old requests were last forgotten
+	// expired is called, if set, with the requests forgotten without response
+	expired func(t *httpTransaction)
+}
+
+func newTransactionPairer() *transactionPairer {
+	p := new(transactionPairer)
+	p.pending = make(map[string]*httpTransaction)
+	return p
+}
+
+// push adds an event and returns the transaction it completed, if any.
+// The returned transaction of a request is not complete until its response is pushed.
+func (p *transactionPairer) push(e ngnet.Event) (t *httpTransaction, completed bool) {
+	switch v := e.(type) {
+	case ngnet.HTTPRequestEvent:
+		if v.Start.After(p.newest) {
+			p.newest = v.Start
+		}
+		if p.newest.Sub(p.lastExpiry) >= pendingTimeout/2 {
+			p.forget(p.newest.Add(-pendingTimeout))
+			p.lastExpiry = p.newest
+		}
+		t = ngnet.NewTransactionEvent(v)
+		p.pending[t.ID] = t
+		return t, false
+	case ngnet.HTTPResponseEvent:
+		id := ngnet.TransactionID(v.StreamSeq, v.RequestSeq)
+		t = p.pending[id]
+		if t == nil {
+			return nil, false
+		}
+		delete(p.pending, id)
+		resp := v
+		t.Response = &resp
+		return t, true
+	}
+	return nil, false
+}
+
+// forget drops the requests sent before t which are still waiting for
+// their responses
+func (p *transactionPairer) forget(t time.Time) {
+	var forgotten []*httpTransaction
+	for id, pending := range p.pending {
+		if pending.Request.Start.Before(t) {
+			delete(p.pending, id)
+			forgotten = append(forgotten, pending)
+		}
+	}
+	if p.expired != nil {
+		sortTransactions(forgotten)
+		for _, pending := range forgotten {
+			p.expired(pending)
+		}
+	}
+}
+
+// unanswered returns the requests still waiting for their responses
+func (p *transactionPairer) unanswered() []*httpTransaction {
+	var ts []*httpTransaction
+	for _, t := range p.pending {
+		ts = append(ts, t)
+	}
+	sortTransactions(ts)
+	return ts
+}
+
+// sortTransactions sorts transactions by the start of their request
+func sortTransactions(ts []*httpTransaction) {
+	sort.Slice(ts, func(i, j int) bool {
+		return ts[i].Request.Start.Before(ts[j].Request.Start)
+	})
+}
+
+// pairEvents pairs a list of events into transactions, ordered by request.
+func pairEvents(events []ngnet.Event) []*httpTransaction {
+	p := newTransactionPairer()
+	var ts []*httpTransaction
+	for _, e := range events {
+		if t, completed := p.push(e); t != nil && !completed {
+			ts = append(ts, t)
+		}
+	}
+	return ts
+}
@@ -46,6 +46,18 @@ angular.module('ngFilter', []).filter('reqFilter', function() {
                         return false;
                     return item.Response.Code == parseInt(pattern)
                 };
+            } else if (filterType == "Process") {
+                return function(item) {
+                    var procs = [item.ClientProcess, item.ServerProcess];
+                    for (var i = 0; i < procs.length; ++i) {
+                        var p = procs[i];
+                        if (p && (String(p.PID) == pattern || p.Exe.indexOf(pattern) != -1 ||
+                                p.Cmdline.indexOf(pattern) != -1 || p.User == pattern ||
+                                (p.ContainerID && p.ContainerID.indexOf(pattern) == 0)))
+                            return true;
+                    }
+                    return false;
+                };
             } else if (filterType == "RequestBody") {
                 return function(item) {
                     return item.Body.indexOf(pattern) != -1;
@@ -68,23 +80,233 @@ angular.module('ngFilter', []).filter('reqFilter', function() {
         return result;
     };
 });
-var app = angular.module('netgraph', ['angular-websocket', 'ngFilter'])
+angular.module('ngGraph', []).directive('dependencyGraph', function() {
+    // draws the nodes and edges of /api/graph in an SVG element, placed by a
+    // force simulation, the nodes can be dragged
+    var svgNS = "http://www.w3.org/2000/svg";
+    function el(name, attrs, parent) {
+        var e = document.createElementNS(svgNS, name);
+        for (var k in attrs) {
+            e.setAttribute(k, attrs[k]);
+        }
+        if (parent) {
+            parent.appendChild(e);
+        }
+        return e;
+    }
+    function title(e, text) {
+        el("title", {}, e).textContent = text;
+    }
+    return {
+        restrict: 'A',
+        scope: {graph: '=dependencyGraph'},
+        link: function(scope, element) {
+            var width = 1000, height = 500;
+            var svg = el("svg", {width: "100%", height: height, viewBox: "0 0 " + width + " " + height});
+            element[0].appendChild(svg);
+            var defs = el("defs", {}, svg);
+            var marker = el("marker", {id: "arrow", viewBox: "0 0 10 10", refX: 10, refY: 5,
+                markerWidth: 6, markerHeight: 6, orient: "auto"}, defs);
+            el("path", {d: "M 0 0 L 10 5 L 0 10 z"}, marker);
+            var edgeLayer = el("g", {}, svg);
+            var nodeLayer = el("g", {}, svg);
+
+            var positions = {}; // node id -> {x, y, vx, vy}, kept between updates
+            var nodes = [], edges = [];
+            var dragged = null;
+            var ticks = 0;
+
+            function edgeColor(e) {
+                if (e.server_error_rate > 0) {
+                    return "red";
+                }
+                return e.client_error_rate > 0 ? "orange" : "#555";
+            }
+            function render(graph) {
+                while (edgeLayer.firstChild) {
+                    edgeLayer.removeChild(edgeLayer.firstChild);
+                }
+                while (nodeLayer.firstChild) {
+                    nodeLayer.removeChild(nodeLayer.firstChild);
+                }
+                nodes = [];
+                edges = [];
+                var byID = {};
+                angular.forEach(graph.nodes, function(n) {
+                    var p = positions[n.id];
+                    if (!p) {
+                        p = positions[n.id] = {x: width / 2 + (Math.random() - 0.5) * width / 2,
+                            y: height / 2 + (Math.random() - 0.5) * height / 2, vx: 0, vy: 0};
+                    }
+                    var g = el("g", {"class": "node " + n.kind}, nodeLayer);
+                    var shape = n.kind == "client" ? el("circle", {r: 8}, g) : el("rect", {x: -9, y: -9, width: 18, height: 18}, g);
+                    el("text", {x: 12, y: 4}, g).textContent = n.id;
+                    title(g, n.id + " (" + n.kind + ")\n" + n.addresses.join(", ") +
+                        "\nrequests in: " + n.requests_in + ", out: " + n.requests_out);
+                    var node = {data: n, pos: p, el: g};
+                    shape.addEventListener("mousedown", function(ev) {
+                        dragged = node;
+                        ev.preventDefault();
+                    });
+                    byID[n.id] = node;
+                    nodes.push(node);
+                });
+                angular.forEach(graph.edges, function(e) {
+                    var from = byID[e.from], to = byID[e.to];
+                    if (!from || !to) {
+                        return;
+                    }
+                    var line = el("line", {stroke: edgeColor(e), "marker-end": "url(#arrow)",
+                        "stroke-width": Math.min(1 + Math.log(1 + e.rate), 6)}, edgeLayer);
+                    title(line, e.from + " -> " + e.to + "\n" + e.requests + " requests, " + e.rate.toFixed(2) + "/s" +
+                        "\n4xx: " + (e.client_error_rate * 100).toFixed(1) + "%, 5xx: " + (e.server_error_rate * 100).toFixed(1) + "%" +
+                        "\np50: " + e.p50_ms.toFixed(1) + " ms, p99: " + e.p99_ms.toFixed(1) + " ms");
+                    edges.push({from: from, to: to, el: line});
+                });
+                ticks = 300;
+                draw();
+            }
+            function step() {
+                var i, j, a, b, dx, dy, d, f;
+                for (i = 0; i < nodes.length; i++) {
+                    a = nodes[i].pos;
+                    for (j = i + 1; j < nodes.length; j++) {
+                        b = nodes[j].pos;
+                        dx = a.x - b.x;
+                        dy = a.y - b.y;
+                        d = Math.max(Math.sqrt(dx * dx + dy * dy), 1);
+                        f = 2000 / (d * d);
+                        a.vx += f * dx / d;
+                        a.vy += f * dy / d;
+                        b.vx -= f * dx / d;
+                        b.vy -= f * dy / d;
+                    }
+                }
+                angular.forEach(edges, function(e) {
+                    var a = e.from.pos, b = e.to.pos;
+                    var dx = b.x - a.x, dy = b.y - a.y;
+                    var d = Math.max(Math.sqrt(dx * dx + dy * dy), 1);
+                    var f = (d - 150) * 0.02;
+                    a.vx += f * dx / d;
+                    a.vy += f * dy / d;
+                    b.vx -= f * dx / d;
+                    b.vy -= f * dy / d;
+                });
+                angular.forEach(nodes, function(n) {
+                    var p = n.pos;
+                    p.vx = (p.vx + (width / 2 - p.x) * 0.002) * 0.8;
+                    p.vy = (p.vy + (height / 2 - p.y) * 0.002) * 0.8;
+                    if (n !== dragged) {
+                        p.x = Math.max(20, Math.min(width - 20, p.x + p.vx));
+                        p.y = Math.max(20, Math.min(height - 20, p.y + p.vy));
+                    }
+                });
+            }
+            function draw() {
+                angular.forEach(nodes, function(n) {
+                    n.el.setAttribute("transform", "translate(" + n.pos.x + "," + n.pos.y + ")");
+                });
+                angular.forEach(edges, function(e) {
+                    var a = e.from.pos, b = e.to.pos;
+                    var dx = b.x - a.x, dy = b.y - a.y;
+                    var d = Math.max(Math.sqrt(dx * dx + dy * dy), 1);
+                    // stop the arrow at the border of the target
+                    e.el.setAttribute("x1", a.x);
+                    e.el.setAttribute("y1", a.y);
+                    e.el.setAttribute("x2", b.x - dx / d * 12);
+                    e.el.setAttribute("y2", b.y - dy / d * 12);
+                });
+            }
+            var frame = null;
+            function animate() {
+                frame = window.requestAnimationFrame(animate);
+                if (ticks > 0 || dragged) {
+                    ticks = Math.max(ticks - 1, 0);
+                    step();
+                    draw();
+                }
+            }
+            animate();
+            function svgPoint(ev) {
+                var pt = svg.createSVGPoint();
+                pt.x = ev.clientX;
+                pt.y = ev.clientY;
+                return pt.matrixTransform(svg.getScreenCTM().inverse());
+            }
+            svg.addEventListener("mousemove", function(ev) {
+                if (dragged) {
+                    var p = svgPoint(ev);
+                    dragged.pos.x = p.x;
+                    dragged.pos.y = p.y;
+                    ticks = 100;
+                }
+            });
+            window.addEventListener("mouseup", function() {
+                dragged = null;
+            });
+            scope.$watch('graph.version', function() {
+                if (scope.graph) {
+                    render(scope.graph);
+                }
+            });
+            scope.$on('$destroy', function() {
+                window.cancelAnimationFrame(frame);
+            });
+        }
+    };
+});
+var app = angular.module('netgraph', ['angular-websocket', 'ngFilter', 'ngGraph'])
 app.factory('netdata', function($websocket) {
-    var dataStream = $websocket("ws://" + location.host + "/data");
-    var streams = {};
+    var scheme = location.protocol == "https:" ? "wss://" : "ws://";
+    var dataStream = $websocket(scheme + location.host + "/data");
+    var requests = {}; // by event ID
     var reqs = [];
+    var status = {dropped: 0, paused: false};
+    var endpoints = {shown: false, window: "5m", list: [], order: "requests", reverse: true, error: ""};
+    var graph = {shown: false, group: "host", nodes: [], edges: [], version: 0, error: ""};
+    var requestID = 0;
+    function command(name, args) {
+        var cmd = args || {};
+        cmd.version = 1;
+        cmd.request_id = ++requestID;
+        cmd.command = name;
+        dataStream.send(JSON.stringify(cmd));
+    }
     dataStream.onMessage(function(message) {
         var e = JSON.parse(message.data);
-        if (!(e.StreamSeq in streams)) {
-            streams[e.StreamSeq] = [];
+        if (e.Type == "Reply") {
+            if (e.Error) {
+                console.error("command " + e.Command + " failed: " + e.Error);
+            }
+            if (e.Command == "endpoints") {
+                endpoints.error = e.Error || "";
+                endpoints.list = e.Result ? e.Result.endpoints : [];
+            }
+            if (e.Command == "graph") {
+                graph.error = e.Error || "";
+                graph.nodes = e.Result ? e.Result.nodes : [];
+                graph.edges = e.Result ? e.Result.edges : [];
+                graph.version++;
+            }
+            return;
+        }
+        if (e.Type == "Dropped") {
+            status.dropped = e.Count;
+            return;
+        }
+        if (e.Type == "StoreStats") {
+            status.store = e;
+            return;
+        }
+        if (e.Type == "DNSQuery" || e.Type == "Transaction") {
+            return;
         }
-        var stream = streams[e.StreamSeq];
         if (e.Type == "HTTPRequest") {
             e.Start = new Date(e.Start)
             if (e.Body) {
                 e.Body = Base64.decode(e.Body)
             }
-            stream.push(e);
+            requests[e.ID] = e;
             reqs.push(e);
             //add Host
             for (var i = 0; i < e.Headers.length; ++i) {
@@ -94,15 +316,18 @@ app.factory('netdata', function($websocket) {
                     break;
                 }
             }
+            if (!e.Host && e.ServerName) {
+                e.Host = e.ServerName;
+            }
         } else if (e.Type == "HTTPResponse") {
             if (e.Body) {
                 e.Body = Base64.decode(e.Body)
             }
-            
-            if (stream.length > 0) {
-                var req = stream[stream.length-1]
+
+            var req = requests[e.RequestID];
+            if (req) {
                 if (req.Response) {
-                    console.error("duplicate response in stream #" + e.StreamSeq + " URI:" + req.URI
+                    console.error("duplicate response " + e.ID + " URI:" + req.URI
                         + "\nold:", req.Response, "\nnew:", e)
                 } else {
                     req.Response = e;
@@ -113,15 +338,80 @@ app.factory('netdata', function($websocket) {
     });
     var data = {
         reqs: reqs,
-        streams: streams,
+        requests: requests,
+        status: status,
+        endpoints: endpoints,
+        refreshEndpoints: function() {
+            command("endpoints", {window: endpoints.window, limit: 1000});
+        },
+        graph: graph,
+        refreshGraph: function() {
+            command("graph", {group: graph.group});
+        },
         sync: function() {
-            dataStream.send("sync");
+            command("sync");
+        },
+        pause: function() {
+            status.paused = true;
+            command("pause");
+        },
+        resume: function() {
+            status.paused = false;
+            command("resume");
+        },
+        clear: function() {
+            command("clear");
+            reqs.length = 0;
+            for (var id in requests) {
+                delete requests[id];
+            }
         }
     };
     return data;
 })
-app.controller('HttpListCtrl', function ($scope, netdata) {
+app.controller('HttpListCtrl', function ($scope, $interval, netdata) {
     $scope.reqs = netdata.reqs;
+    $scope.status = netdata.status;
+    $scope.endpoints = netdata.endpoints;
+    $scope.refreshEndpoints = netdata.refreshEndpoints;
+    var endpointsTimer = null;
+    $scope.showEndpoints = function(shown) {
+        netdata.endpoints.shown = shown;
+        if (endpointsTimer) {
+            $interval.cancel(endpointsTimer);
+            endpointsTimer = null;
+        }
+        if (shown) {
+            netdata.refreshEndpoints();
+            endpointsTimer = $interval(netdata.refreshEndpoints, 5000);
+        }
+    }
+    $scope.graph = netdata.graph;
+    $scope.refreshGraph = netdata.refreshGraph;
+    var graphTimer = null;
+    $scope.showGraph = function(shown) {
+        netdata.graph.shown = shown;
+        if (graphTimer) {
+            $interval.cancel(graphTimer);
+            graphTimer = null;
+        }
+        if (shown) {
+            netdata.refreshGraph();
+            graphTimer = $interval(netdata.refreshGraph, 5000);
+        }
+    }
+    $scope.sortEndpoints = function(field) {
+        var ep = netdata.endpoints;
+        if (ep.order == field) {
+            ep.reverse = !ep.reverse;
+        } else {
+            ep.order = field;
+            ep.reverse = field != "host" && field != "route";
+        }
+    }
+    $scope.pause = netdata.pause;
+    $scope.resume = netdata.resume;
+    $scope.clear = netdata.clear;
     $scope.showDetail = function($event, req) {
         $scope.selectedReq = req;
         var tr = $event.currentTarget;
@@ -140,6 +430,16 @@ app.controller('HttpListCtrl', function ($scope, netdata) {
         }
         return null;
     }
+    $scope.describeProcess = function(p) {
+        if (!p) {
+            return "";
+        }
+        var s = p.PID + " " + p.Cmdline + " (" + p.User + ")";
+        if (p.ContainerID) {
+            s += " container " + p.ContainerID.substring(0, 12);
+        }
+        return s;
+    }
     $scope.selectedRow = null;
     $scope.filterType = "URI";
     $scope.order = "Start";